@@ -0,0 +1,201 @@
+package track
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCHIVES -- ExportArchive writes a range of a track's messages to a single gzipped tar
+// file, for cold storage. Unlike a raw copy of the chunks it doesn't depend on the chunk
+// size or header layout, and it's compressed as a whole rather than message by message.
+// The tar holds two files:
+//
+//	track:    VERSION FROM END ID, on one line
+//	messages: the messages from FROM up to END, framed by their lengths as uvarints,
+//	          in the format written by WriteTo and Tee
+
+const (
+	archiveVersion  = 1
+	archiveMeta     = "track"
+	archiveMessages = "messages"
+)
+
+// ExportArchive writes the messages from fromOffset up to the latest offset to a new
+// archive at path, replacing any file already there. Messages written while it runs aren't
+// included. Trimming, truncation, compaction and merging wait until it's done, so that the
+// messages can't change under it. Offsets which have been trimmed give ErrOffsetTrimmed
+func (t *Track) ExportArchive(path string, fromOffset uint64) (err error) {
+	defer recoverPanic(&err)
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+
+	end, size, err := t.framedSize(fromOffset)
+	if err != nil {
+		return err
+	}
+	r, err := t.ReaderAt(fromOffset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	r.snapshot = true
+	r.snapshotEnd = end
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(f, r, fmt.Sprintf("%d %d %d %s\n", archiveVersion, fromOffset, end, t.Id), size)
+	err = firstErr(err, f.Sync(), f.Close())
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Find the end of the track, and the number of bytes the messages from the given offset
+// up to it take once framed
+func (t *Track) framedSize(from uint64) (end, size uint64, err error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	end = t.latestOffset()
+	if from > end {
+		return 0, 0, fmt.Errorf("Cannot export from offset %d, past the end of the track at %d", from, end)
+	}
+	for offset := from; offset < end; offset++ {
+		n, i := t.locate(offset)
+		if n < 0 {
+			return 0, 0, ErrOffsetTrimmed
+		}
+		msgSize, err := t.stores[n].SizeOf(i)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += uint64(frameLen(msgSize)) + msgSize
+	}
+	return end, size, nil
+}
+
+// Write the archive's files to w, copying the messages from r, which must take exactly
+// size bytes once framed
+func writeArchive(w io.Writer, r *StorageReader, meta string, size uint64) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	err := tw.WriteHeader(&tar.Header{Name: archiveMeta, Mode: 0644, Size: int64(len(meta)), ModTime: now})
+	if err == nil {
+		_, err = io.WriteString(tw, meta)
+	}
+	if err == nil {
+		err = tw.WriteHeader(&tar.Header{Name: archiveMessages, Mode: 0644, Size: int64(size), ModTime: now})
+	}
+	if err == nil {
+		_, err = r.WriteTo(tw)
+	}
+	if err == nil {
+		err = tw.Close() // Fails if fewer bytes were written than the header said
+	}
+	return firstErr(err, gz.Close())
+}
+
+// ImportArchive creates a new track with the given root and id from an archive written by
+// ExportArchive. Its offsets start from 0, so the message which was at the archive's first
+// offset is at 0 in the new track. Returns the new track, still open for writing. If the
+// import fails, the new track's files are deleted
+func ImportArchive(root, id, path string) (*Track, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	from, end, err := readArchiveMeta(tr)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := tr.Next()
+	if err == nil && hdr.Name != archiveMessages {
+		err = fmt.Errorf("Expected %q in the archive, found %q", archiveMessages, hdr.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := NewTrackWithConfig(root, id, DefaultTrackConfig())
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(tr)
+	var count uint64
+	for {
+		msg, err := readFramed(r)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = t.WriteMessage(msg)
+		}
+		if err != nil {
+			t.discard()
+			return nil, err
+		}
+		count++
+	}
+	if count != end-from {
+		t.discard()
+		return nil, fmt.Errorf("Archive holds %d messages, expected %d", count, end-from)
+	}
+	// Any write which failed has stopped the writer, which Sync reports
+	err = t.Sync()
+	if err != nil {
+		t.discard()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Read the archive's description of the messages in it, and return their range of offsets
+func readArchiveMeta(tr *tar.Reader) (from, end uint64, err error) {
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, err
+	} else if hdr.Name != archiveMeta {
+		return 0, 0, fmt.Errorf("Expected %q in the archive, found %q", archiveMeta, hdr.Name)
+	}
+	line, err := bufio.NewReader(tr).ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+	if len(fields) != 4 {
+		return 0, 0, fmt.Errorf("Malformed archive description %q", line)
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err == nil && version != archiveVersion {
+		return 0, 0, fmt.Errorf("Unsupported archive version %d", version)
+	}
+	if err == nil {
+		from, err = strconv.ParseUint(fields[1], 10, 64)
+	}
+	if err == nil {
+		end, err = strconv.ParseUint(fields[2], 10, 64)
+	}
+	if err == nil && end < from {
+		err = fmt.Errorf("Malformed archive description %q", line)
+	}
+	return from, end, err
+}
@@ -0,0 +1,74 @@
+package track
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	cleanupTrackId("imported")
+	defer cleanupTrackId("imported")
+	path := "id.tar.gz"
+	defer os.Remove(path)
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	for i := 0; i < 13; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprint("message ", i))), t)
+	}
+	_, err := track.WriteMessageCommit(nil) // Empty, like a compacted message
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.ExportArchive(path, 3), t)
+	// Written after the export, so not in the archive
+	testutils.CheckErr(track.WriteMessage([]byte("later")), t)
+
+	imported, err := ImportArchive("", "imported", path)
+	testutils.CheckErr(err, t)
+	defer imported.Close()
+	testutils.CheckUint64(11, imported.LatestOffset(), t)
+	testutils.ExpectTrue(len(imported.stores) > 1, "Expected the import to span several chunks", t)
+	r, err := imported.ReaderSnapshotAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := 3; i < 13; i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprint("message ", i), string(msg), t)
+	}
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, len(msg), t)
+
+	testutils.ExpectTrue(track.ExportArchive(path, 100) != nil, "Expected an export past the end to fail", t)
+}
+
+func TestImportTruncatedArchive(t *testing.T) {
+	cleanupTrack()
+	cleanupTrackId("imported")
+	defer cleanupTrackId("imported")
+	path := "id.tar.gz"
+	defer os.Remove(path)
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	for i := 0; i < 100; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	testutils.CheckErr(track.ExportArchive(path, 0), t)
+	info, err := os.Stat(path)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(os.Truncate(path, info.Size()/2), t)
+
+	_, err = ImportArchive("", "imported", path)
+	testutils.ExpectTrue(err != nil, "Expected importing a truncated archive to fail", t)
+	chunks, err := discoverChunks("", "imported", DefaultChunkNamer{})
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, len(chunks), t)
+}
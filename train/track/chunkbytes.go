@@ -0,0 +1,83 @@
+package track
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// With MaxChunkBytes set, a chunk can fill up with bytes before it has CHUNK_SIZE messages.
+// It's then sealed early: its offset table is cut down to the messages it holds, so that
+// it's full, and the next chunk starts at the next offset as usual. That costs a copy of the
+// chunk, unless its offset table is in a sidecar, as with Grow. Readers part way through
+// the chunk carry on with the old file, which holds the same messages
+
+// ErrMessageTooLarge is returned for messages which are bigger than MaxChunkBytes
+var ErrMessageTooLarge = errors.New("Message is bigger than a chunk can hold")
+
+// ErrNoRoomInChunk is returned for messages which don't fit in the bytes left in the
+// active chunk, when OnOversizedForChunk is Reject
+var ErrNoRoomInChunk = errors.New("Message doesn't fit in the active chunk")
+
+// The number of bytes of messages the store holds
+func (store *FileStorage) dataBytes() uint64 {
+	return store.index[store.Size] - store.index[0]
+}
+
+// Whether a message of the given size fits in the bytes left in the store
+func (t *Track) fitsInChunk(store *FileStorage, size uint64) bool {
+	max := t.config.MaxChunkBytes
+	return max == 0 || store.dataBytes()+size <= max
+}
+
+// Fail requests holding a message which could never fit in a chunk
+func (t *Track) checkMessageSizes(req writeRequest) error {
+	max := t.config.MaxChunkBytes
+	if max == 0 {
+		return nil
+	}
+	for _, msg := range req.batch {
+		if uint64(len(msg)) > max {
+			return ErrMessageTooLarge
+		}
+	}
+	if req.batch == nil && chunkBytesNeeded(req, false) > max {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// The number of the messages, from the start, which fit in the bytes left in the store
+func (t *Track) messagesFitting(store *FileStorage, msgs [][]byte) int {
+	if t.config.MaxChunkBytes == 0 {
+		return len(msgs)
+	}
+	used := store.dataBytes()
+	for i, msg := range msgs {
+		used += uint64(len(msg))
+		if used > t.config.MaxChunkBytes {
+			return i
+		}
+	}
+	return len(msgs)
+}
+
+// Seal the active store before it's full, once a message doesn't fit in its bytes. Returns
+// ErrTrackFull if there'd be no room for another chunk, in which case it's left as it is.
+// Must only be called by the writer
+func (t *Track) sealEarly(active *FileStorage) error {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	if t.config.MaxChunks > 0 && len(t.stores) >= t.config.MaxChunks {
+		return ErrTrackFull
+	}
+	// Readers hold dataCond.L to look at the header, so they never see it half shrunk
+	err := active.shrinkToFit()
+	if err == nil {
+		atomic.AddUint64(&t.syncs, 1)
+		err = active.seal()
+	}
+	if err == nil {
+		t.setDurable(active.baseOffset + active.Size)
+	}
+	return err
+}
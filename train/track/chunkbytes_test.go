@@ -0,0 +1,113 @@
+package track
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func chunkBytesConfig(policy OversizePolicy) TrackConfig {
+	config := DefaultTrackConfig()
+	config.MaxChunkBytes = 100
+	config.OnOversizedForChunk = policy
+	return config
+}
+
+func TestSealAndRetry(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 10
+	for _, sidecar := range []bool{false, true} {
+		INDEX_SIDECAR = sidecar
+		cleanupTrack()
+		track, err := NewTrackWithConfig("", "id", chunkBytesConfig(SealAndRetry))
+		testutils.CheckErr(err, t)
+		r, err := track.ReaderAt(0)
+		testutils.CheckErr(err, t)
+
+		// 60 bytes, and then a message which only fits in a fresh chunk
+		msgs := [][]byte{bytes.Repeat([]byte("a"), 30), bytes.Repeat([]byte("b"), 30), bytes.Repeat([]byte("c"), 70)}
+		for _, msg := range msgs[:2] {
+			testutils.CheckErr(track.WriteMessage(msg), t)
+		}
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[0], msg, t)
+		offset, err := track.WriteMessageCommit(msgs[2])
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(2, offset, t)
+		testutils.CheckInt(2, len(track.stores), t)
+		testutils.CheckUint64(2, track.stores[0].Capacity, t)
+		testutils.ExpectTrue(track.stores[0].sealed, "Expected the first chunk to be sealed early", t)
+
+		// The reader part way through the first chunk moves on to the second
+		for _, expected := range msgs[1:] {
+			msg, err = r.Next()
+			testutils.CheckErr(err, t)
+			testutils.CheckByteSlice(expected, msg, t)
+		}
+		r.Close()
+
+		// A batch is split between chunks by bytes
+		batch := make([][]byte, 5)
+		for i := range batch {
+			batch[i] = bytes.Repeat([]byte{byte('d' + i)}, 20)
+		}
+		offset, err = track.WriteMessages(batch)
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(3, offset, t)
+		testutils.CheckInt(3, len(track.stores), t)
+		testutils.CheckUint64(2, track.stores[1].Size, t)
+
+		_, err = track.WriteMessageCommit(bytes.Repeat([]byte("z"), 101))
+		testutils.ExpectTrue(err == ErrMessageTooLarge, fmt.Sprintf("Expected ErrMessageTooLarge, got %v", err), t)
+		testutils.CheckErr(track.Close(), t)
+
+		track, err = OpenTrackWithConfig("", "id", chunkBytesConfig(SealAndRetry))
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(8, track.LatestOffset(), t)
+		testutils.CheckErr(track.Verify(), t)
+		r, err = track.ReaderAt(0)
+		testutils.CheckErr(err, t)
+		for _, expected := range append(msgs, batch...) {
+			msg, err = r.Next()
+			testutils.CheckErr(err, t)
+			testutils.CheckByteSlice(expected, msg, t)
+		}
+		r.Close()
+		testutils.CheckErr(track.Close(), t)
+	}
+	INDEX_SIDECAR = false
+	cleanupTrack()
+}
+
+func TestRejectOversized(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 10
+	cleanupTrack()
+	config := chunkBytesConfig(Reject)
+	config.MaxChunks = 2
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	big := bytes.Repeat([]byte("b"), 70)
+	testutils.CheckErr(track.WriteMessage(bytes.Repeat([]byte("a"), 60)), t)
+	_, err = track.WriteMessageCommit(big)
+	testutils.ExpectTrue(err == ErrNoRoomInChunk, fmt.Sprintf("Expected ErrNoRoomInChunk, got %v", err), t)
+	testutils.CheckUint64(1, track.LatestOffset(), t)
+
+	// The chunk was sealed anyway, so the message fits when it's written again
+	offset, err := track.WriteMessageCommit(big)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(1, offset, t)
+	testutils.CheckInt(2, len(track.stores), t)
+
+	// With no room for another chunk, the active chunk is left as it is
+	_, err = track.WriteMessageCommit(big)
+	testutils.ExpectTrue(err == ErrTrackFull, fmt.Sprintf("Expected ErrTrackFull, got %v", err), t)
+	offset, err = track.WriteMessageCommit([]byte("fits"))
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(2, offset, t)
+}
@@ -0,0 +1,156 @@
+package track
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A CoalescingReader reads every message which is already available, up to a byte budget,
+// in one go. Each read takes the track's lock once to find the messages, and reads all of
+// them from the chunk with a single call, which is much cheaper than a Read per message
+// when they're small. Messages are framed by their lengths as uvarints, as with Tee
+type CoalescingReader struct {
+	reader *StorageReader
+	buf    []byte
+	sizes  []uint64 // The sizes of the messages in the current read
+	msgs   [][]byte
+}
+
+// Coalescing returns a CoalescingReader which reads from sr up to budget bytes at a time,
+// frames included. It shares sr's position, so sr shouldn't be read while it's in use
+func (sr *StorageReader) Coalescing(budget int) *CoalescingReader {
+	return &CoalescingReader{reader: sr, buf: make([]byte, budget)}
+}
+
+// Read fills p with as many whole messages as are available and fit, each framed by its
+// length, and returns the number of bytes used. Like Read, it blocks until there's at least
+// one message, and returns ErrShortBuffer if the first doesn't fit. Reads stop at the end
+// of a chunk. If the reader is part way through a message, only the rest of it is read,
+// framed by the length of the rest
+func (cr *CoalescingReader) Read(p []byte) (n int, err error) {
+	defer recoverPanic(&err)
+	sr := cr.reader
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	size, err := sr.waitForNext()
+	if err != nil {
+		return 0, err
+	}
+	cr.sizes = sr.available(append(cr.sizes[:0], size), uint64(len(p)))
+	first := cr.sizes[0] - sr.partial
+	framed := 0
+	var total uint64
+	for i, size := range cr.sizes {
+		if i == 0 {
+			size = first
+		}
+		framed += frameLen(size)
+		total += size
+	}
+	if uint64(framed)+total > uint64(len(p)) {
+		return 0, ErrShortBuffer // Only happens if the first message doesn't fit
+	}
+	// Read all of the data after where the frames will go, then move each message
+	// down into place behind its frame. Each only ever moves towards the start
+	data := p[framed : uint64(framed)+total]
+	_, err = io.ReadFull(sr.currentSub, data)
+	if err != nil {
+		// Skip back to the right place when the chunk is reopened by the next read
+		sr.dropSub()
+		return 0, err
+	}
+	for i, size := range cr.sizes {
+		rest := size
+		if i == 0 {
+			rest = first
+		}
+		start := n + binary.PutUvarint(p[n:], rest)
+		copy(p[start:], data[:rest])
+		data = data[rest:]
+		if sr.tee != nil {
+			err = firstErr(err, sr.teeMessage(p[start:start+int(rest)], size))
+		}
+		sr.consumed(rest, size)
+		n = start + int(rest)
+	}
+	return n, err
+}
+
+// ReadMessages is like Read, but returns the messages split back out of their frames.
+// They're only valid until the next call, which reuses their buffer. A message bigger
+// than the budget is returned on its own, in a buffer of its own
+func (cr *CoalescingReader) ReadMessages() ([][]byte, error) {
+	n, err := cr.Read(cr.buf)
+	if err == ErrShortBuffer {
+		msg, err := cr.reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{msg}, nil
+	} else if err != nil && n == 0 {
+		return nil, err
+	}
+	var splitErr error
+	cr.msgs, splitErr = splitFrames(cr.msgs[:0], cr.buf[:n])
+	return cr.msgs, firstErr(err, splitErr)
+}
+
+// Append the messages in buf, each framed by its length, to msgs
+func splitFrames(msgs [][]byte, buf []byte) ([][]byte, error) {
+	for len(buf) > 0 {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || size > uint64(len(buf)-n) {
+			return msgs, errors.New("Truncated message frame")
+		}
+		msgs = append(msgs, buf[n:n+int(size)])
+		buf = buf[n+int(size):]
+	}
+	return msgs, nil
+}
+
+// The number of bytes in the frame for a message of the given size
+func frameLen(size uint64) int {
+	var frame [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(frame[:], size)
+}
+
+// Add the sizes of the messages after those in sizes which can be read now from the
+// current chunk, while the messages and their frames fit in budget bytes. sizes starts
+// with the size of the message at the current offset, which is ready to read
+func (sr *StorageReader) available(sizes []uint64, budget uint64) []uint64 {
+	t := sr.parent
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	n, i := t.locate(sr.Offset)
+	if n < 0 || n >= len(t.stores) {
+		return sizes
+	}
+	store := sr.sizesFrom(t.stores[n])
+	end := store.baseOffset + store.Size
+	if sr.readAhead > 0 {
+		return sizes // Only the next message has been read ahead
+	} else if sr.verify != nil {
+		return sizes // So that findNext checks the offset of every message
+	}
+	if sr.subEnd < end {
+		end = sr.subEnd // The chunk has grown since the reader opened it
+	}
+	if sr.OnlyDurable && t.durable < end {
+		end = t.durable
+	}
+	if sr.snapshot && sr.snapshotEnd < end {
+		end = sr.snapshotEnd
+	}
+	used := uint64(frameLen(sizes[0]-sr.partial)) + sizes[0] - sr.partial
+	for i++; store.baseOffset+i < end; i++ {
+		size, err := store.SizeOf(i)
+		if err != nil || used+uint64(frameLen(size))+size > budget {
+			break
+		}
+		used += uint64(frameLen(size)) + size
+		sizes = append(sizes, size)
+	}
+	return sizes
+}
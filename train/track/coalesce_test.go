@@ -0,0 +1,145 @@
+package track
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/go-misc/utils"
+)
+
+func TestCoalescingReader(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 10
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 25)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat([]byte{byte('a' + i)}, i*10)
+	}
+	_, err := track.WriteMessages(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	var tee bytes.Buffer
+	r.Tee(&tee)
+	cr := r.Coalescing(200)
+	// Reads stop at the end of each chunk, and once the budget is used up
+	got := make([][]byte, 0)
+	reads := 0
+	for {
+		batch, err := cr.ReadMessages()
+		if err == io.EOF {
+			break
+		}
+		testutils.CheckErr(err, t)
+		reads++
+		for _, msg := range batch {
+			got = append(got, append([]byte(nil), msg...))
+		}
+	}
+	testutils.CheckInt(len(msgs), len(got), t)
+	for i, msg := range got {
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	// Messages over the budget come back on their own
+	testutils.ExpectTrue(reads > 3 && reads < len(msgs), fmt.Sprintf("Expected the messages to be coalesced, got %d reads", reads), t)
+
+	// The tee gets the same frames
+	teed, err := splitFrames(nil, tee.Bytes())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(msgs), len(teed), t)
+	for i, msg := range teed {
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+}
+
+func TestCoalescingReaderFraming(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := [][]byte{[]byte("first"), nil, testData, bytes.Repeat([]byte("x"), 300)}
+	_, err := track.WriteMessages(msgs)
+	testutils.CheckErr(err, t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	// Start part way through the first message
+	r.PartialReads = true
+	buf := make([]byte, 2)
+	_, err = r.Read(buf)
+	testutils.CheckErr(err, t)
+
+	cr := r.Coalescing(0)
+	p := make([]byte, 1000)
+	n, err := cr.Read(p)
+	testutils.CheckErr(err, t)
+	framed, err := splitFrames(nil, p[:n])
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(4, len(framed), t)
+	testutils.CheckString("rst", string(framed[0]), t)
+	for i := 1; i < len(msgs); i++ {
+		testutils.CheckByteSlice(msgs[i], framed[i], t)
+	}
+	testutils.CheckUint64(4, r.Offset, t)
+
+	// A buffer too small for the next message
+	_, err = track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	_, err = cr.Read(p[:2])
+	testutils.ExpectTrue(err == ErrShortBuffer, fmt.Sprintf("Expected ErrShortBuffer, got %v", err), t)
+	_, err = splitFrames(nil, []byte{10, 'a'})
+	testutils.ExpectTrue(err != nil, "Expected a truncated frame to be an error", t)
+}
+
+func benchmarkTinyReads(read func(r *StorageReader, n int) error, b *testing.B) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 1000)
+	for i := range msgs {
+		msgs[i] = []byte("Hello World")
+	}
+	for i := 0; i < b.N; i += len(msgs) {
+		_, err := track.WriteMessages(msgs)
+		utils.Check(err)
+	}
+	r, err := track.ReaderAt(0)
+	utils.Check(err)
+	defer r.Close()
+	b.ResetTimer()
+	utils.Check(read(r, b.N))
+}
+
+func BenchmarkSingleReads(b *testing.B) {
+	benchmarkTinyReads(func(r *StorageReader, n int) error {
+		buf := make([]byte, 64)
+		for i := 0; i < n; i++ {
+			if _, err := r.Read(buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, b)
+}
+
+func BenchmarkCoalescedReads(b *testing.B) {
+	benchmarkTinyReads(func(r *StorageReader, n int) error {
+		cr := r.Coalescing(64 * 1024)
+		for read := 0; read < n; {
+			msgs, err := cr.ReadMessages()
+			if err != nil {
+				return err
+			}
+			read += len(msgs)
+		}
+		return nil
+	}, b)
+}
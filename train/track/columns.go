@@ -0,0 +1,253 @@
+package track
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// ErrNoColumn is returned when scanning a column which a chunk wasn't written with
+var ErrNoColumn = errors.New("Chunk has no such column")
+
+// With a Splitter in the config, the writer also splits each message into Columns fields,
+// and stores field j of each message as the message with the same index in column j of
+// the chunk. Each column is storage of its own beside the chunk, named after it. Scanning
+// one field across the track then only reads that field, rather than every message in
+// full. The chunk still holds every message whole, so nothing else changes
+
+// A Splitter breaks a message into its fields. It must always return the same number of
+// fields. Messages it fails for, or returns the wrong number of fields for, aren't written
+type Splitter func(msg []byte) ([][]byte, error)
+
+// The id of the storage holding the given column of the storage with the given id
+func columnName(id string, column int) string {
+	return fmt.Sprintf("%s.col%d", id, column)
+}
+
+var columnPattern = regexp.MustCompile(`\.col[0-9]+$`)
+
+// Whether the file with the given name holds a column of a chunk
+func isColumnName(name string) bool {
+	return columnPattern.MatchString(name)
+}
+
+func checkColumns(config TrackConfig) error {
+	if config.Splitter != nil && config.Columns <= 0 {
+		return errors.New("A track with a Splitter needs at least one column")
+	}
+	return nil
+}
+
+// The writer's state for writing the fields of each message
+type columnWriter struct {
+	stores []*FileStorage // The columns of the active chunk
+}
+
+// Start writing the columns of the given store, which has just become the active chunk
+func (c *columnWriter) switchTo(store *FileStorage, columns int) error {
+	err := c.close()
+	for j := 0; j < columns && err == nil; j++ {
+		var col *FileStorage
+		id := columnName(store.fileId, j)
+		if exists(fname(id, store.rootPath)) {
+			col, err = OpenFileStorage(store.rootPath, id)
+		} else {
+			col, err = CreateFileStorage(store.rootPath, id, store.Capacity, 0)
+		}
+		if err == nil {
+			c.stores = append(c.stores, col)
+		}
+	}
+	return err
+}
+
+// Write the fields of the message with the given index in the store, without making them
+// visible. If any of them can't be written, none of them are
+func (c *columnWriter) prepare(store *FileStorage, index int, fields [][]byte) ([]pendingMessage, error) {
+	if len(fields) != len(c.stores) {
+		return nil, fmt.Errorf("Splitter returned %d fields, but the track has %d columns", len(fields), len(c.stores))
+	}
+	pending := make([]pendingMessage, len(fields))
+	for j, col := range c.stores {
+		err := c.align(col, store, index)
+		if err == nil {
+			pending[j], err = col.prepareMessage(index, fields[j])
+		}
+		if err != nil {
+			for _, prepared := range c.stores[:j] {
+				prepared.abortWrite(index, err)
+			}
+			return nil, err
+		}
+	}
+	return pending, nil
+}
+
+// Bring the column into line with the store, ready for the message with the given index.
+// After a crash, or a failed write, a column may hold more messages than its chunk, or
+// fewer. Fields which were lost are filled in as empty
+func (c *columnWriter) align(col, store *FileStorage, index int) error {
+	if col.Capacity < store.Capacity {
+		// The chunk has grown
+		err := col.Grow(store.Capacity)
+		if err != nil {
+			return err
+		}
+	}
+	err := col.truncate(uint64(index))
+	for err == nil && col.Size < uint64(index) {
+		err = col.WriteMessage(int(col.Size), nil)
+	}
+	return err
+}
+
+// Make the prepared fields visible
+func (c *columnWriter) commit(pending []pendingMessage) error {
+	var err error
+	for j, p := range pending {
+		err = firstErr(err, c.stores[j].commitMessage(p))
+	}
+	return err
+}
+
+func (c *columnWriter) sync() error {
+	var err error
+	for _, col := range c.stores {
+		err = firstErr(err, col.Flush())
+	}
+	return err
+}
+
+func (c *columnWriter) close() error {
+	var err error
+	for _, col := range c.stores {
+		err = firstErr(err, col.Close())
+	}
+	c.stores = nil
+	return err
+}
+
+// ScanColumn calls fn with the given field of every message from fromOffset up to the end
+// of the track, reading only that field's column. It doesn't wait for more messages to be
+// written, and stops at the first error from fn. Chunks written without the column give
+// ErrNoColumn. Chunks which are trimmed or merged during the scan give an error
+func (t *Track) ScanColumn(column int, fromOffset uint64, fn func(offset uint64, field []byte) error) error {
+	// Take a snapshot of the chunks to scan, then read them without holding the lock
+	type chunk struct {
+		root, id    string
+		base        uint64
+		first, size uint64
+	}
+	t.dataCond.L.Lock()
+	n, i := t.locate(fromOffset)
+	if n < 0 {
+		t.dataCond.L.Unlock()
+		return ErrOffsetTrimmed
+	}
+	chunks := make([]chunk, 0)
+	for first := n; n < len(t.stores); n, i = n+1, 0 {
+		store := t.stores[n]
+		if n > first && store.baseOffset != t.stores[n-1].baseOffset+t.stores[n-1].Capacity {
+			t.dataCond.L.Unlock()
+			return ErrOffsetTrimmed // The chunks in between are missing
+		}
+		chunks = append(chunks, chunk{store.rootPath, store.fileId, store.baseOffset, i, store.Size})
+	}
+	t.dataCond.L.Unlock()
+
+	for _, c := range chunks {
+		if c.first >= c.size {
+			continue
+		}
+		col, err := OpenReadOnly(c.root, columnName(c.id, column))
+		if os.IsNotExist(err) {
+			return ErrNoColumn
+		} else if err != nil {
+			return err
+		} else if col.Size < c.size {
+			col.Close()
+			return fmt.Errorf("Column %d of chunk %s holds %d of its %d messages", column, c.id, col.Size, c.size)
+		}
+		err = scanColumn(col, c.first, c.size, func(index uint64, field []byte) error {
+			return fn(c.base+index, field)
+		})
+		err = firstErr(err, col.Close())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the fields with indexes in [from, to) from the column, in order
+func scanColumn(col *FileStorage, from, to uint64, fn func(index uint64, field []byte) error) error {
+	f, err := col.ReaderAt(from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for i := from; i < to; i++ {
+		size, err := col.SizeOf(i)
+		if err != nil {
+			return err
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(r, field)
+		if err == nil {
+			err = fn(i, field)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the given column stores. They're only read, so there's nothing to report
+func closeStores(stores []*FileStorage) {
+	for _, store := range stores {
+		store.Close()
+	}
+}
+
+// Merge the columns of the given stores into columns of the store with the given id. Columns
+// are kept up to the first one which any of the stores lacks, or doesn't have in full
+func mergeColumns(root, id string, group []*FileStorage) error {
+	var capacity uint64
+	for _, store := range group {
+		capacity += store.Size
+	}
+	for j := 0; exists(fname(columnName(group[0].fileId, j), group[0].rootPath)); j++ {
+		cols := make([]*FileStorage, 0, len(group))
+		for _, store := range group {
+			col, err := OpenReadOnly(store.rootPath, columnName(store.fileId, j))
+			if err != nil {
+				break
+			} else if col.Size != store.Size {
+				col.Close()
+				break
+			}
+			cols = append(cols, col)
+		}
+		if len(cols) < len(group) {
+			closeStores(cols)
+			break
+		}
+		merged, err := CreateFileStorage(root, columnName(id, j), capacity, 0)
+		if err != nil {
+			closeStores(cols)
+			return err
+		}
+		err = copyMessages(merged, cols)
+		closeStores(cols)
+		err = firstErr(err, merged.Close())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package track
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+// Split name=value messages into their name and value
+func splitPair(msg []byte) ([][]byte, error) {
+	i := bytes.IndexByte(msg, '=')
+	if i < 0 {
+		return nil, errors.New("Not a pair")
+	}
+	return [][]byte{msg[:i], msg[i+1:]}, nil
+}
+
+func TestScanColumn(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.Splitter = splitPair
+	config.Columns = 2
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("a rather long name %d=%d", i, i*i))
+	}
+	_, err = track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	_, err = track.WriteMessageCommit([]byte("no separator"))
+	testutils.ExpectTrue(err != nil, "Expected a message the Splitter fails for to fail", t)
+
+	checkValues := func(from, end uint64) {
+		next := from
+		err := track.ScanColumn(1, from, func(offset uint64, field []byte) error {
+			testutils.CheckUint64(next, offset, t)
+			testutils.CheckString(fmt.Sprintf("%d", offset*offset), string(field), t)
+			next++
+			return nil
+		})
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(end, next, t)
+	}
+	checkValues(0, 12)
+	checkValues(7, 12)
+	// The values are stored apart from the names, so scanning them reads nothing else
+	col, err := OpenReadOnly("", columnName(track.stores[0].fileId, 1))
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(5, col.Size, t)
+	testutils.CheckUint64(uint64(len("014916")), col.index[col.Size]-col.index[0], t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Columns carry on after reopening, and survive merging
+	track, err = OpenTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	_, err = track.WriteAllSync([][]byte{[]byte("a rather long name 12=144")})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.MergeChunks(100), t)
+	checkValues(0, 13)
+	err = track.ScanColumn(2, 0, func(uint64, []byte) error { return nil })
+	testutils.ExpectTrue(err == ErrNoColumn, fmt.Sprintf("Expected ErrNoColumn, got %v", err), t)
+}
+
+func TestColumnsNeedCount(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.Splitter = splitPair
+	_, err := NewTrackWithConfig("", "id", config)
+	testutils.ExpectTrue(err != nil, "Expected a Splitter without Columns to be rejected", t)
+}
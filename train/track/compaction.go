@@ -0,0 +1,258 @@
+package track
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// COMPACTION -- With CompactInterval set, a compactor checks every interval for sealed
+// chunks in which enough of the messages are dead, and rewrites each of them without the
+// dead messages' data. A keyed message is dead once its key has been written again, or,
+// with TTL and Timestamps set, once it's older than the TTL. A tombstone is only dead once
+// its key has been written again, so that values before it in chunks which haven't been
+// compacted stay deleted. Offsets never change, so a dead message is rewritten as an empty
+// message, which ReadMessage skips. The active chunk is never compacted, and neither is a
+// track without KeyedOnly set, since its messages might not be keyed at all.
+// A rewritten chunk replaces the old file, so readers part way through it carry on
+// reading the old file, which holds the same live messages at the same offsets
+
+// By default, chunks are compacted once half of their messages are dead
+const defaultCompactDeadRatio = 0.5
+
+func checkCompaction(config TrackConfig) error {
+	if config.CompactInterval > 0 && !config.IndexKeys {
+		return errors.New("Compaction needs the key index, set IndexKeys in the track's config")
+	} else if config.CompactInterval > 0 && !config.KeyedOnly {
+		return errors.New("Compaction needs every message to be keyed, set KeyedOnly in the track's config")
+	} else if config.CompactDeadRatio < 0 || config.CompactDeadRatio > 1 {
+		return errors.New("CompactDeadRatio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Start the compactor if the config asks for one. It runs until the writer stops
+func (t *Track) startCompactor() {
+	if t.config.CompactInterval <= 0 || t.keys == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(t.config.CompactInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if t.finished() {
+				return
+			}
+			t.compactChunks(time.Now())
+		}
+	}()
+}
+
+// Rewrite every sealed chunk whose share of dead messages has reached CompactDeadRatio.
+// Returns the number of chunks rewritten
+func (t *Track) compactChunks(now time.Time) (int, error) {
+	if !t.config.KeyedOnly {
+		return 0, nil // Any message could be mistaken for a dead keyed one
+	}
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+
+	ratio := t.config.CompactDeadRatio
+	if ratio == 0 {
+		ratio = defaultCompactDeadRatio
+	}
+	// Sealed chunks never change, so we can read them without holding the lock
+	t.dataCond.L.Lock()
+	sealed := make([]*FileStorage, 0)
+	for _, store := range t.stores {
+		if !store.readOnly {
+			break
+		}
+		sealed = append(sealed, store)
+	}
+	t.dataCond.L.Unlock()
+
+	count := 0
+	for _, store := range sealed {
+		dead, expired, err := t.deadMessages(store, now)
+		if err != nil {
+			return count, err
+		}
+		// The share is of the messages which still hold data
+		var n, held uint64
+		for i, d := range dead {
+			if d {
+				n++
+			}
+			if size, err := store.SizeOf(uint64(i)); err == nil && size > 0 {
+				held++
+			}
+		}
+		if n == 0 || float64(n) < ratio*float64(held) {
+			continue
+		}
+		err = t.compactChunk(store, dead, n, expired)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Find the dead messages in the store, by their index, along with the offsets of the
+// expired messages which are still the latest for their key, which have to be dropped
+// from the key index. Messages which are already empty aren't dead, since there's nothing
+// left of them to reclaim
+func (t *Track) deadMessages(store *FileStorage, now time.Time) ([]bool, map[string]uint64, error) {
+	var stamps []byte
+	if t.config.TTL > 0 && t.config.Timestamps {
+		var err error
+		stamps, err = ioutil.ReadFile(timestampsName(store.fileId, store.rootPath))
+		if os.IsNotExist(err) {
+			err = nil // Written without timestamps, so nothing expires
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	it := store.Messages()
+	defer it.Close()
+
+	dead := make([]bool, store.Size)
+	expired := make(map[string]uint64)
+	for i := uint64(0); it.Next(); i++ {
+		m, err := ParseMessage(it.Message())
+		if err != nil {
+			continue // Already empty
+		}
+		offset := store.baseOffset + i
+		latest, ok := t.keys.lookup(m.Key)
+		if m.Tombstone {
+			dead[i] = ok && latest > offset
+			continue
+		}
+		dead[i] = !ok || latest != offset
+		if !dead[i] && uint64(len(stamps)) >= (i+1)*_nSize {
+			ts := int64(binary.LittleEndian.Uint64(stamps[i*_nSize:]))
+			if ts != 0 && now.Sub(time.Unix(0, ts)) >= t.config.TTL {
+				dead[i] = true
+				expired[string(m.Key)] = offset
+			}
+		}
+	}
+	return dead, expired, it.Err()
+}
+
+// The store to take the sizes of messages from for the chunk the reader is in. A reader
+// part way through a chunk which compaction has replaced carries on with the old file, so
+// it needs the old sizes. Must be called with dataCond.L held
+func (sr *StorageReader) sizesFrom(store *FileStorage) *FileStorage {
+	if sr.currentSub != nil && sr.subStore != nil && sr.subStore.replaced {
+		return sr.subStore
+	}
+	return store
+}
+
+// Rewrite the store with its n dead messages emptied, and swap it into the track.
+// Must be called with mergeMutex held
+func (t *Track) compactChunk(store *FileStorage, dead []bool, n uint64, expired map[string]uint64) error {
+	tempId := store.fileId + ".compact"
+	compacted, reclaimed, err := rewriteStore(store, tempId, dead)
+	if err != nil {
+		return err
+	}
+	// Only list the chunks before this one while it's replaced, so that a crash part
+	// way through leaves a track which still opens
+	err = t.writeManifestOf(func(s *FileStorage) bool {
+		return s.baseOffset < store.baseOffset
+	})
+	if err != nil {
+		compacted.Close()
+		removeStorage(tempId, store.rootPath)
+		return err
+	}
+
+	t.dataCond.L.Lock()
+	err = renameStorage(tempId, store.rootPath, store.fileId, store.rootPath)
+	if err != nil {
+		t.dataCond.L.Unlock()
+		compacted.Close()
+		removeStorage(tempId, store.rootPath)
+		return firstErr(err, t.writeManifest())
+	}
+	compacted.fileId = store.fileId
+	for n := range t.stores {
+		if t.stores[n] == store {
+			t.stores[n] = compacted
+		}
+	}
+	// Readers of this chunk have their own open file, and carry on reading it
+	store.replaced = true
+	err = store.Close()
+	t.dataCond.L.Unlock()
+
+	for key, offset := range expired {
+		t.keys.forget([]byte(key), offset)
+	}
+	atomic.AddUint64(&t.compactions, 1)
+	atomic.AddUint64(&t.compactedMessages, n)
+	atomic.AddUint64(&t.compactedBytes, reclaimed)
+	return firstErr(err, t.writeManifest())
+}
+
+// Copy the store's messages into a new sealed store with the given id, leaving the dead
+// ones empty. Returns the new store and the number of bytes dropped
+func rewriteStore(store *FileStorage, id string, dead []bool) (*FileStorage, uint64, error) {
+	compacted, err := CreateFileStorage(store.rootPath, id, store.Capacity, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	var reclaimed uint64
+	err = compacted.setBaseOffset(store.baseOffset)
+	if err == nil {
+		reclaimed, err = copyLive(compacted, store, dead)
+	}
+	if err == nil {
+		err = compacted.seal()
+	}
+	if err != nil {
+		compacted.Close()
+		removeStorage(id, store.rootPath)
+		return nil, 0, err
+	}
+	return compacted, reclaimed, nil
+}
+
+// Append every message from src to dst, with the dead ones empty
+func copyLive(dst, src *FileStorage, dead []bool) (uint64, error) {
+	r, _, err := src.RawRange(0, src.Size)
+	if err != nil {
+		return 0, err
+	}
+	defer r.(io.Closer).Close()
+	var reclaimed uint64
+	for i := uint64(0); i < src.Size; i++ {
+		size, err := src.SizeOf(i)
+		if err != nil {
+			return reclaimed, err
+		}
+		if dead[i] {
+			_, err = io.CopyN(ioutil.Discard, r, int64(size))
+			if err == nil {
+				err = dst.WriteMessage(int(i), nil)
+			}
+			reclaimed += size
+		} else {
+			err = dst.WriteMessageFrom(int(i), r, int64(size))
+		}
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
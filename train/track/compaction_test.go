@@ -0,0 +1,191 @@
+package track
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+// The total size of the track's chunk files, other than the active chunk's
+func sealedBytes(track *Track) int64 {
+	track.dataCond.L.Lock()
+	defer track.dataCond.L.Unlock()
+	var total int64
+	for _, store := range track.stores {
+		if !store.readOnly {
+			continue
+		}
+		info, err := os.Stat(fname(store.fileId, store.rootPath))
+		if err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+func TestCompactorReclaimsOverwrites(t *testing.T) {
+	defer func(size uint64, align bool) { CHUNK_SIZE, PAGE_ALIGN_FILES = size, align }(CHUNK_SIZE, PAGE_ALIGN_FILES)
+	CHUNK_SIZE = 10
+	PAGE_ALIGN_FILES = false
+	cleanupTrack()
+
+	config := indexedConfig()
+	config.KeyedOnly = true
+	config.CompactInterval = 10 * time.Millisecond
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	value := make([]byte, 1000)
+	for i := 0; i < 95; i++ {
+		copy(value, fmt.Sprintf("%d", i))
+		testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte(fmt.Sprintf("k%d", i%3)), value)), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	before := sealedBytes(track)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for track.Stats().Compactions < 9 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := track.Stats()
+	testutils.CheckUint64(9, stats.Compactions, t)
+	testutils.CheckUint64(90, stats.CompactedMessages, t)
+	testutils.CheckUint64(90*1004, stats.CompactedBytes, t)
+	testutils.ExpectTrue(sealedBytes(track) < before/10, fmt.Sprintf("Expected compaction to shrink %d bytes of chunks", before), t)
+
+	// Only the latest value of each key is left in the sealed chunks, and every offset
+	// stays where it was
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := 90; i < 95; i++ {
+		m, err := r.ReadMessage()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprintf("k%d", i%3), string(m.Key), t)
+		testutils.CheckString(fmt.Sprint(i), string(m.Value[:2]), t)
+		testutils.CheckUint64(uint64(i+1), r.Offset, t)
+	}
+	m, ok, err := track.Get([]byte("k1"))
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(ok, "Expected k1 to be found", t)
+	testutils.CheckString("94", string(m.Value[:2]), t)
+	testutils.CheckUint64(95, track.LatestOffset(), t)
+	testutils.CheckErr(track.Verify(), t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Nothing is left to compact once the track is reopened
+	track, err = OpenTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	n, err := track.compactChunks(time.Now())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, n, t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestCompactionKeepsReaders(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 4
+	cleanupTrack()
+
+	config := indexedConfig()
+	config.KeyedOnly = true
+	config.Timestamps = true
+	config.TTL = time.Hour
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	for i, key := range []string{"a", "b", "a", "c", "b", "d", "e", "f", "g"} {
+		testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte(key), []byte(fmt.Sprint(i)))), t)
+	}
+	testutils.CheckErr(track.WriteKeyed(Tombstone([]byte("c"))), t)
+	testutils.CheckErr(track.Flush(), t)
+
+	// Part way through the first chunk when it's compacted
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	m, err := r.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckString("0", string(m.Value), t)
+
+	// Chunk 0 only holds a@2 once a@0, b@1 and c@3 are overwritten, but nothing in chunk 1
+	// has been
+	n, err := track.compactChunks(time.Now())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(1, n, t)
+	for _, expected := range []string{"1", "2", "3"} {
+		m, err = r.ReadMessage()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(expected, string(m.Value), t)
+	}
+
+	// New readers see the compacted chunk
+	r2, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r2.Close()
+	for _, expected := range []string{"2", "4", "5"} {
+		m, err = r2.ReadMessage()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(expected, string(m.Value), t)
+	}
+
+	// Everything in the sealed chunks expires, but the active chunk is left alone
+	n, err = track.compactChunks(time.Now().Add(2 * time.Hour))
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, n, t)
+	checkGet(track, "a", "", t)
+	checkGet(track, "d", "", t)
+	checkGet(track, "g", "8", t)
+	r3, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r3.Close()
+	m, err = r3.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckString("8", string(m.Value), t)
+	m, err = r3.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(m.Tombstone, "Expected the tombstone to be left", t)
+	testutils.CheckErr(track.Close(), t)
+	_, err = r3.ReadMessage()
+	testutils.ExpectTrue(err == io.EOF, "Expected nothing after the tombstone", t)
+
+	config.IndexKeys = false
+	config.CompactInterval = time.Second
+	_, err = NewTrackWithConfig("", "id2", config)
+	testutils.ExpectTrue(err != nil, "Expected compaction without a key index to be refused", t)
+	config.IndexKeys = true
+	config.KeyedOnly = false
+	_, err = NewTrackWithConfig("", "id2", config)
+	testutils.ExpectTrue(err != nil, "Expected compaction of a track which isn't keyed only to be refused", t)
+}
+
+func TestCompactionSkipsUnkeyedTracks(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+
+	track, err := NewTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	// Plain messages which happen to parse as writes of the same key
+	raw := KeyedMessage([]byte("k"), testData).Bytes()
+	for i := 0; i < 6; i++ {
+		testutils.CheckErr(track.WriteMessage(raw), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	n, err := track.compactChunks(time.Now())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, n, t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := 0; i < 6; i++ {
+		data, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(raw, data, t)
+	}
+}
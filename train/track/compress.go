@@ -0,0 +1,80 @@
+package track
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// Compressed messages are wrapped in a one byte envelope saying how the rest
+// of the message is encoded. Messages smaller than the track's CompressMinSize
+// are stored raw, since gzip's overhead outweighs any savings.
+// Byte Range: Contents
+//          0: ENCODING_RAW or ENCODING_GZIP
+//        1..: payload
+
+const (
+	ENCODING_RAW  byte = 0
+	ENCODING_GZIP byte = 1
+)
+
+// Write the message, gzip-compressing it if it's at least CompressMinSize bytes.
+// Messages written this way must be read with ReadCompressed
+func (t *Track) WriteCompressed(data []byte) error {
+	msg, err := compressMessage(data, t.config.CompressMinSize)
+	if err != nil {
+		return err
+	}
+	return t.WriteMessage(msg)
+}
+
+// ReadCompressed reads the next message written with WriteCompressed, decompressing
+// it if needed. Like Read, it blocks until a message is available
+func (sr *StorageReader) ReadCompressed() ([]byte, error) {
+	data, err := sr.Next()
+	if err != nil {
+		return nil, err
+	}
+	return decompressMessage(data)
+}
+
+// Wrap data in a compression envelope
+func compressMessage(data []byte, minSize int) ([]byte, error) {
+	if len(data) < minSize {
+		return append([]byte{ENCODING_RAW}, data...), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(ENCODING_GZIP)
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unwrap a message created by compressMessage
+func decompressMessage(msg []byte) ([]byte, error) {
+	if len(msg) == 0 {
+		return nil, errors.New("Compressed message is missing its envelope")
+	}
+	switch msg[0] {
+	case ENCODING_RAW:
+		return msg[1:], nil
+	case ENCODING_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(msg[1:]))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("Unknown message encoding %d", msg[0])
+	}
+}
@@ -0,0 +1,57 @@
+package track
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestCompressThreshold(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.CompressMinSize = 100
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	small := testData
+	large := bytes.Repeat(testData, 100)
+	testutils.CheckErr(track.WriteCompressed(small), t)
+	testutils.CheckErr(track.WriteCompressed(large), t)
+	_, r, err := track.AppendAndReader([]byte{ENCODING_RAW})
+	testutils.CheckErr(err, t)
+	r.Close()
+
+	r, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	raw, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(raw[0] == ENCODING_RAW, "Expected small message to be stored raw", t)
+	testutils.CheckByteSlice(small, raw[1:], t)
+	raw, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(raw[0] == ENCODING_GZIP, "Expected large message to be compressed", t)
+	testutils.ExpectTrue(len(raw) < len(large), "Expected compression to save space", t)
+
+	r, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	msg, err := r.ReadCompressed()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(small, msg, t)
+	msg, err = r.ReadCompressed()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(large, msg, t)
+	msg, err = r.ReadCompressed()
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, len(msg), t)
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	_, err := decompressMessage(nil)
+	testutils.ExpectTrue(err != nil, "Expected missing envelope to fail", t)
+	_, err = decompressMessage([]byte{42})
+	testutils.ExpectTrue(err != nil, "Expected unknown encoding to fail", t)
+	_, err = decompressMessage([]byte{ENCODING_GZIP, 1, 2, 3})
+	testutils.ExpectTrue(err != nil, "Expected corrupt gzip data to fail", t)
+}
@@ -0,0 +1,130 @@
+package track
+
+import (
+	"time"
+)
+
+// TrackConfig holds the tunable behavior of a track
+type TrackConfig struct {
+	// Sync decides how often written messages are flushed to disk
+	Sync SyncPolicy
+	// Messages written with WriteCompressed are only compressed if they're at least this many bytes
+	CompressMinSize int
+	// If set, OnCommit is called by the writer goroutine with each message once it has been
+	// written, before any caller waiting on the write is told. msg is the message as it's
+	// stored, and is nil for messages copied from a reader with WriteMessageFrom. The writer
+	// waits for the hook, so it should be quick. Panics in the hook are recovered and ignored
+	OnCommit func(offset uint64, msg []byte)
+	// If TTL and SweepInterval are both set, a sweeper checks every SweepInterval for sealed
+	// chunks at the start of the track whose messages are all older than TTL, and deletes them.
+	// The active chunk is never deleted, however old it is
+	TTL           time.Duration
+	SweepInterval time.Duration
+	// If set, the track keeps an index from the key of each keyed message to its latest
+	// write, so that Get can find it without scanning the track
+	IndexKeys bool
+	// Set if every message in the track is a keyed message, written with WriteKeyed. Nothing
+	// in a message says whether it's keyed, and one which isn't can still parse as a keyed
+	// message, so compaction would drop it once its "key" looked overwritten. Compaction
+	// needs it
+	KeyedOnly bool
+	// If set, the writer records the time it wrote each message, which Timestamp returns.
+	// Timestamps strictly increase with offset, even when the clock doesn't tick between
+	// writes or goes backwards
+	Timestamps bool
+	// If set, the writer writes at most this many messages, or this many bytes of messages,
+	// each second. Writes beyond the limit queue up, and once the queue is full they block
+	MaxWritesPerSecond uint64
+	MaxBytesPerSecond  uint64
+	// If set, the writer checks before each write that the offsets in the chunk's offset table
+	// never go backwards, and that the chunk's file is positioned where the next message should
+	// start. If not, the write fails with ErrCorruptIndex, and nothing is written
+	ChecksOnWrite bool
+	// If set, the track never has more than this many chunks. Once the last of them is full,
+	// writes fail with ErrTrackFull and nothing is written, until chunks are trimmed. Messages
+	// written with WriteMessage which were already queued are dropped, and counted in Stats
+	MaxChunks int
+	// If set, each write first checks that the disk has room for the message, and for the
+	// preallocated space of a new chunk if it starts one. If not, it fails with ErrDiskFull
+	// and nothing is written. Queued messages written with WriteMessage are dropped, and
+	// counted in Stats
+	CheckDiskSpace bool
+	// If Splitter is set, each message is also split into Columns fields, which are stored
+	// column by column beside each chunk, so that ScanColumn can read one field of every
+	// message without reading the rest. Messages written with WriteMessageFrom can't be split,
+	// so they fail. See columns.go
+	Splitter Splitter
+	Columns  int
+	// The upper bounds of the buckets of Stats().MessageSizes, in increasing order. If nil,
+	// the buckets double in width, from empty messages up to 2GB
+	SizeBuckets []uint64
+	// Names the track's chunk files. If nil, DefaultChunkNamer is used. Tracks must always
+	// be opened with the namer they were created with
+	ChunkNamer ChunkNamer
+	// If CompactInterval is set, a compactor checks every CompactInterval for sealed chunks in
+	// which at least CompactDeadRatio of the messages have been overwritten or have expired,
+	// and rewrites them without their data. CompactDeadRatio defaults to half. Compaction
+	// needs IndexKeys and KeyedOnly. See compaction.go
+	CompactInterval  time.Duration
+	CompactDeadRatio float64
+	// If set, each chunk holds at most this many bytes of messages, as well as at most
+	// CHUNK_SIZE messages. OnOversizedForChunk decides what happens to a message which
+	// doesn't fit in what's left of the active chunk. Messages bigger than MaxChunkBytes
+	// never fit, so they fail with ErrMessageTooLarge. See chunkbytes.go
+	MaxChunkBytes       uint64
+	OnOversizedForChunk OversizePolicy
+}
+
+func DefaultTrackConfig() TrackConfig {
+	return TrackConfig{
+		Sync:            SyncNever,
+		CompressMinSize: 512,
+	}
+}
+
+// An OversizePolicy decides what the writer does with a message which doesn't fit in the
+// bytes left in the active chunk, with MaxChunkBytes set
+type OversizePolicy int
+
+const (
+	// Seal the active chunk early, and write the message to a new one
+	SealAndRetry OversizePolicy = iota
+	// Fail the write with ErrNoRoomInChunk. The active chunk is still sealed, so the
+	// message can be written again, to a new chunk
+	Reject
+)
+
+// A SyncPolicy decides when the writer flushes the active chunk to disk.
+// Regardless of policy, a chunk is always flushed when it's sealed, and
+// messages written with WriteAllSync are always flushed before it returns
+type SyncPolicy struct {
+	every    uint64        // Flush once this many messages are unflushed
+	interval time.Duration // Flush once the oldest unflushed message is this old
+}
+
+var (
+	// Leave flushing to the operating system
+	SyncNever = SyncPolicy{}
+	// Flush after every message
+	SyncAlways = SyncPolicy{every: 1}
+)
+
+// Flush after every n messages
+func SyncEvery(n uint64) SyncPolicy {
+	return SyncPolicy{every: n}
+}
+
+// Flush unflushed messages at least once every d
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// Whether the writer should flush, given the number of unflushed
+// messages and the time since the last flush
+func (p SyncPolicy) due(unsynced uint64, sinceSync time.Duration) bool {
+	if unsynced == 0 {
+		return false
+	}
+	return (p.every > 0 && unsynced >= p.every) ||
+		(p.interval > 0 && sinceSync >= p.interval)
+}
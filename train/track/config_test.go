@@ -0,0 +1,250 @@
+package track
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestSyncPolicies(t *testing.T) {
+	expectations := []struct {
+		policy SyncPolicy
+		syncs  uint64
+	}{
+		{SyncNever, 0},
+		{SyncAlways, 10},
+		{SyncEvery(3), 3},
+		{SyncEvery(20), 0},
+	}
+	for _, e := range expectations {
+		cleanupTrack()
+		track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: e.policy})
+		testutils.CheckErr(err, t)
+		writeAndWait(track, 10, t)
+		testutils.CheckUint64(e.syncs, atomic.LoadUint64(&track.syncs), t)
+		track.Close()
+		track.WaitForShutdown()
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	cleanupTrack()
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncInterval(50 * time.Millisecond)})
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	writeAndWait(track, 10, t)
+	testutils.CheckUint64(0, atomic.LoadUint64(&track.syncs), t)
+
+	// The idle writer flushes once the interval has passed, then has nothing left to flush
+	time.Sleep(200 * time.Millisecond)
+	testutils.CheckUint64(1, atomic.LoadUint64(&track.syncs), t)
+}
+
+func TestSyncOnSeal(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncNever})
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	writeAndWait(track, 12, t)
+	testutils.CheckUint64(2, atomic.LoadUint64(&track.syncs), t)
+}
+
+// Write n messages, and wait for the last of them to be written
+func writeAndWait(track *Track, n int, t *testing.T) {
+	for i := 0; i < n-1; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	_, _, err := track.AppendAndReader(testData)
+	testutils.CheckErr(err, t)
+}
+
+func TestOnCommit(t *testing.T) {
+	cleanupTrack()
+	offsets := make([]uint64, 0)
+	msgs := make([][]byte, 0)
+	config := DefaultTrackConfig()
+	config.OnCommit = func(offset uint64, msg []byte) {
+		offsets = append(offsets, offset)
+		msgs = append(msgs, msg)
+		if offset == 1 {
+			panic("A broken hook shouldn't stop the writer")
+		}
+	}
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	written := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	_, err = track.WriteAllSync(written)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	testutils.CheckInt(3, len(offsets), t)
+	for i := range written {
+		testutils.CheckUint64(uint64(i), offsets[i], t)
+		testutils.CheckByteSlice(written[i], msgs[i], t)
+	}
+}
+
+func TestMaxWritesPerSecond(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.MaxWritesPerSecond = 100
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	// After a burst of a tenth of a second's writes, the rest are held to the limit
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	testutils.CheckErr(track.Sync(), t)
+	elapsed := time.Since(start)
+	testutils.ExpectTrue(elapsed >= 450*time.Millisecond, fmt.Sprintf("Expected 60 writes to take at least 450ms, took %s", elapsed), t)
+	testutils.CheckUint64(60, track.LatestOffset(), t)
+}
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.MaxBytesPerSecond = 20000
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	start := time.Now()
+	msg := make([]byte, 1000)
+	for i := 0; i < 10; i++ {
+		testutils.CheckErr(track.WriteMessage(msg), t)
+	}
+	testutils.CheckErr(track.Sync(), t)
+	elapsed := time.Since(start)
+	testutils.ExpectTrue(elapsed >= 350*time.Millisecond, fmt.Sprintf("Expected 10KB to take at least 350ms, took %s", elapsed), t)
+}
+
+func TestTrackChecksOnWrite(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.ChecksOnWrite = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	_, err = track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	track.dataCond.L.Lock()
+	store := track.stores[len(track.stores)-1]
+	track.dataCond.L.Unlock()
+	store.header = &lossyHeader{store.header}
+	_, err = track.WriteMessageCommit([]byte("lost"))
+	testutils.CheckErr(err, t)
+	_, err = track.WriteMessageCommit([]byte("rejected"))
+	testutils.ExpectTrue(err == ErrCorruptIndex, fmt.Sprintf("Expected ErrCorruptIndex, got %v", err), t)
+	testutils.CheckUint64(2, track.LatestOffset(), t)
+}
+
+// A header whose flushes fail until it's told otherwise
+type failingFlushHeader struct {
+	headerIO
+	fail bool
+}
+
+func (h *failingFlushHeader) flush() error {
+	if h.fail {
+		return errors.New("Injected failure")
+	}
+	return h.headerIO.flush()
+}
+
+func TestSyncFlushesEveryDirtyChunk(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncNever})
+	testutils.CheckErr(err, t)
+	writeAndWait(track, 5, t)
+	track.dataCond.L.Lock()
+	sealing := track.stores[0]
+	header := &failingFlushHeader{sealing.header, true}
+	sealing.header = header
+	track.dataCond.L.Unlock()
+
+	// The rollover's flush fails, leaving both chunks dirty
+	writeAndWait(track, 2, t)
+	testutils.ExpectTrue(sealing.dirty && !sealing.readOnly, "Expected the sealed chunk to be left dirty", t)
+	header.fail = false
+	syncs := atomic.LoadUint64(&track.syncs)
+	testutils.CheckErr(track.Sync(), t)
+	testutils.CheckUint64(syncs+2, atomic.LoadUint64(&track.syncs), t)
+	track.dataCond.L.Lock()
+	for _, store := range track.stores {
+		testutils.ExpectTrue(!store.dirty, "Expected every chunk to be flushed", t)
+	}
+	testutils.ExpectTrue(sealing.readOnly, "Expected the sealed chunk to be released once flushed", t)
+	track.dataCond.L.Unlock()
+
+	// Nothing changed, so there's nothing more to flush
+	testutils.CheckErr(track.Sync(), t)
+	testutils.CheckUint64(syncs+2, atomic.LoadUint64(&track.syncs), t)
+
+	// Crash, leaving the track open, and find everything on disk
+	crashed, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(crashed.stores), t)
+	testutils.ExpectTrue(crashed.stores[0].sealed, "Expected the seal to be durable", t)
+	testutils.CheckUint64(7, crashed.LatestOffset(), t)
+	testutils.ExpectTrue(track.Close() != nil, "Expected the failed seal to be reported", t)
+}
+
+func TestMaxChunks(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.MaxChunks = 1
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	for i := 0; i < 5; i++ {
+		_, err = track.WriteMessageCommit(testData)
+		testutils.CheckErr(err, t)
+	}
+
+	_, err = track.WriteMessageCommit(testData)
+	testutils.ExpectTrue(err == ErrTrackFull, fmt.Sprintf("Expected ErrTrackFull, got %v", err), t)
+	err = track.WriteMessage(testData)
+	testutils.ExpectTrue(err == ErrTrackFull, fmt.Sprintf("Expected ErrTrackFull, got %v", err), t)
+	testutils.CheckUint64(5, track.LatestOffset(), t)
+	testutils.CheckInt(1, len(track.stores), t)
+	testutils.ExpectTrue(!exists(fname(track.chunkId(1), "")), "Expected no second chunk to be created", t)
+}
+
+func TestMaxChunksDropsQueuedWrites(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.MaxChunks = 1
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	rejected := 0
+	for i := 0; i < 8; i++ {
+		if track.WriteMessage(testData) == ErrTrackFull {
+			rejected++
+		}
+	}
+	testutils.CheckErr(track.Sync(), t)
+	// Whatever got past WriteMessage before the chunk filled up is dropped by the writer
+	testutils.CheckUint64(5, track.LatestOffset(), t)
+	testutils.CheckInt(3, rejected+int(track.Stats().Dropped), t)
+}
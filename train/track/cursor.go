@@ -0,0 +1,79 @@
+package track
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// A Cursor records a reader's position, including how much of a partly read message it
+// has consumed, so that reading can resume from exactly the same place after a restart.
+// Encoded with MarshalBinary, a cursor is 17 bytes, little endian:
+//
+//	[version][offset][bytes of the message at offset already read]
+type Cursor struct {
+	Offset  uint64
+	Partial uint64
+}
+
+const cursorVersion byte = 1
+const cursorSize = 17
+
+func (c Cursor) MarshalBinary() ([]byte, error) {
+	data := make([]byte, cursorSize)
+	data[0] = cursorVersion
+	binary.LittleEndian.PutUint64(data[1:], c.Offset)
+	binary.LittleEndian.PutUint64(data[9:], c.Partial)
+	return data, nil
+}
+
+func (c *Cursor) UnmarshalBinary(data []byte) error {
+	if len(data) != cursorSize || data[0] != cursorVersion {
+		return errors.New("Invalid cursor")
+	}
+	c.Offset = binary.LittleEndian.Uint64(data[1:])
+	c.Partial = binary.LittleEndian.Uint64(data[9:])
+	return nil
+}
+
+// Cursor returns the reader's current position. Cursor is thread-safe
+func (sr *StorageReader) Cursor() Cursor {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	return Cursor{Offset: atomic.LoadUint64(&sr.Offset), Partial: sr.partial}
+}
+
+// ReaderFromCursor returns a reader which carries on from the position recorded in the
+// token, which was made by marshalling a Cursor. Unlike ReaderAt, the position may be
+// part way through a message, in which case the reader returns the rest of it first
+func (t *Track) ReaderFromCursor(token []byte) (*StorageReader, error) {
+	var c Cursor
+	err := c.UnmarshalBinary(token)
+	if err != nil {
+		return nil, err
+	}
+	r, err := t.ReaderAt(c.Offset)
+	if err != nil {
+		return nil, err
+	}
+	r.partial = c.Partial
+	return r, nil
+}
+
+// Skip the part of a message which was read before the reader's cursor was saved.
+// Closes sub if it fails
+func skipPartial(sub io.ReadCloser, partial, size uint64) error {
+	var err error
+	if partial >= size {
+		err = fmt.Errorf("Invalid cursor, %d bytes of a %d byte message have been read", partial, size)
+	} else {
+		_, err = io.CopyN(ioutil.Discard, sub, int64(partial))
+	}
+	if err != nil {
+		sub.Close()
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package track
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestResumeFromCursor(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Read halfway, stopping part way through a message
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	for i := 0; i < 6; i++ {
+		_, err = r.Next()
+		testutils.CheckErr(err, t)
+	}
+	r.PartialReads = true
+	head := make([]byte, 4)
+	_, err = r.Read(head)
+	testutils.CheckErr(err, t)
+	token, err := r.Cursor().MarshalBinary()
+	testutils.CheckErr(err, t)
+	r.Close()
+
+	// A fresh track and reader carry on from exactly the same place
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err = track.ReaderFromCursor(token)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	rest, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[6], append(head, rest...), t)
+	for i := 7; i < len(msgs); i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	cleanupTrack()
+}
+
+func TestInvalidCursor(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, err := track.WriteAllSync([][]byte{testData})
+	testutils.CheckErr(err, t)
+
+	_, err = track.ReaderFromCursor([]byte("garbage"))
+	testutils.ExpectTrue(err != nil, "Expected a bad token to be rejected", t)
+
+	// A cursor past the end of its message can't be resumed
+	token, err := Cursor{Offset: 0, Partial: uint64(len(testData))}.MarshalBinary()
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderFromCursor(token)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	_, err = r.Next()
+	testutils.ExpectTrue(err != nil, "Expected the cursor to be rejected", t)
+
+	var c Cursor
+	token, err = Cursor{Offset: 7, Partial: 3}.MarshalBinary()
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(c.UnmarshalBinary(token), t)
+	testutils.ExpectTrue(bytes.Equal(token, []byte{1, 7, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}), "Expected a little endian encoding", t)
+	testutils.CheckUint64(7, c.Offset, t)
+	testutils.CheckUint64(3, c.Partial, t)
+}
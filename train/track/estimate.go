@@ -0,0 +1,61 @@
+package track
+
+// EstimateDiskUsage predicts how many bytes a track written with the given config will
+// occupy once it holds messageCount messages averaging avgMessageSize bytes. Each chunk
+// holds CHUNK_SIZE messages after its header, though with CHUNK_INITIAL_CAPACITY set the
+// last one's header only has room for as many as it's grown to hold. Chunk files are
+// never smaller than their preallocated size. With Timestamps set, each message also takes
+// 8 bytes in its chunk's timestamps file. Not counted are the key index kept with IndexKeys
+// and the columns written with a Splitter, whose sizes depend on what's in the messages, or
+// chunks sealed early by MaxChunkBytes. This is the apparent size of the files; filesystems
+// may allocate more or, for sparse files, less. For WriteCompressed, pass the average size
+// after compression
+func EstimateDiskUsage(cfg TrackConfig, messageCount uint64, avgMessageSize uint64) uint64 {
+	if messageCount == 0 || CHUNK_SIZE == 0 {
+		return 0
+	}
+	chunkBytes := func(messages uint64) uint64 {
+		capacity := initialCapacity()
+		for capacity < messages {
+			capacity = nextCapacity(capacity)
+		}
+		header := (capacity + 2 + _nExtra) * _nSize
+		size := header + messages*avgMessageSize
+		initial := CHUNK_INITIAL_BYTES
+		if initial < header {
+			initial = header
+		}
+		if PAGE_ALIGN_FILES {
+			initial = pageAlign(initial)
+		}
+		if size < initial {
+			return initial
+		}
+		return size
+	}
+	full := messageCount / CHUNK_SIZE
+	total := full * chunkBytes(CHUNK_SIZE)
+	if rem := messageCount % CHUNK_SIZE; rem > 0 {
+		total += chunkBytes(rem)
+	}
+	if cfg.Timestamps {
+		total += messageCount * _nSize
+	}
+	return total
+}
+
+// RecommendChunkSize returns a CHUNK_SIZE which makes each chunk file about targetChunkBytes
+// long when messages average avgMessageSize bytes, accounting for the header and the offset
+// table entry each message takes. Set CHUNK_SIZE to it before creating or opening tracks.
+// Never returns less than 1
+func RecommendChunkSize(avgMessageSize uint64, targetChunkBytes uint64) uint64 {
+	fixed := uint64(2+_nExtra) * _nSize // Capacity, the first offset, and the reserved slots
+	if targetChunkBytes <= fixed {
+		return 1
+	}
+	n := (targetChunkBytes - fixed) / (avgMessageSize + _nSize)
+	if n == 0 {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,113 @@
+package track
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestEstimateDiskUsage(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 1000
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 2500)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %08d", i)) // 16 bytes
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	var actual uint64
+	chunks, err := discoverChunks("", "id", DefaultChunkNamer{})
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(3, len(chunks), t)
+	for _, n := range chunks {
+		info, err := os.Stat(fname(chunkName("id", n), ""))
+		testutils.CheckErr(err, t)
+		actual += uint64(info.Size())
+	}
+
+	estimate := EstimateDiskUsage(DefaultTrackConfig(), 2500, 16)
+	diff := int64(estimate) - int64(actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	testutils.ExpectTrue(uint64(diff) <= actual/100, fmt.Sprintf("Estimate %d is too far from actual %d", estimate, actual), t)
+	testutils.CheckUint64(0, EstimateDiskUsage(DefaultTrackConfig(), 0, 16), t)
+	cleanupTrack()
+}
+
+func TestEstimateDiskUsageWithTimestamps(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 1000
+	cleanupTrack()
+
+	config := DefaultTrackConfig()
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	msgs := make([][]byte, 2500)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %08d", i)) // 16 bytes
+	}
+	_, err = track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	var actual, stamps uint64
+	chunks, err := discoverChunks("", "id", DefaultChunkNamer{})
+	testutils.CheckErr(err, t)
+	for _, n := range chunks {
+		info, err := os.Stat(fname(chunkName("id", n), ""))
+		testutils.CheckErr(err, t)
+		actual += uint64(info.Size())
+		info, err = os.Stat(timestampsName(chunkName("id", n), ""))
+		testutils.CheckErr(err, t)
+		stamps += uint64(info.Size())
+	}
+	testutils.CheckUint64(2500*_nSize, stamps, t)
+	actual += stamps
+
+	estimate := EstimateDiskUsage(config, 2500, 16)
+	testutils.CheckUint64(EstimateDiskUsage(DefaultTrackConfig(), 2500, 16)+stamps, estimate, t)
+	diff := int64(estimate) - int64(actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	testutils.ExpectTrue(uint64(diff) <= actual/100, fmt.Sprintf("Estimate %d is too far from actual %d", estimate, actual), t)
+	cleanupTrack()
+}
+
+func TestRecommendChunkSize(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	const target = 64 * 1024
+	CHUNK_SIZE = RecommendChunkSize(100, target)
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 2*CHUNK_SIZE)
+	for i := range msgs {
+		msgs[i] = make([]byte, 100)
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	chunks, err := discoverChunks("", "id", DefaultChunkNamer{})
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(chunks), t)
+	for _, n := range chunks {
+		info, err := os.Stat(fname(chunkName("id", n), ""))
+		testutils.CheckErr(err, t)
+		size := uint64(info.Size())
+		testutils.ExpectTrue(size <= target && size > target-108, fmt.Sprintf("Expected chunk of about %d bytes, got %d", target, size), t)
+	}
+
+	testutils.CheckUint64(1, RecommendChunkSize(100, 10), t)
+	testutils.CheckUint64(1, RecommendChunkSize(1<<20, 4096), t)
+}
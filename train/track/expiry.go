@@ -0,0 +1,56 @@
+package track
+
+import (
+	"os"
+	"time"
+)
+
+// Start the expiry sweeper if the config asks for one. It runs until the writer stops
+func (t *Track) startSweeper() {
+	if t.config.TTL <= 0 || t.config.SweepInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(t.config.SweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if t.finished() {
+				return
+			}
+			t.sweep(time.Now())
+		}
+	}()
+}
+
+// Delete the sealed chunks at the start of the track whose newest message is older than
+// the TTL. With Timestamps set, a chunk's age is taken from its newest timestamp. Chunks
+// written without them fall back to their file's modification time, which is set when
+// they're sealed and is never earlier than their newest message. Readers of the deleted
+// offsets get ErrOffsetTrimmed. Returns the number of chunks deleted
+func (t *Track) sweep(now time.Time) (int, error) {
+	return t.trimChunks(func(store *FileStorage) (bool, error) {
+		newest, err := t.newestWrite(store)
+		if err != nil {
+			return false, err
+		}
+		return now.Sub(newest) >= t.config.TTL, nil
+	})
+}
+
+// The time the newest message in the sealed store was written. Timestamps increase with
+// offset, so that's the last message's, if it has one
+func (t *Track) newestWrite(store *FileStorage) (time.Time, error) {
+	if t.config.Timestamps && store.Size > 0 {
+		ts, err := readTimestamp(timestampsName(store.fileId, store.rootPath), store.Size-1)
+		if err != nil {
+			return time.Time{}, err
+		} else if ts != 0 {
+			return time.Unix(0, ts), nil
+		}
+	}
+	info, err := os.Stat(fname(store.fileId, store.rootPath))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
@@ -0,0 +1,133 @@
+package track
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestSweeperDeletesExpiredChunks(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.TTL = 50 * time.Millisecond
+	config.SweepInterval = 10 * time.Millisecond
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	msgs := make([][]byte, 7)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err = track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	// A reader part way through the chunk which is about to expire
+	r, err := track.ReaderAt(3)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[3], msg, t)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for exists(fname(chunkName("id", 0), "")) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 0), "")), "Expected the expired chunk to be deleted", t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 1), "")), "Expected the active chunk to be kept", t)
+
+	_, err = r.Next()
+	testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the reader's chunk to be trimmed", t)
+	r2, err := track.ReaderAt(5)
+	testutils.CheckErr(err, t)
+	defer r2.Close()
+	for i := 5; i < len(msgs); i++ {
+		msg, err = r2.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+
+	// The writer carries on after the gap
+	offset, err := track.WriteAllSync([][]byte{testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(7, offset, t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestSweepKeepsUnexpiredChunks(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.TTL = time.Hour
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	_, err = track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+	n, err := track.sweep(time.Now())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, n, t)
+	n, err = track.sweep(time.Now().Add(2 * time.Hour))
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(1, n, t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestSweepFailedManifest(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.TTL = time.Hour
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	_, err = track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+
+	// The manifest can't be rewritten while something's in the way of its temporary file
+	blocker := manifestName("", "id") + ".tmp"
+	testutils.CheckErr(os.Mkdir(blocker, 0755), t)
+	defer os.Remove(blocker)
+	n, err := track.sweep(time.Now().Add(2 * time.Hour))
+	testutils.ExpectTrue(err != nil, "Expected the sweep to fail", t)
+	testutils.CheckInt(0, n, t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 0), "")), "Expected the chunk to be kept", t)
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, track.EarliestOffset(), t)
+	cleanupTrack()
+}
+
+func TestSweepUsesTimestamps(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	config := DefaultTrackConfig()
+	config.TTL = time.Hour
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	_, err = track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+	// Touching the chunk's file doesn't make its messages any newer
+	later := time.Now().Add(2 * time.Hour)
+	testutils.CheckErr(os.Chtimes(fname(chunkName("id", 0), ""), later, later), t)
+	n, err := track.sweep(time.Now().Add(90 * time.Minute))
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(1, n, t)
+	testutils.CheckUint64(5, track.EarliestOffset(), t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
@@ -1,12 +1,14 @@
 package track
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
-	"reflect"
-	"unsafe"
+	"sync"
 
 	"github.com/asp2insp/go-misc/utils"
 	"github.com/edsrzf/mmap-go"
@@ -16,69 +18,276 @@ import (
 // The size of the array must be specified at time of creation,
 // For fast access, the first 8 bytes stores the length, and then the following 8 * (length + 1)
 // bytes will be an offset table where each entry's offset is inserted as it is written.
+// The offset table is followed by _nExtra reserved slots holding per-chunk metadata.
 // Example: a FileStorage with capacity for 100 messages which currently has 1 message of size
 // 40 bytes inserted will have the following structure:
 // Byte Range: Contents
 //      [0-7]: 100
-//     [8-15]: 816        // Offset of the first message is the first byte address after the index
-//    [16-23]: 856        // Next message will begin after first message ends
+//     [8-15]: 848        // Offset of the first message is the first byte address after the header
+//    [16-23]: 888        // Next message will begin after first message ends
 //   [24-815]: 0          // Remainder of the index is empty. Index length is 101 uint32s since we store
 //                        // beginning and end offsets for each message
-//  [816-855]: MESSAGE1
+//  [816-823]: CHECKSUM   // Running CRC32 of every message written so far
+//  [824-831]: BASE + 1   // Offset of the first message within its track, plus one so that 0 means unknown
+//  [832-839]: SEALED     // 1 once the chunk has been retired, and will never be written again
+//  [840-847]: 0          // Reserved
+//  [848-887]: MESSAGE1
 //  Remainder of the file is empty
 //
+// Files written before the reserved slots were added have no checksum, and their first message
+// begins directly after the offset table. Since the first offset always marks the end of the
+// header, both layouts can be read.
+//
+// Header slots are little endian, and are accessed through either a memory map or
+// positional reads and writes, depending on HEADER_BACKEND. See header.go.
+//
+// Storage created with INDEX_SIDECAR set keeps the whole header in a separate file, named
+// after the storage with an .idx suffix. The data file then begins with just two slots: 0
+// where the capacity would be, which marks the storage as having a sidecar, and the offset
+// of the first message. The sidecar's offset table points into the data file as usual.
+//
 //
 // NOTE: THIS CLASS IS NOT THREAD-SAFE. Atomicity of operations must be implemented by
 // client code! Recommended use is to have a single goroutine manage access to a given FileStorage
 // instance.
 
 type FileStorage struct {
-	fileId       string
-	rootPath     string
-	file         *os.File
-	Capacity     uint64
-	Size         uint64
-	headerMemory mmap.MMap
-	fileMemory   mmap.MMap
-	index        []uint64
+	fileId     string
+	rootPath   string
+	file       *os.File
+	sidecar    *os.File  // Holds the header if it's kept apart from the data, otherwise nil
+	out        io.Writer // Messages are written through out, which is normally file
+	Capacity   uint64
+	Size       uint64
+	header     headerIO // Released once the storage is read-only
+	fileMemory mmap.MMap
+	index      []uint64 // The offset table, which must only be updated through setIndex
+	extra      []uint64 // The reserved header slots, empty for older files
+	checksum   uint32   // Running checksum of all messages, mirrored into extra
+	readOnly   bool
+	sealed     bool // Recorded in the header once the storage will never be written again
+	// If set, every write first checks that the offset table and the file agree
+	checkWrites bool
+	dirty       bool   // Whether the header has changed since the last Flush
+	baseOffset  uint64 // Offset of this store's first message within its track
+	replaced    bool   // Set by compaction once a rewritten copy has taken over the file, under the track's dataCond.L
+	// Used by ReadInto once the storage is read-only and file has been released
+	readFile  *os.File
+	readMutex sync.Mutex
 }
 
 const _nSize = 8 // sizeof(uint64)
 
+// Reserved header slots after the offset table
+const (
+	_slotChecksum = iota
+	_slotBaseOffset
+	_slotSealed
+	_nExtra = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// New files are extended to their initial size, and at least their header, up front.
+// If PAGE_ALIGN_FILES is set that's rounded up to a whole number of pages. Turn it off
+// to keep new files as small as possible, for filesystems where every block counts
+var PAGE_ALIGN_FILES = true
+
+// If set, storage created from now on keeps its offset table in a sidecar file, so that
+// Grow can enlarge it without moving the messages. Open works with either layout
+var INDEX_SIDECAR = false
+
+// Where the messages begin in a data file whose header is in a sidecar
+const _sidecarDataStart = 2 * _nSize
+
 // Create the file storage with the given path and name
 func NewFileStorage(root, id string, capacity uint64) *FileStorage {
+	return NewFileStorageWithSize(root, id, capacity, 0)
+}
+
+// Create the file storage with the given path and name, preallocating
+// initialSize bytes (rounded up to a whole page) so that the first writes
+// don't have to repeatedly extend the file
+func NewFileStorageWithSize(root, id string, capacity, initialSize uint64) *FileStorage {
+	store, err := CreateFileStorage(root, id, capacity, initialSize)
+	utils.Check(err)
+	return store
+}
+
+// Create the file storage with the given path and name, returning an error
+// rather than panicking if it can't be initialized. If creation fails part
+// way through, the partially created file is removed
+func CreateFileStorage(root, id string, capacity, initialSize uint64) (*FileStorage, error) {
+	if capacity == 0 {
+		return nil, fmt.Errorf("Cannot create storage %s with a capacity of 0", id)
+	}
 	f := FileStorage{
 		fileId:   id,
 		rootPath: root,
 		Capacity: capacity,
 		Size:     0,
 	}
-	return f.init()
+	path := fname(id, root)
+	existed := exists(path)
+	err := f.init(initialSize)
+	if err != nil {
+		if f.header != nil {
+			f.header.release()
+		}
+		if f.file != nil {
+			f.file.Close()
+		}
+		if f.sidecar != nil {
+			f.sidecar.Close()
+		}
+		if !existed {
+			removeStorage(id, root)
+		}
+		return nil, err
+	}
+	return &f, nil
 }
 
 // Open the file storage with the given path and name
 func Open(root, id string) *FileStorage {
+	store, err := OpenFileStorage(root, id)
+	utils.Check(err)
+	return store
+}
+
+// OpenFileStorage is like Open, but returns an error rather than panicking
+func OpenFileStorage(root, id string) (*FileStorage, error) {
+	return openStorage(root, id, false)
+}
+
+// Open the storage for writing. Sealed storage is opened read-only, unless unseal is set,
+// in which case the seal is removed so it can be written again
+func openStorage(root, id string, unseal bool) (_ *FileStorage, err error) {
+	defer recoverPanic(&err)
+	store := FileStorage{
+		fileId:   id,
+		rootPath: root,
+	}
+	store.file, err = open(fname(store.fileId, store.rootPath), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	store.out = store.file
+	err = store.loadHeader(mmap.RDWR)
+	if err != nil {
+		store.file.Close()
+		if store.sidecar != nil {
+			store.sidecar.Close()
+		}
+		return nil, err
+	}
+	// Sealed storage is read-only. Older files have no flag, so switch them once they're full
+	legacy := len(store.extra) <= _slotSealed
+	if unseal && store.sealed {
+		store.sealed = false
+		err = store.setExtra(_slotSealed, 0)
+	} else if !unseal && (store.sealed || (legacy && store.IsFull())) {
+		err = store.switchToReadOnly()
+	}
+	if err == nil && !store.readOnly {
+		_, err = store.file.Seek(int64(store.index[store.Size]), os.SEEK_SET)
+	}
+	if err != nil && !store.readOnly {
+		store.release()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
+
+// Open the file storage with the given path and name without write access.
+// The offset table is copied out of the mapped header and the file is closed
+// immediately, so the returned storage can only be used for reading.
+func OpenReadOnly(root, id string) (*FileStorage, error) {
 	store := FileStorage{
 		fileId:   id,
 		rootPath: root,
 	}
-	store.file = open(fname(store.fileId, store.rootPath), os.O_RDWR)
-	// Find the header size
 	var err error
-	capMem, err := mmap.MapRegion(store.file, _nSize, mmap.RDWR, 0, 0)
-	utils.Check(err)
-	capSlice := mmapToIndex(capMem, 0, uint64(_nSize))
-	store.Capacity = capSlice[0]
-	capMem.Unmap()
+	store.file, err = os.Open(fname(store.fileId, store.rootPath))
+	if err != nil {
+		return nil, err
+	}
+	err = store.loadHeader(mmap.RDONLY)
+	if err != nil {
+		store.file.Close()
+		if store.sidecar != nil {
+			store.sidecar.Close()
+		}
+		return nil, err
+	}
+	err = store.switchToReadOnly()
+	if err != nil {
+		return nil, err
+	}
+	return &store, nil
+}
 
-	// Init the header
-	headerSize := (store.Capacity + 2) * _nSize // Size of array + offset table in bytes
-	store.headerMemory, err = mmap.MapRegion(store.file, int(headerSize), mmap.RDWR, 0, 0)
-	utils.Check(err)
-	index := mmapToIndex(store.headerMemory, 0, headerSize)
+// ErrTruncatedHeader is returned when opening storage whose file is too short to hold the
+// header it says it has, for example because it was cut short by a failed copy
+var ErrTruncatedHeader = errors.New("Storage file is too short to hold its header")
+
+// Load the header of an existing file with the given protection and
+// use it to find the capacity and size of the storage
+func (store *FileStorage) loadHeader(prot int) error {
+	// Find the capacity and header size, which is the offset of the first message
+	prefix, err := readPrefix(store.file, prot)
+	if err != nil {
+		return err
+	}
+	headerFile := store.file
+	store.Capacity = prefix[0]
+	headerSize := prefix[1]
+	if store.Capacity == 0 && headerSize != 0 {
+		// The header is in a sidecar, which always has the reserved slots
+		flags := os.O_RDWR
+		if prot == mmap.RDONLY {
+			flags = os.O_RDONLY
+		}
+		store.sidecar, err = os.OpenFile(sidecarName(store.fileId, store.rootPath), flags, 0)
+		if err != nil {
+			return err
+		}
+		headerFile = store.sidecar
+		prefix, err = readPrefix(store.sidecar, prot)
+		if err != nil {
+			return err
+		}
+		store.Capacity = prefix[0]
+		headerSize = (store.Capacity + 2 + _nExtra) * _nSize
+	}
+	tableSize := (store.Capacity + 2) * _nSize // Size of array + offset table in bytes
+	if headerSize < tableSize {
+		return fmt.Errorf("Corrupt header in %s: header size %d is smaller than the offset table", store.fileId, headerSize)
+	}
+
+	// Init the header, which must all be in the file. Only new files are ever mapped past
+	// their end, while they're being created
+	err = checkFileSize(headerFile, headerSize)
+	if err != nil {
+		return err
+	}
+	store.header, err = newHeader(headerFile, headerSize, prot)
+	if err != nil {
+		return err
+	}
+	header := store.header.slots()
+	index := header[:store.Capacity+2]
 	store.index = index[1:]
+	store.extra = header[store.Capacity+2:]
+	if len(store.extra) > _slotChecksum {
+		store.checksum = uint32(store.extra[_slotChecksum])
+	}
+	store.sealed = len(store.extra) > _slotSealed && store.extra[_slotSealed] != 0
 
-	// Find the size of the array
+	// Find the size of the array. If we don't find an end, we're full
+	store.Size = store.Capacity
 	for i, offset := range index {
 		// Look for the end of our written index
 		if offset == 0 {
@@ -86,47 +295,598 @@ func Open(root, id string) *FileStorage {
 			break
 		}
 	}
-	// If we didn't find an end, we're full and we'll switch to read-only mode
-	if store.Size == 0 {
-		store.Size = store.Capacity
-		store.switchToReadOnly()
-	} else {
-		_, err = store.file.Seek(int64(store.index[store.Size]), os.SEEK_SET)
-		utils.Check(err)
+	return nil
+}
+
+// Check that the file holds at least size bytes
+func checkFileSize(file *os.File, size uint64) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	} else if uint64(info.Size()) < size {
+		return ErrTruncatedHeader
+	}
+	return nil
+}
+
+// Read the first two slots of a header file
+func readPrefix(file *os.File, prot int) ([]uint64, error) {
+	err := checkFileSize(file, 2*_nSize)
+	if err != nil {
+		return nil, err
 	}
-	return &store
+	prefixHeader, err := newHeader(file, 2*_nSize, prot)
+	if err != nil {
+		return nil, err
+	}
+	prefix := append([]uint64(nil), prefixHeader.slots()...)
+	return prefix, prefixHeader.release()
 }
 
 // STORAGE
-func (store *FileStorage) init() *FileStorage {
+func (store *FileStorage) init(initialSize uint64) error {
 	// Init the header
-	headerSize := (store.Capacity + 2) * _nSize // Size of array + offset table in bytes
-	store.file = open(fname(store.fileId, store.rootPath), os.O_RDWR|os.O_CREATE)
+	headerSize := (store.Capacity + 2 + _nExtra) * _nSize // Size of array + offset table + reserved slots in bytes
+	if headerSize > maxHeaderSize {
+		return fmt.Errorf("Capacity %d is too large, its header would be %d bytes", store.Capacity, headerSize)
+	}
+	dataStart := headerSize
+	if INDEX_SIDECAR {
+		dataStart = _sidecarDataStart
+	}
+	if initialSize < dataStart {
+		initialSize = dataStart // Make sure every slot in the header is backed by the file
+	}
 	var err error
-	store.headerMemory, err = mmap.MapRegion(store.file, int(headerSize), mmap.RDWR, 0, 0)
-	utils.Check(err)
-	index := mmapToIndex(store.headerMemory, 0, headerSize)
-	index[0] = store.Capacity
-	store.index = index[1:]
-	store.index[0] = headerSize
-	_, err = store.file.Seek(int64(headerSize), os.SEEK_SET)
-	utils.Check(err)
-	return store
+	store.file, err = open(fname(store.fileId, store.rootPath), os.O_RDWR|os.O_CREATE, initialSize)
+	if err != nil {
+		return err
+	}
+	store.out = store.file
+	headerFile := store.file
+	if INDEX_SIDECAR {
+		// Start from an empty sidecar, so no stale offsets are left past the end of the index
+		store.sidecar, err = open(sidecarName(store.fileId, store.rootPath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, headerSize)
+		if err != nil {
+			return err
+		}
+		headerFile = store.sidecar
+	}
+	store.header, err = newHeader(headerFile, headerSize, mmap.RDWR)
+	if err != nil {
+		return err
+	}
+	header := store.header.slots()
+	store.index = header[1 : store.Capacity+2]
+	store.extra = header[store.Capacity+2:]
+	err = store.header.set(0, store.Capacity)
+	if err == nil {
+		err = store.setIndex(0, dataStart)
+	}
+	// Don't inherit metadata from a file which was here before
+	for slot := range store.extra {
+		if err == nil && store.extra[slot] != 0 {
+			err = store.setExtra(slot, 0)
+		}
+	}
+	if err == nil && INDEX_SIDECAR {
+		// Mark the data file as having a sidecar, once the sidecar is ready
+		var prefix [_sidecarDataStart]byte
+		binary.LittleEndian.PutUint64(prefix[_nSize:], dataStart)
+		_, err = store.file.WriteAt(prefix[:], 0)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = store.file.Seek(int64(dataStart), os.SEEK_SET)
+	return err
 }
 
 // Write the given message to the storage.
 func (store *FileStorage) WriteMessage(index int, data []byte) error {
-	if uint64(index) != store.Size {
+	p, err := store.prepareMessage(index, data)
+	if err != nil {
+		return err
+	}
+	return store.commitMessage(p)
+}
+
+// Write the given messages to the storage, starting at the given index. Their data goes
+// to the file in a single write, rather than one per message
+func (store *FileStorage) WriteMessages(index int, msgs [][]byte) error {
+	pending, err := store.prepareMessages(index, msgs)
+	for _, p := range pending {
+		if err == nil {
+			err = store.commitMessage(p)
+		}
+	}
+	return err
+}
+
+// Write a message of the given size to the storage, copying it directly from r.
+// If r can't provide size bytes, the message is discarded and an error is returned
+func (store *FileStorage) WriteMessageFrom(index int, r io.Reader, size int64) error {
+	p, err := store.prepareMessageFrom(index, r, size)
+	if err != nil {
+		return err
+	}
+	return store.commitMessage(p)
+}
+
+// A message which has been written to the file, but isn't part of the index yet.
+// Writes are split in two so that a Track can do the slow part, writing the data,
+// without blocking readers, and only synchronize with them for the commit
+type pendingMessage struct {
+	index    int
+	end      uint64 // Offset just past the end of the message
+	checksum uint32 // Running checksum including the message
+}
+
+// Write the message data to the file without making it visible
+func (store *FileStorage) prepareMessage(index int, data []byte) (pendingMessage, error) {
+	err := store.checkWritable(index)
+	if err == nil && store.checkWrites {
+		err = store.checkConsistent(index)
+	}
+	if err != nil {
+		return pendingMessage{}, err
+	}
+	n, err := store.out.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return pendingMessage{}, store.abortWrite(index, fmt.Errorf("Only wrote %d of %d bytes: %v", n, len(data), err))
+	}
+	return pendingMessage{
+		index:    index,
+		end:      store.index[index] + uint64(len(data)),
+		checksum: crc32.Update(store.checksum, crcTable, data),
+	}, nil
+}
+
+// Write the data of all the messages to the file at once without making any of them visible
+func (store *FileStorage) prepareMessages(index int, msgs [][]byte) ([]pendingMessage, error) {
+	err := store.checkWritable(index)
+	if err == nil && uint64(index+len(msgs)) > store.Capacity {
+		err = fmt.Errorf("Index %d out of bounds [0, %d]", index+len(msgs)-1, store.Capacity)
+	}
+	if err == nil && store.checkWrites {
+		err = store.checkConsistent(index)
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, msg := range msgs {
+		size += len(msg)
+	}
+	buf := make([]byte, 0, size)
+	pending := make([]pendingMessage, len(msgs))
+	end, sum := store.index[index], store.checksum
+	for i, msg := range msgs {
+		buf = append(buf, msg...)
+		end += uint64(len(msg))
+		sum = crc32.Update(sum, crcTable, msg)
+		pending[i] = pendingMessage{index: index + i, end: end, checksum: sum}
+	}
+	n, err := store.out.Write(buf)
+	if err == nil && n < len(buf) {
+		err = io.ErrShortWrite
+	}
+	if err != nil {
+		return nil, store.abortWrite(index, fmt.Errorf("Only wrote %d of %d bytes: %v", n, len(buf), err))
+	}
+	return pending, nil
+}
+
+// Copy the message data from r to the file without making it visible
+func (store *FileStorage) prepareMessageFrom(index int, r io.Reader, size int64) (pendingMessage, error) {
+	err := store.checkWritable(index)
+	if err == nil && store.checkWrites {
+		err = store.checkConsistent(index)
+	}
+	if err != nil {
+		return pendingMessage{}, err
+	}
+	sum := &checksumWriter{store.checksum}
+	n, err := io.CopyN(io.MultiWriter(store.out, sum), r, size)
+	if err != nil {
+		return pendingMessage{}, store.abortWrite(index, fmt.Errorf("Only wrote %d of %d bytes: %v", n, size, err))
+	}
+	return pendingMessage{
+		index:    index,
+		end:      store.index[index] + uint64(size),
+		checksum: sum.sum,
+	}, nil
+}
+
+// Add a prepared message to the index, making it visible to readers.
+// If the index can't be updated, the message is discarded
+func (store *FileStorage) commitMessage(p pendingMessage) error {
+	err := store.setIndex(p.index+1, p.end)
+	if err != nil {
+		return store.abortWrite(p.index, err)
+	}
+	store.Size++
+	return store.setChecksum(p.checksum)
+}
+
+// Update an entry in the offset table
+func (store *FileStorage) setIndex(i int, offset uint64) error {
+	store.dirty = true
+	return store.header.set(1+i, offset)
+}
+
+// Record the running checksum, in the header if there's room for it
+func (store *FileStorage) setChecksum(sum uint32) error {
+	store.checksum = sum
+	return store.setExtra(_slotChecksum, uint64(sum))
+}
+
+// Record the offset of the first message within the track, in the header if
+// there's room for it and the storage is still writable
+func (store *FileStorage) setBaseOffset(offset uint64) error {
+	store.baseOffset = offset
+	if store.readOnly {
+		return nil
+	}
+	return store.setExtra(_slotBaseOffset, offset+1)
+}
+
+// The base offset recorded in the header. Returns false for storage
+// written before base offsets were recorded
+func (store *FileStorage) recordedBaseOffset() (uint64, bool) {
+	if len(store.extra) <= _slotBaseOffset || store.extra[_slotBaseOffset] == 0 {
+		return 0, false
+	}
+	return store.extra[_slotBaseOffset] - 1, true
+}
+
+// Update a reserved header slot, if the header has it
+func (store *FileStorage) setExtra(slot int, value uint64) error {
+	if len(store.extra) <= slot {
+		return nil
+	}
+	store.dirty = true
+	return store.header.set(int(store.Capacity)+2+slot, value)
+}
+
+// Grow increases the capacity of writable storage, keeping its messages. If the offset table
+// is in a sidecar, only the sidecar is rewritten. Otherwise the messages begin directly after
+// the offset table, so there's no room to extend it in place. Instead the messages are copied
+// into a new file with a bigger header, which replaces the old one. That costs a full copy of
+// the data, so it's best avoided for large storage. Readers which already have the old file
+// open carry on reading it, since it holds the same messages
+func (store *FileStorage) Grow(newCapacity uint64) error {
+	if store.readOnly {
+		return ErrReadOnly
+	} else if newCapacity <= store.Capacity {
+		return fmt.Errorf("Cannot grow %s from %d to %d messages", store.fileId, store.Capacity, newCapacity)
+	}
+	return store.resize(newCapacity)
+}
+
+// Shrink the capacity of writable storage down to the messages it holds, so that it's full,
+// in the same way as Grow
+func (store *FileStorage) shrinkToFit() error {
+	if store.readOnly {
+		return ErrReadOnly
+	} else if store.Size == 0 {
+		return fmt.Errorf("Cannot shrink %s to hold no messages", store.fileId)
+	} else if store.IsFull() {
+		return nil
+	}
+	return store.resize(store.Size)
+}
+
+// Change the capacity of the storage, which must leave room for its messages
+func (store *FileStorage) resize(newCapacity uint64) error {
+	if store.sidecar != nil {
+		return store.resizeSidecar(newCapacity)
+	}
+	tempId := store.fileId + ".grow"
+	grown, err := CreateFileStorage(store.rootPath, tempId, newCapacity, 0)
+	if err != nil {
+		return err
+	}
+	err = store.copyInto(grown)
+	if err == nil {
+		err = grown.Flush()
+	}
+	if err == nil {
+		err = renameStorage(tempId, store.rootPath, store.fileId, store.rootPath)
+	}
+	if err != nil {
+		grown.Close()
+		removeStorage(tempId, store.rootPath)
+		return err
+	}
+	// Take over the new files
+	err = store.release()
+	store.file, store.out, store.header = grown.file, grown.file, grown.header
+	store.sidecar = grown.sidecar
+	store.index, store.extra = grown.index, grown.extra
+	store.Capacity = grown.Capacity
+	return err
+}
+
+// Replace the sidecar with one of a different size, holding the same offsets and reserved slots
+func (store *FileStorage) resizeSidecar(newCapacity uint64) error {
+	headerSize := (newCapacity + 2 + _nExtra) * _nSize
+	if headerSize > maxHeaderSize {
+		return fmt.Errorf("Capacity %d is too large, its header would be %d bytes", newCapacity, headerSize)
+	}
+	slots := make([]uint64, headerSize/_nSize)
+	slots[0] = newCapacity
+	copy(slots[1:], store.index[:store.Size+1])
+	copy(slots[newCapacity+2:], store.extra)
+	data := make([]byte, headerSize)
+	for i, slot := range slots {
+		binary.LittleEndian.PutUint64(data[i*_nSize:], slot)
+	}
+	name := sidecarName(store.fileId, store.rootPath)
+	err := store.header.flush()
+	if err == nil {
+		err = replaceFile(name, data)
+	}
+	if err != nil {
+		return err
+	}
+
+	sidecar, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	header, err := newHeader(sidecar, headerSize, mmap.RDWR)
+	if err != nil {
+		sidecar.Close()
+		return err
+	}
+	err = firstErr(store.header.release(), store.sidecar.Close())
+	store.sidecar, store.header = sidecar, header
+	slots = header.slots()
+	store.index = slots[1 : newCapacity+2]
+	store.extra = slots[newCapacity+2:]
+	store.Capacity = newCapacity
+	return err
+}
+
+// Copy the messages and metadata into empty storage with at least the same capacity
+func (store *FileStorage) copyInto(dst *FileStorage) error {
+	if base, ok := store.recordedBaseOffset(); ok {
+		err := dst.setBaseOffset(base)
+		if err != nil {
+			return err
+		}
+	}
+	if store.Size == 0 {
+		return nil
+	}
+	r, length, err := store.RawRange(0, store.Size)
+	if err != nil {
+		return err
+	}
+	defer r.(io.Closer).Close()
+	// Older files have no checksum, so work it out as we go
+	sum := &checksumWriter{}
+	_, err = io.CopyN(io.MultiWriter(dst.out, sum), r, int64(length))
+	if err != nil {
+		return err
+	}
+	shift := dst.index[0] - store.index[0]
+	for i := 1; i <= int(store.Size); i++ {
+		err = dst.setIndex(i, store.index[i]+shift)
+		if err != nil {
+			return err
+		}
+	}
+	dst.Size = store.Size
+	return dst.setChecksum(sum.sum)
+}
+
+// CopyTo writes the storage to w as a chunk file holding just its header and the messages
+// written so far, without any unwritten space after them, and returns the number of bytes
+// written. LoadFrom turns it back into storage. The header always comes first, even if the
+// storage keeps it in a sidecar. Nothing may write to the storage while it's copied, so
+// it's meant for sealed chunks
+func (store *FileStorage) CopyTo(w io.Writer) (int64, error) {
+	slots := make([]uint64, 0, 2+store.Capacity+uint64(len(store.extra)))
+	slots = append(slots, store.Capacity)
+	slots = append(slots, store.index[:store.Capacity+1]...)
+	slots = append(slots, store.extra...)
+	// The messages follow straight after the header, wherever they started before
+	shift := uint64(len(slots))*_nSize - store.index[0]
+	for i := 1; i <= int(store.Size)+1; i++ {
+		slots[i] += shift
+	}
+	for i := int(store.Size) + 2; i < int(store.Capacity)+2; i++ {
+		slots[i] = 0
+	}
+	header := make([]byte, len(slots)*_nSize)
+	for i, slot := range slots {
+		binary.LittleEndian.PutUint64(header[i*_nSize:], slot)
+	}
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil || store.Size == 0 {
+		return written, err
+	}
+	r, length, err := store.RawRange(0, store.Size)
+	if err != nil {
+		return written, err
+	}
+	defer r.(io.Closer).Close()
+	copied, err := io.CopyN(w, r, int64(length))
+	return written + copied, err
+}
+
+// LoadFrom creates storage with the given id from a chunk file written by CopyTo, and
+// checks its messages against its checksum. Storage with the id mustn't already exist.
+// If the chunk was sealed, so is the storage, and it's opened read-only
+func LoadFrom(root, id string, r io.Reader) (*FileStorage, error) {
+	if exists(fname(id, root)) {
+		return nil, fmt.Errorf("Cannot load storage %s, it already exists", id)
+	}
+	tempId := id + ".load"
+	f, err := os.OpenFile(fname(tempId, root), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = firstErr(err, f.Close())
+	if err == nil {
+		err = renameStorage(tempId, root, id, root)
+	}
+	if err != nil {
+		removeStorage(tempId, root)
+		return nil, err
+	}
+	store, err := OpenFileStorage(root, id)
+	if err == nil {
+		err = store.Verify()
+		if err != nil {
+			store.Close()
+		}
+	}
+	if err != nil {
+		removeStorage(id, root)
+		return nil, err
+	}
+	return store, nil
+}
+
+// Verify re-reads every message in the storage and checks them against the
+// running checksum stored in the header. Returns an error if the data doesn't
+// match. Storage written before checksums were added can't be verified, and
+// always passes
+func (store *FileStorage) Verify() error {
+	if len(store.extra) <= _slotChecksum {
+		return nil
+	}
+	r, length, err := store.RawRange(0, store.Size)
+	if err != nil {
+		return err
+	}
+	defer r.(io.Closer).Close()
+	sum := &checksumWriter{}
+	_, err = io.CopyN(sum, r, int64(length))
+	if err != nil {
+		return err
+	}
+	if sum.sum != store.checksum {
+		return fmt.Errorf("Checksum mismatch in %s: header has %08x but data is %08x", store.fileId, store.checksum, sum.sum)
+	}
+	return nil
+}
+
+// Undo a failed write of the message with the given index, leaving the storage exactly
+// as it was before the write. Size and the index are never updated until a write succeeds,
+// so we only need to rewind the file so the next message overwrites any partial data
+func (store *FileStorage) abortWrite(index int, cause error) error {
+	_, err := store.file.Seek(int64(store.index[index]), os.SEEK_SET)
+	if err != nil {
+		return fmt.Errorf("%v, and could not rewind: %v", cause, err)
+	}
+	return cause
+}
+
+// TruncateTo drops the messages from the given index on, and shortens the file to end with
+// the last message kept. It only ever shrinks the storage, so a size beyond the messages
+// it holds is an error. Like writes, the change is only durable once the storage is flushed
+func (store *FileStorage) TruncateTo(size uint64) error {
+	if store.readOnly {
+		return ErrReadOnly
+	} else if size > store.Size {
+		return fmt.Errorf("Cannot truncate storage holding %d messages to %d", store.Size, size)
+	}
+	err := store.truncate(size)
+	if err == nil {
+		err = store.file.Truncate(int64(store.index[size]))
+	}
+	return err
+}
+
+// Reset drops every message, and forgets the base offset, so that the storage can be reused
+// for a new stream without allocating another file. The capacity is kept, and so is the
+// file, which the new messages overwrite. Like writes, the change is only durable once the
+// storage is flushed
+func (store *FileStorage) Reset() error {
+	if store.readOnly {
+		return ErrReadOnly
+	}
+	err := store.truncate(0)
+	if err == nil {
+		store.baseOffset = 0
+		err = store.setExtra(_slotBaseOffset, 0)
+	}
+	if err == nil {
+		_, err = store.file.Seek(int64(store.index[0]), os.SEEK_SET)
+	}
+	return err
+}
+
+// Drop the messages from the given index on, so that the next one written takes its place.
+// Their data is left in the file to be overwritten
+func (store *FileStorage) truncate(size uint64) error {
+	if size >= store.Size {
+		return nil
+	} else if store.readOnly {
+		return ErrReadOnly
+	}
+	sum := &checksumWriter{}
+	if size > 0 {
+		r, length, err := store.RawRange(0, size)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(sum, r, int64(length))
+		r.(io.Closer).Close()
+		if err != nil {
+			return err
+		}
+	}
+	for i := store.Size; i > size; i-- {
+		err := store.setIndex(int(i), 0)
+		if err != nil {
+			return err
+		}
+	}
+	store.Size = size
+	err := store.setChecksum(sum.sum)
+	if err != nil {
+		return err
+	}
+	_, err = store.file.Seek(int64(store.index[size]), os.SEEK_SET)
+	return err
+}
+
+// Check that the message with the given index can be written next
+func (store *FileStorage) checkWritable(index int) error {
+	if store.readOnly {
+		return ErrReadOnly
+	} else if uint64(index) != store.Size {
 		return fmt.Errorf("Out of order message. Expected %d but got %d", store.Size, index)
 	} else if index < 0 || uint64(index) >= store.Capacity {
 		return fmt.Errorf("Index %d out of bounds [0, %d]", index, store.Capacity)
 	}
-	_, err := store.file.Write(data)
+	return nil
+}
+
+// Check that the message with the given index would be written where the offset table
+// says it starts: offsets never go backwards, and the file is positioned at the end of
+// the last message
+func (store *FileStorage) checkConsistent(index int) error {
+	pos, err := store.file.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return err
 	}
-	store.index[index+1] = store.index[index] + uint64(len(data))
-	store.Size++
+	if (index > 0 && store.index[index] < store.index[index-1]) || uint64(pos) != store.index[index] {
+		return ErrCorruptIndex
+	}
 	return nil
 }
 
@@ -149,6 +909,176 @@ func (store *FileStorage) ReaderAt(messageIndex uint64) (io.ReadCloser, error) {
 	return r, nil
 }
 
+// ReadInto reads the message with the given index into p, and returns its size. Unlike
+// ReaderAt, it doesn't open a file or allocate, as it reads with ReadAt from a file which
+// the storage keeps open. Returns ErrShortBuffer if p is too small for the message
+func (store *FileStorage) ReadInto(messageIndex uint64, p []byte) (int, error) {
+	size, err := store.SizeOf(messageIndex)
+	if err != nil {
+		return 0, err
+	} else if size > uint64(len(p)) {
+		return 0, ErrShortBuffer
+	}
+	file, err := store.readHandle()
+	if err != nil {
+		return 0, err
+	}
+	return file.ReadAt(p[:size], int64(store.index[messageIndex]))
+}
+
+// SectionReaderAt returns a reader over just the message with the given index, for random
+// access within it. Like ReadInto, it reads from the file the storage keeps open, so it
+// needn't be closed, but stops working once the storage is closed
+func (store *FileStorage) SectionReaderAt(messageIndex uint64) (*io.SectionReader, error) {
+	size, err := store.SizeOf(messageIndex)
+	if err != nil {
+		return nil, err
+	}
+	file, err := store.readHandle()
+	if err != nil {
+		return nil, err
+	}
+	return io.NewSectionReader(file, int64(store.index[messageIndex]), int64(size)), nil
+}
+
+// The file to read messages from. While the storage is writable that's the file it
+// writes to. Once it's read-only, another is opened on first use, and kept until Close
+func (store *FileStorage) readHandle() (*os.File, error) {
+	store.readMutex.Lock()
+	defer store.readMutex.Unlock()
+	if !store.readOnly {
+		return store.file, nil
+	}
+	if store.readFile == nil {
+		file, err := os.Open(fname(store.fileId, store.rootPath))
+		if err != nil {
+			return nil, err
+		}
+		store.readFile = file
+	}
+	return store.readFile, nil
+}
+
+// Return a reader over the raw bytes of the messages in [fromIdx, toIdx), along
+// with the total length of the range. The reader closes its file once it reaches
+// the end of the range, and may be closed early by asserting it to an io.Closer
+func (store *FileStorage) RawRange(fromIdx, toIdx uint64) (io.Reader, uint64, error) {
+	if fromIdx > toIdx {
+		return nil, 0, fmt.Errorf("Invalid range [%d, %d)", fromIdx, toIdx)
+	} else if toIdx > store.Size {
+		return nil, 0, fmt.Errorf("Index %d exceeds available size of %d", toIdx, store.Size)
+	}
+	r, err := os.Open(fname(store.fileId, store.rootPath))
+	if err != nil {
+		return nil, 0, err
+	}
+	start := store.index[fromIdx]
+	length := store.index[toIdx] - start
+	return &sectionReadCloser{io.NewSectionReader(r, int64(start), int64(length)), r}, length, nil
+}
+
+// ReverseReaderFrom returns an iterator over the messages from the given index down to
+// the first. Each message is found straight from the offset table, and read with ReadInto
+func (store *FileStorage) ReverseReaderFrom(index uint64) (MessageIterator, error) {
+	if index >= store.Size {
+		return nil, fmt.Errorf("Index %d exceeds available size of %d", index, store.Size)
+	}
+	return &reverseIterator{store: store, next: int64(index)}, nil
+}
+
+type reverseIterator struct {
+	store   *FileStorage
+	next    int64 // Index of the message Next reads, -1 once they've all been read
+	message []byte
+	err     error
+}
+
+func (it *reverseIterator) Next() bool {
+	it.message = nil
+	if it.err != nil || it.next < 0 {
+		return false
+	}
+	size, err := it.store.SizeOf(uint64(it.next))
+	if err == nil {
+		it.message = make([]byte, size)
+		_, err = it.store.ReadInto(uint64(it.next), it.message)
+	}
+	if err != nil {
+		it.message, it.err = nil, err
+		return false
+	}
+	it.next--
+	return true
+}
+
+func (it *reverseIterator) Message() []byte {
+	return it.message
+}
+
+func (it *reverseIterator) Err() error {
+	return it.err
+}
+
+// Close does nothing, as the storage's own file is used
+func (it *reverseIterator) Close() error {
+	return nil
+}
+
+// Messages returns an iterator over the messages in the storage, from the first up to
+// those written so far. Unlike reading each with ReaderAt, the file is only opened once,
+// and each message is read straight from the offset table with ReadAt. Each message is
+// only valid until the next call to Next, which reuses its buffer
+func (store *FileStorage) Messages() MessageIterator {
+	file, err := os.Open(fname(store.fileId, store.rootPath))
+	return &messageIterator{store: store, file: file, end: store.Size, err: err}
+}
+
+type messageIterator struct {
+	store   *FileStorage
+	file    *os.File
+	next    uint64 // Index of the message Next reads
+	end     uint64 // The size of the storage when the iterator was created
+	buf     []byte
+	message []byte
+	err     error
+}
+
+func (it *messageIterator) Next() bool {
+	it.message = nil
+	if it.err != nil || it.next >= it.end {
+		return false
+	}
+	size, err := it.store.SizeOf(it.next)
+	if err == nil {
+		if uint64(cap(it.buf)) < size {
+			it.buf = make([]byte, size)
+		}
+		it.message = it.buf[:size]
+		_, err = it.file.ReadAt(it.message, int64(it.store.index[it.next]))
+	}
+	if err != nil {
+		it.message, it.err = nil, err
+		return false
+	}
+	it.next++
+	return true
+}
+
+func (it *messageIterator) Message() []byte {
+	return it.message
+}
+
+func (it *messageIterator) Err() error {
+	return it.err
+}
+
+func (it *messageIterator) Close() error {
+	if it.file == nil {
+		return nil
+	}
+	return it.file.Close()
+}
+
 // Return the size in bytes of the message at the given index
 func (store *FileStorage) SizeOf(messageIndex uint64) (uint64, error) {
 	if uint64(messageIndex) >= store.Size {
@@ -164,69 +1094,239 @@ func (store *FileStorage) SizeOf(messageIndex uint64) (uint64, error) {
 	return top - bottom, nil
 }
 
+// Locate returns where the message with the given index lies in the data file: the byte
+// offset it starts at, and its length. It's for code which reads the file itself, for
+// example through its own mapping. Growing the storage moves its messages, unless the
+// offset table is in a sidecar, so they have to be located again afterwards
+func (store *FileStorage) Locate(messageIndex uint64) (byteOffset, length uint64, err error) {
+	length, err = store.SizeOf(messageIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+	return store.index[messageIndex], length, nil
+}
+
 func (store *FileStorage) IsFull() bool {
 	return store.Size == store.Capacity
 }
 
 // Flush any pending writes to disk
-func (store *FileStorage) Flush() {
-	store.file.Sync()
-	store.headerMemory.Flush()
+func (store *FileStorage) Flush() error {
+	if store.readOnly {
+		return nil // Already flushed when it was sealed
+	}
+	err := firstErr(store.file.Sync(), store.header.flush())
+	if store.sidecar != nil {
+		err = firstErr(err, store.sidecar.Sync())
+	}
+	if err == nil {
+		store.dirty = false
+	}
+	return err
 }
 
 // CLOSABLE
 
-// Close this storage, by closing the file
-// pointers and unmapping all memory
-func (store *FileStorage) Close() {
-	store.headerMemory.Flush()
-	store.headerMemory.Unmap()
-	store.file.Close()
+// Close this storage, by closing the file pointers and unmapping all memory.
+// Returns the first failure, since a failed flush means the header may not
+// have reached the disk
+func (store *FileStorage) Close() error {
+	if store.readOnly {
+		// Everything else was released by switchToReadOnly
+		store.readMutex.Lock()
+		defer store.readMutex.Unlock()
+		if store.readFile == nil {
+			return nil
+		}
+		err := store.readFile.Close()
+		store.readFile = nil
+		return err
+	}
+	return firstErr(store.header.flush(), store.release())
 }
 
 // UTILS
 
-func (store *FileStorage) switchToReadOnly() {
+// Mark the storage as sealed in its header, so that it's never written to again,
+// and switch to read-only mode
+func (store *FileStorage) seal() error {
+	if store.readOnly {
+		return nil // The header has already been released
+	}
+	store.sealed = true
+	err := store.setExtra(_slotSealed, 1)
+	if err == nil {
+		// Flush after setting the flag, so it's as durable as the messages
+		err = store.Flush()
+	}
+	if err != nil {
+		return err // Left writable, so that the flush can be retried
+	}
+	return store.switchToReadOnly()
+}
+
+func (store *FileStorage) switchToReadOnly() error {
+	if store.readOnly {
+		return nil
+	}
 	index := make([]uint64, store.Capacity+1)
 	copy(index, store.index)
 	store.index = index
-	store.headerMemory.Unmap()
-	store.file.Close()
+	extra := make([]uint64, len(store.extra))
+	copy(extra, store.extra)
+	store.extra = extra
+	store.readOnly = true
+	return store.release()
+}
+
+// Release the header and close the files
+func (store *FileStorage) release() error {
+	err := store.header.release()
+	store.header = nil
+	if store.sidecar != nil {
+		err = firstErr(err, store.sidecar.Close())
+	}
+	return firstErr(err, store.file.Close())
+}
+
+// Return the first non-nil error
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Accumulates a running checksum of everything written to it
+type checksumWriter struct {
+	sum uint32
+}
+
+func (c *checksumWriter) Write(p []byte) (int, error) {
+	c.sum = crc32.Update(c.sum, crcTable, p)
+	return len(p), nil
 }
 
-// Open the given file with the given flags
-func open(path string, fileFlags int) *os.File {
+// A reader over part of a file which closes the file once it has been read to the end
+type sectionReadCloser struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r *sectionReadCloser) Read(p []byte) (int, error) {
+	n, err := r.SectionReader.Read(p)
+	if err == io.EOF {
+		r.file.Close()
+	}
+	return n, err
+}
+
+func (r *sectionReadCloser) Close() error {
+	return r.file.Close()
+}
+
+// Open the given file with the given flags. Empty files are extended to initialSize,
+// rounded up to a whole page if PAGE_ALIGN_FILES is set. So are files left behind
+// shorter than initialSize, or a header bigger than a page could be mapped past the
+// end of the file, where touching it faults
+func open(path string, fileFlags int, initialSize uint64) (*os.File, error) {
 	file, err := os.OpenFile(path, fileFlags, 0666)
-	utils.Check(err)
-	if utils.Filesize(file) == 0 {
-		err = file.Truncate(int64(os.Getpagesize()))
-		utils.Check(err)
+	if err != nil {
+		return nil, err
 	}
-	return file
+	size := uint64(utils.Filesize(file))
+	short := size < initialSize
+	if PAGE_ALIGN_FILES {
+		initialSize = pageAlign(initialSize)
+	}
+	if (size == 0 && initialSize > 0) || short {
+		err = file.Truncate(int64(initialSize))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// Round the given size up to a multiple of the page size, with
+// a minimum of one page
+func pageAlign(size uint64) uint64 {
+	page := uint64(os.Getpagesize())
+	if size <= page {
+		return page
+	}
+	return (size + page - 1) / page * page
 }
 
 // Return a path to the file named with the given id.
 // If a root dir is provided, the file will be relative
 // to that root. Otherwise it is placed in the tmpdir
 func fname(id, root string) string {
+	return filepath.Join(rootDir(root), id)
+}
+
+// The directory files with the given root are placed in
+func rootDir(root string) string {
 	if root != "" {
-		return filepath.Join(root, id)
-	} else {
-		return filepath.Join(os.TempDir(), id)
+		return root
 	}
+	return os.TempDir()
+}
+
+// The name of the sidecar file holding the header of the storage with the given id
+func sidecarName(id, root string) string {
+	return fname(id+".idx", root)
+}
+
+// The files which may be kept beside a storage's data file
+var storageFiles = []func(id, root string) string{sidecarName, timestampsName}
+
+// Remove the files of the storage with the given id
+func removeStorage(id, root string) error {
+	err := os.Remove(fname(id, root))
+	for _, name := range storageFiles {
+		if serr := os.Remove(name(id, root)); !os.IsNotExist(serr) {
+			err = firstErr(err, serr)
+		}
+	}
+	for j := 0; exists(fname(columnName(id, j), root)); j++ {
+		err = firstErr(err, removeStorage(columnName(id, j), root))
+	}
+	return err
+}
+
+// Rename the files of the storage with the given id, and of its columns. If any of the
+// files beside the data file can't be renamed, those already renamed are put back
+func renameStorage(id, root, newId, newRoot string) error {
+	names := append([]func(id, root string) string{fname}, storageFiles...)
+	for i, name := range names {
+		err := os.Rename(name(id, root), name(newId, newRoot))
+		if err != nil && (i == 0 || !os.IsNotExist(err)) {
+			for _, renamed := range names[:i] {
+				os.Rename(renamed(newId, newRoot), renamed(id, root))
+			}
+			return err
+		}
+	}
+	for j := 0; exists(fname(columnName(id, j), root)); j++ {
+		err := renameStorage(columnName(id, j), root, columnName(newId, j), newRoot)
+		if err != nil {
+			for k := 0; k < j; k++ {
+				renameStorage(columnName(newId, k), newRoot, columnName(id, k), root)
+			}
+			for _, renamed := range names {
+				os.Rename(renamed(newId, newRoot), renamed(id, root))
+			}
+			return err
+		}
+	}
+	return nil
 }
 
 func exists(name string) bool {
 	_, err := os.Stat(name)
 	return !os.IsNotExist(err)
 }
-
-// Cast the []byte represented by the mmapped region
-// to an array of integers
-func mmapToIndex(data mmap.MMap, offset, size uint64) []uint64 {
-	d := data[offset : offset+size]
-	dHeader := (*reflect.SliceHeader)(unsafe.Pointer(&d))
-	dHeader.Len /= _nSize
-	dHeader.Cap /= _nSize
-	return *(*[]uint64)(unsafe.Pointer(dHeader))
-}
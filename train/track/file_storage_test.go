@@ -1,10 +1,17 @@
 package track
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 
 	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/go-misc/utils"
 )
 
 var testData = []byte("0123456789ABCDEF")
@@ -37,9 +44,10 @@ func TestReadWrite(t *testing.T) {
 
 	// Size = 8 bytes
 	// Index = 8 bytes * 11
-	// Offset of first item should be 96
-	testutils.CheckUint64(96, store.index[0], t)
-	testutils.CheckUint64(96+uint64(len(testData)), store.index[1], t)
+	// Reserved = 8 bytes * 4
+	// Offset of first item should be 128
+	testutils.CheckUint64(128, store.index[0], t)
+	testutils.CheckUint64(128+uint64(len(testData)), store.index[1], t)
 
 	store.Flush()
 
@@ -77,6 +85,46 @@ func TestPersistence(t *testing.T) {
 	testutils.CheckByteSlice(testData, temp, t)
 }
 
+func TestPersistenceOfEmpty(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	store.Close()
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(0, store.Size, t)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+}
+
+func TestReadOnlyOfEmpty(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	store.Close()
+
+	store, err := OpenReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	defer store.Close()
+	testutils.CheckUint64(0, store.Size, t)
+	_, err = store.ReaderAt(0)
+	testutils.ExpectTrue(err != nil, "Expected no messages to read", t)
+}
+
+func TestSwitchToReadOnlyTwice(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	store.switchToReadOnly()
+	store.switchToReadOnly()
+	defer store.Close()
+
+	r, err := store.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	temp := make([]byte, len(testData))
+	n, err := r.Read(temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, temp[:n], t)
+}
+
 func TestFillUp(t *testing.T) {
 	cleanup()
 	store := NewFileStorage("", "id", 10)
@@ -105,6 +153,859 @@ func TestFillUp(t *testing.T) {
 	store.Close()
 }
 
+func TestGrow(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 3)
+	msgs := [][]byte{[]byte("one"), []byte("two"), []byte("three"), []byte("four"), []byte("five")}
+	for i := 0; i < 3; i++ {
+		testutils.CheckErr(store.WriteMessage(i, msgs[i]), t)
+	}
+	testutils.CheckErr(store.setBaseOffset(10), t)
+	testutils.ExpectTrue(store.IsFull(), "Expected the store to be full", t)
+	// A reader which was open before growing isn't disturbed
+	r, err := store.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+
+	testutils.ExpectTrue(store.Grow(2) != nil, "Expected shrinking to fail", t)
+	testutils.CheckErr(store.Grow(6), t)
+	testutils.CheckUint64(6, store.Capacity, t)
+	testutils.CheckUint64(3, store.Size, t)
+	testutils.ExpectTrue(!exists(fname("id.grow", "")), "Expected the temporary file to be gone", t)
+	for i := 3; i < len(msgs); i++ {
+		testutils.CheckErr(store.WriteMessage(i, msgs[i]), t)
+	}
+	testutils.CheckErr(store.Verify(), t)
+	temp := make([]byte, 3)
+	_, err = io.ReadFull(r, temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], temp, t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(6, store.Capacity, t)
+	testutils.CheckUint64(5, store.Size, t)
+	base, ok := store.recordedBaseOffset()
+	testutils.ExpectTrue(ok, "Expected the base offset to be kept", t)
+	testutils.CheckUint64(10, base, t)
+	testutils.CheckErr(store.Verify(), t)
+	for i, expected := range msgs {
+		r, err := store.ReaderAt(uint64(i))
+		testutils.CheckErr(err, t)
+		msg := make([]byte, len(expected))
+		_, err = io.ReadFull(r, msg)
+		r.Close()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(expected, msg, t)
+	}
+}
+
+// Run the FileStorage tests which don't depend on the layout, and some track tests,
+// again with the offset table in a sidecar
+func TestIndexSidecar(t *testing.T) {
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	INDEX_SIDECAR = true
+
+	suite := map[string]func(*testing.T){
+		"Init":                  TestInit,
+		"Persistence":           TestPersistence,
+		"PersistenceOfEmpty":    TestPersistenceOfEmpty,
+		"FillUp":                TestFillUp,
+		"RawRange":              TestRawRange,
+		"CreateFailureCleansUp": TestCreateFailureCleansUp,
+		"VerifyChecksum":        TestVerifyChecksum,
+		"SealedFlag":            TestSealedFlag,
+		"Grow":                  TestGrow,
+		"MergeChunks":           TestMergeChunks,
+		"MoveTo":                TestMoveTo,
+		"TrimUnderReader":       TestTrimUnderReader,
+		"OpenPrunesEmptyChunks": TestOpenPrunesEmptyChunks,
+	}
+	for name, test := range suite {
+		t.Run(name, test)
+	}
+}
+
+func TestSidecarLayout(t *testing.T) {
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	INDEX_SIDECAR = true
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, []byte("second")), t)
+	testutils.CheckErr(store.Close(), t)
+	testutils.ExpectTrue(exists(sidecarName("id", "")), "Expected a sidecar", t)
+
+	// The data file holds just the marker, the start of the data, and the messages
+	data, err := ioutil.ReadFile(fname("id", ""))
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, binary.LittleEndian.Uint64(data), t)
+	testutils.CheckUint64(_sidecarDataStart, binary.LittleEndian.Uint64(data[_nSize:]), t)
+	testutils.CheckByteSlice(append(testData, "second"...), data[_sidecarDataStart:_sidecarDataStart+len(testData)+6], t)
+
+	// Open finds the sidecar whatever INDEX_SIDECAR is set to now
+	INDEX_SIDECAR = false
+	store = Open("", "id")
+	testutils.CheckUint64(10, store.Capacity, t)
+	testutils.CheckUint64(2, store.Size, t)
+	testutils.CheckErr(store.Verify(), t)
+	testutils.CheckErr(store.WriteMessage(2, []byte("third")), t)
+	testutils.CheckErr(store.Close(), t)
+	store, err = OpenReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(3, store.Size, t)
+	size, err := store.SizeOf(2)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(5, size, t)
+
+	// Removing the storage takes the sidecar with it
+	cleanup()
+	testutils.ExpectTrue(!exists(sidecarName("id", "")), "Expected the sidecar to be removed", t)
+}
+
+func TestGrowSidecarKeepsData(t *testing.T) {
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	INDEX_SIDECAR = true
+	cleanup()
+	store := NewFileStorage("", "id", 2)
+	defer store.Close()
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, testData), t)
+	testutils.CheckErr(store.Flush(), t)
+	before, err := ioutil.ReadFile(fname("id", ""))
+	testutils.CheckErr(err, t)
+	info, err := os.Stat(fname("id", ""))
+	testutils.CheckErr(err, t)
+
+	testutils.CheckErr(store.Grow(100), t)
+	after, err := ioutil.ReadFile(fname("id", ""))
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(before, after, t)
+	grownInfo, err := os.Stat(fname("id", ""))
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(os.SameFile(info, grownInfo), "Expected the data file to be left in place", t)
+	testutils.CheckUint64(_sidecarDataStart, store.index[0], t)
+	testutils.CheckErr(store.WriteMessage(2, testData), t)
+	testutils.CheckUint64(100, store.Capacity, t)
+	testutils.CheckErr(store.Verify(), t)
+}
+
+func TestInitialSize(t *testing.T) {
+	cleanup()
+	initialSize := uint64(16 * os.Getpagesize())
+	store := NewFileStorageWithSize("", "id", 10, initialSize)
+	defer store.Close()
+	testutils.CheckUint64(initialSize, uint64(utils.Filesize(store.file)), t)
+
+	// Header is 128 bytes, so all of these fit within the preallocated space
+	var err error
+	for i := 0; i < 9; i++ {
+		err = store.WriteMessage(i, testData)
+		testutils.CheckErr(err, t)
+	}
+	testutils.CheckUint64(initialSize, uint64(utils.Filesize(store.file)), t)
+
+	// Writing past the end extends the file
+	big := make([]byte, initialSize)
+	err = store.WriteMessage(9, big)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(store.index[10], uint64(utils.Filesize(store.file)), t)
+
+	r, err := store.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	temp := make([]byte, len(testData))
+	_, err = r.Read(temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, temp, t)
+}
+
+func TestRawRange(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	var expected []byte
+	for i := 0; i < 5; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		if i >= 1 && i < 4 {
+			expected = append(expected, msg...)
+		}
+		testutils.CheckErr(store.WriteMessage(i, msg), t)
+	}
+
+	r, length, err := store.RawRange(1, 4)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(uint64(len(expected)), length, t)
+	actual, err := ioutil.ReadAll(r)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(expected, actual, t)
+
+	_, length, err = store.RawRange(2, 2)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, length, t)
+
+	_, _, err = store.RawRange(3, 1)
+	testutils.ExpectTrue(err != nil, "Expected inverted range to fail", t)
+	_, _, err = store.RawRange(0, 6)
+	testutils.ExpectTrue(err != nil, "Expected range past the end to fail", t)
+}
+
+func TestZeroCapacity(t *testing.T) {
+	cleanup()
+	store, err := CreateFileStorage("", "id", 0, 0)
+	testutils.ExpectTrue(err != nil, "Expected zero capacity to be rejected", t)
+	testutils.ExpectTrue(store == nil, "Expected no storage to be returned", t)
+	testutils.ExpectTrue(!exists(fname("id", "")), "Expected no file to be created", t)
+}
+
+func TestCreateFailureCleansUp(t *testing.T) {
+	cleanup()
+	// The header for this capacity is far too large to map
+	store, err := CreateFileStorage("", "id", 1<<45, 0)
+	testutils.ExpectTrue(err != nil, "Expected creation to fail", t)
+	testutils.ExpectTrue(store == nil, "Expected no storage to be returned", t)
+	testutils.ExpectTrue(!exists(fname("id", "")), "Expected partial file to be removed", t)
+
+	store, err = CreateFileStorage("", "id", 10, 0)
+	testutils.CheckErr(err, t)
+	store.Close()
+}
+
+func TestShortWrite(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+
+	store.out = &shortWriter{store.file}
+	err := store.WriteMessage(1, testData)
+	testutils.ExpectTrue(err != nil, "Expected short write to fail", t)
+	testutils.CheckUint64(1, store.Size, t)
+	testutils.CheckUint64(0, store.index[2], t)
+
+	_, err = store.SizeOf(1)
+	testutils.ExpectTrue(err != nil, "Expected failed message to be unreadable", t)
+}
+
+func TestWriteAfterFailedWrite(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+
+	// Half of the message reaches the file before the error
+	store.out = &failingWriter{store.file}
+	err := store.WriteMessage(1, []byte("partial message"))
+	testutils.ExpectTrue(err != nil, "Expected failed write to return an error", t)
+	err = store.WriteMessageFrom(1, bytes.NewReader(testData), int64(len(testData)))
+	testutils.ExpectTrue(err != nil, "Expected failed write to return an error", t)
+	testutils.CheckUint64(1, store.Size, t)
+
+	store.out = store.file
+	testutils.CheckErr(store.WriteMessage(1, testData), t)
+	testutils.CheckUint64(128+2*uint64(len(testData)), store.index[2], t)
+
+	r, err := store.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	temp := make([]byte, 2*len(testData))
+	_, err = io.ReadFull(r, temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(append(testData, testData...), temp, t)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 3)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessageFrom(1, bytes.NewReader(testData), int64(len(testData))), t)
+	testutils.CheckErr(store.WriteMessage(2, []byte("last")), t)
+	testutils.CheckErr(store.Verify(), t)
+	testutils.CheckErr(store.seal(), t)
+
+	// Reopening a sealed store leaves it read-only
+	store = Open("", "id")
+	testutils.ExpectTrue(store.readOnly, "Expected sealed store to be read-only", t)
+	testutils.CheckErr(store.Verify(), t)
+
+	// Flip a byte in the middle of the second message
+	f, err := os.OpenFile(fname("id", ""), os.O_RDWR, 0666)
+	testutils.CheckErr(err, t)
+	_, err = f.WriteAt([]byte{'X'}, int64(store.index[1]+3))
+	testutils.CheckErr(err, t)
+	f.Close()
+	testutils.ExpectTrue(store.Verify() != nil, "Expected corruption to be detected", t)
+}
+
+func TestCloseReportsFailure(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	store.file.Close()
+	testutils.ExpectTrue(store.Flush() != nil, "Expected syncing a broken file to fail", t)
+	testutils.ExpectTrue(store.Close() != nil, "Expected closing a broken file to fail", t)
+}
+
+func TestSealedFlag(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 2)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, testData), t)
+	testutils.CheckErr(store.Close(), t)
+
+	// Full isn't the same as sealed
+	store = Open("", "id")
+	testutils.ExpectTrue(!store.sealed && !store.readOnly, "Expected a full but unsealed store to stay open", t)
+	testutils.CheckErr(store.seal(), t)
+	testutils.ExpectTrue(store.readOnly, "Expected sealing to switch to read-only", t)
+
+	store = Open("", "id")
+	testutils.ExpectTrue(store.sealed && store.readOnly, "Expected the seal to be persisted", t)
+	store, err := OpenReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(store.sealed, "Expected the seal to be visible read-only", t)
+}
+
+func TestUnalignedFiles(t *testing.T) {
+	defer func(align bool) { PAGE_ALIGN_FILES = align }(PAGE_ALIGN_FILES)
+	PAGE_ALIGN_FILES = false
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	// Just big enough for the header
+	testutils.CheckUint64(128, uint64(utils.Filesize(store.file)), t)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, testData), t)
+	testutils.CheckUint64(128+2*uint64(len(testData)), uint64(utils.Filesize(store.file)), t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(2, store.Size, t)
+	r, err := store.ReaderAt(1)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	temp := make([]byte, len(testData))
+	_, err = io.ReadFull(r, temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, temp, t)
+}
+
+// Writes half of what it's given, then fails
+type failingWriter struct {
+	w io.Writer
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	n, _ := f.w.Write(p[:len(p)/2])
+	return n, errors.New("Injected failure")
+}
+
+// Writes only half of what it's given, without reporting an error
+type shortWriter struct {
+	w io.Writer
+}
+
+func (s *shortWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p[:len(p)/2])
+}
+
 func cleanup() {
-	os.Remove(fname("id", ""))
+	removeStorage("id", "")
+}
+
+// A header that silently loses writes to the offset table, like failing hardware would
+type lossyHeader struct {
+	headerIO
+}
+
+func (h *lossyHeader) set(slot int, value uint64) error {
+	if slot > 0 && slot < len(h.slots())-_nExtra {
+		return nil
+	}
+	return h.headerIO.set(slot, value)
+}
+
+func TestChecksOnWrite(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	store.checkWrites = true
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, []byte{}), t)
+
+	// The end of the third message is lost, so the fourth would overwrite it
+	store.header = &lossyHeader{store.header}
+	testutils.CheckErr(store.WriteMessage(2, []byte("lost")), t)
+	err := store.WriteMessage(3, []byte("rejected"))
+	testutils.ExpectTrue(err == ErrCorruptIndex, fmt.Sprintf("Expected ErrCorruptIndex, got %v", err), t)
+	testutils.CheckUint64(3, store.Size, t)
+
+	// The file moved without the offset table
+	store.header = store.header.(*lossyHeader).headerIO
+	testutils.CheckErr(store.setIndex(3, store.index[2]+4), t)
+	testutils.CheckErr(store.WriteMessage(3, []byte("kept")), t)
+	store.file.Seek(1, io.SeekCurrent)
+	err = store.WriteMessage(4, []byte("rejected"))
+	testutils.ExpectTrue(err == ErrCorruptIndex, fmt.Sprintf("Expected ErrCorruptIndex, got %v", err), t)
+	testutils.CheckUint64(4, store.Size, t)
+}
+
+func TestHeaderLargerThanPage(t *testing.T) {
+	cleanup()
+	capacity := uint64(os.Getpagesize())
+	testutils.ExpectTrue((capacity+2+_nExtra)*_nSize > uint64(os.Getpagesize()), "Expected the header to be larger than a page", t)
+	// Leave behind a short file, which creating the store must extend to hold the header
+	testutils.CheckErr(ioutil.WriteFile(fname("id", ""), []byte("leftover"), 0666), t)
+	store, err := CreateFileStorage("", "id", capacity, 0)
+	testutils.CheckErr(err, t)
+	for i := 0; i < int(capacity); i++ {
+		testutils.CheckErr(store.WriteMessage(i, []byte{byte(i)}), t)
+	}
+	testutils.ExpectTrue(store.IsFull(), "Expected the store to be full", t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(capacity, store.Size, t)
+	testutils.CheckErr(store.Verify(), t)
+	r, err := store.ReaderAt(capacity - 1)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg := make([]byte, 1)
+	_, err = r.Read(msg)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte{byte(capacity - 1)}, msg, t)
+}
+
+func TestReadInto(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	for i := 0; i < 8; i++ {
+		testutils.CheckErr(store.WriteMessage(i, bytes.Repeat(testData[:i+1], i)), t)
+	}
+	check := func() {
+		buf := make([]byte, 64)
+		for _, i := range []uint64{0, 1, 3, 7} {
+			n, err := store.ReadInto(i, buf)
+			testutils.CheckErr(err, t)
+			r, err := store.ReaderAt(i)
+			testutils.CheckErr(err, t)
+			expected := make([]byte, n)
+			_, err = io.ReadFull(r, expected)
+			testutils.CheckErr(err, t)
+			r.Close()
+			testutils.CheckByteSlice(expected, buf[:n], t)
+		}
+	}
+	check()
+	// Once the storage is read-only, it reads with a file of its own
+	testutils.CheckErr(store.seal(), t)
+	check()
+
+	_, err := store.ReadInto(7, make([]byte, 10))
+	testutils.ExpectTrue(err == ErrShortBuffer, fmt.Sprintf("Expected ErrShortBuffer, got %v", err), t)
+	_, err = store.ReadInto(8, make([]byte, 64))
+	testutils.ExpectTrue(err != nil, "Expected reading past the end to fail", t)
+}
+
+func benchmarkSingleReads(read func(*FileStorage, uint64, []byte) error, b *testing.B) {
+	cleanup()
+	store := NewFileStorage("", "id", 100)
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		utils.Check(store.WriteMessage(i, testData))
+	}
+	buf := make([]byte, len(testData))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.Check(read(store, uint64(i%100), buf))
+	}
+}
+
+func BenchmarkReadInto(b *testing.B) {
+	benchmarkSingleReads(func(store *FileStorage, i uint64, buf []byte) error {
+		_, err := store.ReadInto(i, buf)
+		return err
+	}, b)
+}
+
+func BenchmarkReaderAt(b *testing.B) {
+	benchmarkSingleReads(func(store *FileStorage, i uint64, buf []byte) error {
+		r, err := store.ReaderAt(i)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(r, buf)
+		return firstErr(err, r.Close())
+	}, b)
+}
+
+func TestSectionReaderAt(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	testutils.CheckErr(store.WriteMessage(0, []byte("first")), t)
+	testutils.CheckErr(store.WriteMessage(1, testData), t)
+	testutils.CheckErr(store.WriteMessage(2, []byte("third")), t)
+
+	r, err := store.SectionReaderAt(1)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(testData), int(r.Size()), t)
+	buf := make([]byte, 4)
+	_, err = r.ReadAt(buf, 6)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData[6:10], buf, t)
+	// Reads stop at the end of the message
+	_, err = r.Seek(-2, io.SeekEnd)
+	testutils.CheckErr(err, t)
+	rest, err := ioutil.ReadAll(r)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData[len(testData)-2:], rest, t)
+
+	_, err = store.SectionReaderAt(3)
+	testutils.ExpectTrue(err != nil, "Expected a section past the end to fail", t)
+}
+
+func TestCopyToLoadFrom(t *testing.T) {
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	msgs := [][]byte{testData, []byte("second"), []byte("third")}
+	for _, sidecar := range []bool{false, true} {
+		INDEX_SIDECAR = sidecar
+		cleanup()
+		removeStorage("copy", "")
+		store := NewFileStorage("", "id", 10)
+		for i, msg := range msgs {
+			testutils.CheckErr(store.WriteMessage(i, msg), t)
+		}
+		testutils.CheckErr(store.seal(), t)
+		var buf bytes.Buffer
+		n, err := store.CopyTo(&buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(buf.Len(), int(n), t)
+		// Just the header and the messages
+		header := (10 + 2 + _nExtra) * _nSize
+		testutils.CheckInt(header+len(testData)+len("second")+len("third"), buf.Len(), t)
+		testutils.CheckErr(store.Close(), t)
+
+		copied, err := LoadFrom("", "copy", bytes.NewReader(buf.Bytes()))
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(10, copied.Capacity, t)
+		testutils.CheckUint64(uint64(len(msgs)), copied.Size, t)
+		testutils.ExpectTrue(copied.readOnly, "Expected a sealed chunk to load read-only", t)
+		for i, msg := range msgs {
+			p := make([]byte, 16)
+			n, err := copied.ReadInto(uint64(i), p)
+			testutils.CheckErr(err, t)
+			testutils.CheckByteSlice(msg, p[:n], t)
+		}
+		testutils.CheckErr(copied.Close(), t)
+		_, err = LoadFrom("", "copy", bytes.NewReader(buf.Bytes()))
+		testutils.ExpectTrue(err != nil, "Expected loading over existing storage to fail", t)
+
+		// Damaged messages are caught
+		removeStorage("copy", "")
+		data := buf.Bytes()
+		data[len(data)-1] ^= 0xff
+		_, err = LoadFrom("", "copy", bytes.NewReader(data))
+		testutils.ExpectTrue(err != nil, "Expected a damaged chunk to fail to load", t)
+		testutils.ExpectTrue(!exists(fname("copy", "")), "Expected the damaged chunk to be removed", t)
+	}
+}
+
+func TestReverseReaderFrom(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	for i := 0; i < 8; i++ {
+		testutils.CheckErr(store.WriteMessage(i, []byte(fmt.Sprintf("message %d", i))), t)
+	}
+	forward := make([][]byte, 0)
+	r, err := store.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	for i := uint64(0); i < store.Size; i++ {
+		size, err := store.SizeOf(i)
+		testutils.CheckErr(err, t)
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		testutils.CheckErr(err, t)
+		forward = append(forward, msg)
+	}
+	r.Close()
+
+	it, err := store.ReverseReaderFrom(store.Size - 1)
+	testutils.CheckErr(err, t)
+	defer it.Close()
+	n := len(forward)
+	for it.Next() {
+		n--
+		testutils.CheckByteSlice(forward[n], it.Message(), t)
+	}
+	testutils.CheckErr(it.Err(), t)
+	testutils.CheckInt(0, n, t)
+
+	// Part way through
+	it, err = store.ReverseReaderFrom(2)
+	testutils.CheckErr(err, t)
+	count := 0
+	for it.Next() {
+		count++
+	}
+	testutils.CheckInt(3, count, t)
+	_, err = store.ReverseReaderFrom(store.Size)
+	testutils.ExpectTrue(err != nil, "Expected an unwritten index to fail", t)
+}
+
+func TestMessages(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+		if i == 4 {
+			msgs[i] = []byte{} // Empty messages come back too
+		}
+		testutils.CheckErr(store.WriteMessage(i, msgs[i]), t)
+	}
+	testutils.ExpectTrue(store.IsFull(), "Expected a full chunk", t)
+
+	it := store.Messages()
+	n := 0
+	for it.Next() {
+		testutils.CheckByteSlice(msgs[n], it.Message(), t)
+		n++
+	}
+	testutils.CheckErr(it.Err(), t)
+	testutils.CheckErr(it.Close(), t)
+	testutils.CheckInt(len(msgs), n, t)
+
+	cleanup()
+	empty := NewFileStorage("", "empty", 10)
+	defer empty.Close()
+	it = empty.Messages()
+	testutils.ExpectTrue(!it.Next(), "Expected no messages in empty storage", t)
+	testutils.CheckErr(it.Err(), t)
+	testutils.CheckErr(it.Close(), t)
+}
+
+// Scan a whole chunk with Messages, or with a ReaderAt per message
+func benchmarkScan(scan func(*FileStorage) error, b *testing.B) {
+	cleanup()
+	store := NewFileStorage("", "id", 1000)
+	defer store.Close()
+	for i := 0; i < 1000; i++ {
+		utils.Check(store.WriteMessage(i, testData))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.Check(scan(store))
+	}
+}
+
+func BenchmarkScanMessages(b *testing.B) {
+	benchmarkScan(func(store *FileStorage) error {
+		it := store.Messages()
+		for it.Next() {
+		}
+		return firstErr(it.Err(), it.Close())
+	}, b)
+}
+
+func BenchmarkScanReaderAt(b *testing.B) {
+	benchmarkScan(func(store *FileStorage) error {
+		buf := make([]byte, len(testData))
+		for i := uint64(0); i < store.Size; i++ {
+			r, err := store.ReaderAt(i)
+			if err != nil {
+				return err
+			}
+			_, err = io.ReadFull(r, buf)
+			if err = firstErr(err, r.Close()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, b)
+}
+
+func TestLocate(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	defer store.Close()
+	msgs := [][]byte{[]byte("zero"), {}, testData, []byte("three")}
+	testutils.CheckErr(store.WriteMessages(0, msgs), t)
+	testutils.CheckErr(store.Flush(), t)
+	data, err := ioutil.ReadFile(fname("id", ""))
+	testutils.CheckErr(err, t)
+	for i, msg := range msgs {
+		offset, length, err := store.Locate(uint64(i))
+		testutils.CheckErr(err, t)
+		size, err := store.SizeOf(uint64(i))
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(store.index[i], offset, t)
+		testutils.CheckUint64(size, length, t)
+		testutils.CheckByteSlice(msg, data[offset:offset+length], t)
+	}
+	_, _, err = store.Locate(uint64(len(msgs)))
+	testutils.ExpectTrue(err != nil, "Expected an unwritten index to fail", t)
+}
+
+func TestOpenTruncatedHeader(t *testing.T) {
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	for _, sidecar := range []bool{false, true} {
+		INDEX_SIDECAR = sidecar
+		// Cut the header file short, either part way through the offset table or
+		// before the capacity and first offset
+		for _, size := range []int64{100, 10} {
+			cleanup()
+			store := NewFileStorage("", "id", 100)
+			testutils.CheckErr(store.WriteMessage(0, testData), t)
+			testutils.CheckErr(store.Close(), t)
+			name := fname("id", "")
+			if sidecar {
+				name = sidecarName("id", "")
+			}
+			testutils.CheckErr(os.Truncate(name, size), t)
+
+			_, err := OpenFileStorage("", "id")
+			testutils.ExpectTrue(err == ErrTruncatedHeader, fmt.Sprintf("Expected ErrTruncatedHeader, got %v", err), t)
+			_, err = OpenReadOnly("", "id")
+			testutils.ExpectTrue(err == ErrTruncatedHeader, fmt.Sprintf("Expected ErrTruncatedHeader read-only, got %v", err), t)
+		}
+	}
+	cleanup()
+}
+
+func TestWriteMessages(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.WriteMessage(0, []byte("first")), t)
+	testutils.CheckErr(store.WriteMessages(1, [][]byte{testData, nil, []byte("fourth")}), t)
+	testutils.CheckUint64(4, store.Size, t)
+	// A batch which doesn't fit is refused whole
+	err := store.WriteMessages(4, make([][]byte, 7))
+	testutils.ExpectTrue(err != nil, "A batch past the capacity should be refused", t)
+	testutils.CheckUint64(4, store.Size, t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckErr(store.Verify(), t)
+	for i, want := range []string{"first", string(testData), "", "fourth"} {
+		size, err := store.SizeOf(uint64(i))
+		testutils.CheckErr(err, t)
+		buf := make([]byte, size)
+		_, err = store.ReadInto(uint64(i), buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckString(want, string(buf), t)
+	}
+}
+
+func benchmarkWrites(write func(store *FileStorage, index int, msgs [][]byte) error, b *testing.B) {
+	cleanup()
+	store := NewFileStorage("", "id", 1000)
+	defer store.Close()
+	msgs := make([][]byte, 100)
+	for i := range msgs {
+		msgs[i] = []byte("Hello World")
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if store.Size == store.Capacity {
+			b.StopTimer()
+			utils.Check(store.truncate(0))
+			b.StartTimer()
+		}
+		utils.Check(write(store, int(store.Size), msgs))
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	benchmarkWrites(func(store *FileStorage, index int, msgs [][]byte) error {
+		for i, msg := range msgs {
+			if err := store.WriteMessage(index+i, msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, b)
+}
+
+func BenchmarkWriteMessages(b *testing.B) {
+	benchmarkWrites(func(store *FileStorage, index int, msgs [][]byte) error {
+		return store.WriteMessages(index, msgs)
+	}, b)
+}
+
+func TestReset(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.setBaseOffset(20), t)
+	old := [][]byte{[]byte("zero"), []byte("one"), testData}
+	testutils.CheckErr(store.WriteMessages(0, old), t)
+	length := utils.Filesize(store.file)
+	testutils.CheckErr(store.Reset(), t)
+	testutils.CheckUint64(0, store.Size, t)
+	testutils.CheckUint64(10, store.Capacity, t)
+	testutils.CheckUint64(0, store.baseOffset, t)
+	testutils.CheckInt(int(length), int(utils.Filesize(store.file)), t)
+
+	msgs := [][]byte{[]byte("new"), []byte("messages")}
+	testutils.CheckErr(store.WriteMessages(0, msgs), t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(2, store.Size, t)
+	_, recorded := store.recordedBaseOffset()
+	testutils.ExpectTrue(!recorded, "Expected the base offset to be forgotten", t)
+	testutils.CheckErr(store.Verify(), t)
+	buf := make([]byte, 64)
+	for i, msg := range msgs {
+		n, err := store.ReadInto(uint64(i), buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msg, buf[:n], t)
+	}
+	_, err := store.ReadInto(2, buf)
+	testutils.ExpectTrue(err != nil, "Expected the old messages to be gone", t)
+	readOnly, err := OpenReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	defer readOnly.Close()
+	testutils.ExpectTrue(readOnly.Reset() == ErrReadOnly, "Expected read-only storage not to reset", t)
+}
+
+func TestTruncateTo(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	msgs := [][]byte{[]byte("zero"), []byte("one"), testData, []byte("three"), []byte("four")}
+	testutils.CheckErr(store.WriteMessages(0, msgs), t)
+	testutils.ExpectTrue(store.TruncateTo(6) != nil, "Truncating can't grow the storage", t)
+	testutils.CheckErr(store.TruncateTo(3), t)
+	testutils.CheckUint64(3, store.Size, t)
+	testutils.CheckUint64(store.index[3], uint64(utils.Filesize(store.file)), t)
+	testutils.CheckErr(store.TruncateTo(3), t)
+	testutils.CheckErr(store.Close(), t)
+
+	store = Open("", "id")
+	defer store.Close()
+	testutils.CheckUint64(3, store.Size, t)
+	testutils.CheckErr(store.Verify(), t)
+	buf := make([]byte, 64)
+	for i, msg := range msgs[:3] {
+		n, err := store.ReadInto(uint64(i), buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msg, buf[:n], t)
+	}
+	for i := uint64(3); i < 5; i++ {
+		_, err := store.ReadInto(i, buf)
+		testutils.ExpectTrue(err != nil, fmt.Sprintf("Expected message %d to be gone", i), t)
+	}
+	// The next write takes the place of the first message dropped
+	testutils.CheckErr(store.WriteMessage(3, []byte("new")), t)
+	n, err := store.ReadInto(3, buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckString("new", string(buf[:n]), t)
+	testutils.CheckErr(store.Verify(), t)
 }
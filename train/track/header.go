@@ -0,0 +1,150 @@
+package track
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// The header of a FileStorage is an array of uint64 slots: the capacity, the offset table,
+// and the reserved slots. Slots are always stored little endian. The header can be accessed
+// either through a memory map, or with plain positional reads and writes for environments
+// where mmap is unavailable or unreliable. Both backends use the same layout, so files
+// written with one can be opened with the other.
+type HeaderBackend int
+
+const (
+	HEADER_MMAP HeaderBackend = iota
+	HEADER_PREAD
+)
+
+// The backend used for every FileStorage created or opened from now on
+var HEADER_BACKEND = HEADER_MMAP
+
+type headerIO interface {
+	// All of the slots in the header. Callers must not modify them directly
+	slots() []uint64
+	// Update a slot, persisting it to the file
+	set(slot int, value uint64) error
+	// Flush any pending header changes to disk
+	flush() error
+	// Release the header. It must not be used afterwards
+	release() error
+}
+
+// Both backends keep a decoded copy of the header in memory, so refuse to load
+// anything unreasonably large. This allows over 100 million messages per chunk
+const maxHeaderSize = 1 << 30
+
+// Access the first size bytes of the file as a header
+func newHeader(file *os.File, size uint64, prot int) (headerIO, error) {
+	if size > maxHeaderSize {
+		return nil, fmt.Errorf("Header of %d bytes is too large to hold in memory", size)
+	}
+	var h headerIO
+	var err error
+	if HEADER_BACKEND == HEADER_PREAD {
+		h, err = readHeader(file, size)
+	} else {
+		h, err = mapHeader(file, size, prot)
+	}
+	if err != nil {
+		return nil, err // Don't hand back a typed nil
+	}
+	return h, nil
+}
+
+// A header which lives in a memory mapped region of the file
+type mmapHeader struct {
+	memory mmap.MMap
+	header []uint64
+}
+
+func mapHeader(file *os.File, size uint64, prot int) (*mmapHeader, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	memory, err := mmap.MapRegion(file, int(size), prot, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Touching the map past the end of the file would fault
+	valid := []byte(memory)
+	if uint64(info.Size()) < size {
+		valid = valid[:info.Size()]
+	}
+	return &mmapHeader{memory, decodeSlots(valid, size)}, nil
+}
+
+func (h *mmapHeader) slots() []uint64 {
+	return h.header
+}
+
+func (h *mmapHeader) set(slot int, value uint64) error {
+	binary.LittleEndian.PutUint64(h.memory[slot*_nSize:], value)
+	h.header[slot] = value
+	return nil
+}
+
+func (h *mmapHeader) flush() error {
+	return h.memory.Flush()
+}
+
+func (h *mmapHeader) release() error {
+	return h.memory.Unmap()
+}
+
+// A header which is read into memory once, and written through with pwrite
+type preadHeader struct {
+	file   *os.File
+	header []uint64
+}
+
+func readHeader(file *os.File, size uint64) (*preadHeader, error) {
+	data := make([]byte, size)
+	n, err := file.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &preadHeader{file, decodeSlots(data[:n], size)}, nil
+}
+
+func (h *preadHeader) slots() []uint64 {
+	return h.header
+}
+
+func (h *preadHeader) set(slot int, value uint64) error {
+	var data [_nSize]byte
+	binary.LittleEndian.PutUint64(data[:], value)
+	_, err := h.file.WriteAt(data[:], int64(slot*_nSize))
+	if err != nil {
+		return err
+	}
+	h.header[slot] = value
+	return nil
+}
+
+func (h *preadHeader) flush() error {
+	return nil // Writes go straight to the file, which the owner syncs
+}
+
+func (h *preadHeader) release() error {
+	return nil
+}
+
+// Decode a header of the given size from data. Slots past the end of data
+// haven't been written yet, and are zero
+func decodeSlots(data []byte, size uint64) []uint64 {
+	header := make([]uint64, size/_nSize)
+	for i := range header {
+		if (i+1)*_nSize > len(data) {
+			break
+		}
+		header[i] = binary.LittleEndian.Uint64(data[i*_nSize:])
+	}
+	return header
+}
@@ -0,0 +1,127 @@
+package track
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+// Run the FileStorage tests again with the pread header backend
+func TestPreadHeaderBackend(t *testing.T) {
+	defer func(b HeaderBackend) { HEADER_BACKEND = b }(HEADER_BACKEND)
+	HEADER_BACKEND = HEADER_PREAD
+
+	suite := map[string]func(*testing.T){
+		"Init":                  TestInit,
+		"ReadWrite":             TestReadWrite,
+		"Persistence":           TestPersistence,
+		"PersistenceOfEmpty":    TestPersistenceOfEmpty,
+		"FillUp":                TestFillUp,
+		"InitialSize":           TestInitialSize,
+		"RawRange":              TestRawRange,
+		"ZeroCapacity":          TestZeroCapacity,
+		"CreateFailureCleansUp": TestCreateFailureCleansUp,
+		"ShortWrite":            TestShortWrite,
+		"WriteAfterFailedWrite": TestWriteAfterFailedWrite,
+		"VerifyChecksum":        TestVerifyChecksum,
+		"HeaderBackendsMatch":   TestHeaderBackendsMatch,
+		"CloseReportsFailure":   TestCloseReportsFailure,
+		"HeaderMatchesFile":     TestHeaderMatchesFile,
+		"UnalignedFiles":        TestUnalignedFiles,
+		"SealedFlag":            TestSealedFlag,
+		"Grow":                  TestGrow,
+		"SidecarLayout":         TestSidecarLayout,
+		"GrowSidecarKeepsData":  TestGrowSidecarKeepsData,
+		"HeaderLargerThanPage":  TestHeaderLargerThanPage,
+		"ReadInto":              TestReadInto,
+		"SectionReaderAt":       TestSectionReaderAt,
+		"CopyToLoadFrom":        TestCopyToLoadFrom,
+		"ReverseReaderFrom":     TestReverseReaderFrom,
+		"WriteMessages":         TestWriteMessages,
+		"TruncateTo":            TestTruncateTo,
+		"Messages":              TestMessages,
+		"Locate":                TestLocate,
+		"OpenTruncatedHeader":   TestOpenTruncatedHeader,
+		"Reset":                 TestReset,
+	}
+	for name, test := range suite {
+		t.Run(name, test)
+	}
+}
+
+// Files written with one backend must be readable with the other
+func TestHeaderBackendsMatch(t *testing.T) {
+	defer func(b HeaderBackend) { HEADER_BACKEND = b }(HEADER_BACKEND)
+	for _, backends := range [][2]HeaderBackend{{HEADER_MMAP, HEADER_PREAD}, {HEADER_PREAD, HEADER_MMAP}} {
+		cleanup()
+		HEADER_BACKEND = backends[0]
+		store := NewFileStorage("", "id", 10)
+		testutils.CheckErr(store.WriteMessage(0, testData), t)
+		testutils.CheckErr(store.WriteMessage(1, []byte("second")), t)
+		store.Close()
+
+		HEADER_BACKEND = backends[1]
+		store = Open("", "id")
+		testutils.CheckUint64(10, store.Capacity, t)
+		testutils.CheckUint64(2, store.Size, t)
+		testutils.CheckErr(store.Verify(), t)
+		testutils.CheckErr(store.WriteMessage(2, []byte("third")), t)
+		store.Close()
+
+		HEADER_BACKEND = backends[0]
+		store = Open("", "id")
+		testutils.CheckUint64(3, store.Size, t)
+		testutils.CheckErr(store.Verify(), t)
+		size, err := store.SizeOf(2)
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(5, size, t)
+		store.Close()
+	}
+}
+
+// The decoded header must match the raw little endian slots in the file
+func TestHeaderMatchesFile(t *testing.T) {
+	cleanup()
+	store := NewFileStorage("", "id", 10)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	testutils.CheckErr(store.WriteMessage(1, []byte("second")), t)
+	slots := append([]uint64(nil), store.header.slots()...)
+	testutils.CheckErr(store.Close(), t)
+
+	data, err := ioutil.ReadFile(fname("id", ""))
+	testutils.CheckErr(err, t)
+	for i, slot := range slots {
+		testutils.CheckUint64(binary.LittleEndian.Uint64(data[i*_nSize:]), slot, t)
+	}
+	testutils.CheckUint64(10, slots[0], t)
+	testutils.CheckUint64(128, slots[1], t)
+	testutils.CheckUint64(128+uint64(len(testData)), slots[2], t)
+
+	store = Open("", "id")
+	defer store.Close()
+	for i, slot := range store.header.slots() {
+		testutils.CheckUint64(slots[i], slot, t)
+	}
+}
+
+func benchmarkHeaderSet(backend HeaderBackend, b *testing.B) {
+	defer func(b HeaderBackend) { HEADER_BACKEND = b }(HEADER_BACKEND)
+	HEADER_BACKEND = backend
+	cleanup()
+	store := NewFileStorage("", "id", 1000)
+	defer store.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.setIndex(i%1000, uint64(i))
+	}
+}
+
+func BenchmarkMmapHeaderSet(b *testing.B) {
+	benchmarkHeaderSet(HEADER_MMAP, b)
+}
+
+func BenchmarkPreadHeaderSet(b *testing.B) {
+	benchmarkHeaderSet(HEADER_PREAD, b)
+}
@@ -0,0 +1,243 @@
+package track
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// KEY INDEX -- Maps the key of each keyed message to the offset of its latest write, so
+// that Get doesn't have to scan the track. The index is kept in memory by the writer, and
+// saved next to the chunks when the track is closed, along with the offset it covers up to.
+// Opening the track loads it and replays anything written after that offset, such as the
+// messages written before a crash. If the file can't be trusted, because it's corrupt or
+// covers more messages than the track holds, the whole track is replayed instead.
+// Index file layout, little endian:
+//   [covered offset][for each key: len(key) as a uvarint, key, offset][CRC-32 of everything before]
+
+type keyIndex struct {
+	offsets map[string]uint64
+	covered uint64 // Every message before this offset has been indexed
+	mutex   *sync.RWMutex
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		offsets: make(map[string]uint64),
+		mutex:   &sync.RWMutex{},
+	}
+}
+
+func keyIndexName(root, id string) string {
+	return fname(id+".index", root)
+}
+
+// Record the keyed message at offset. Messages which aren't keyed are skipped
+func (k *keyIndex) add(offset uint64, data []byte) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.covered = offset + 1
+	m, err := ParseMessage(data)
+	if err != nil {
+		return
+	}
+	if m.Tombstone {
+		delete(k.offsets, string(m.Key))
+	} else {
+		k.offsets[string(m.Key)] = offset
+	}
+}
+
+// Drop the key from the index if its latest write is still the one at offset
+func (k *keyIndex) forget(key []byte, offset uint64) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if latest, ok := k.offsets[string(key)]; ok && latest == offset {
+		delete(k.offsets, string(key))
+	}
+}
+
+func (k *keyIndex) lookup(key []byte) (uint64, bool) {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	offset, ok := k.offsets[string(key)]
+	return offset, ok
+}
+
+func (k *keyIndex) save(name string) error {
+	k.mutex.RLock()
+	var buf bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	binary.Write(&buf, binary.LittleEndian, k.covered)
+	for key, offset := range k.offsets {
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(key)))])
+		buf.WriteString(key)
+		binary.Write(&buf, binary.LittleEndian, offset)
+	}
+	k.mutex.RUnlock()
+	binary.Write(&buf, binary.LittleEndian, crc32.Update(0, crcTable, buf.Bytes()))
+	return replaceFile(name, buf.Bytes())
+}
+
+var errCorruptKeyIndex = errors.New("Key index is corrupt")
+
+// Load a saved index. Returns an empty index if there's no file
+func loadKeyIndex(name string) (*keyIndex, error) {
+	k := newKeyIndex()
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 {
+		return nil, errCorruptKeyIndex
+	}
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(body):]) != crc32.Update(0, crcTable, body) {
+		return nil, errCorruptKeyIndex
+	}
+	k.covered = binary.LittleEndian.Uint64(body)
+	r := bytes.NewReader(body[8:])
+	for r.Len() > 0 {
+		keyLen, err := binary.ReadUvarint(r)
+		if err != nil || keyLen > uint64(r.Len()) {
+			return nil, errCorruptKeyIndex
+		}
+		key := make([]byte, keyLen)
+		r.Read(key)
+		var offset uint64
+		err = binary.Read(r, binary.LittleEndian, &offset)
+		if err != nil || offset >= k.covered {
+			return nil, errCorruptKeyIndex
+		}
+		k.offsets[string(key)] = offset
+	}
+	return k, nil
+}
+
+// Load the track's saved key index, and bring it up to date by replaying the messages
+// written since it was saved. Must be called before the writer starts
+func (t *Track) openKeyIndex() error {
+	k, err := loadKeyIndex(keyIndexName(t.RootPath, t.Id))
+	if err == errCorruptKeyIndex || (err == nil && k.covered > t.LatestOffset()) {
+		k, err = newKeyIndex(), nil // Start again from scratch
+	}
+	if err != nil {
+		return err
+	}
+	// Nothing else is using the stores yet, so we can read them directly, skipping any gaps
+	for _, store := range t.stores {
+		var from uint64
+		if k.covered > store.baseOffset {
+			from = k.covered - store.baseOffset
+		}
+		if from >= store.Size {
+			continue
+		}
+		err = replayKeys(k, store, from)
+		if err != nil {
+			return err
+		}
+	}
+	t.keys = k
+	return nil
+}
+
+// Index the track's messages again from scratch, once some have been dropped from the end
+// of the track by TruncateTo. Must only be called by the writer, with mergeMutex held
+func (t *Track) rebuildKeyIndex() error {
+	t.dataCond.L.Lock()
+	stores := append([]*FileStorage(nil), t.stores...)
+	t.dataCond.L.Unlock()
+	k := newKeyIndex()
+	for _, store := range stores {
+		if store.Size == 0 {
+			continue
+		}
+		err := replayKeys(k, store, 0)
+		if err != nil {
+			return err
+		}
+	}
+	k.covered = t.LatestOffset()
+	t.keys.mutex.Lock()
+	t.keys.offsets, t.keys.covered = k.offsets, k.covered
+	t.keys.mutex.Unlock()
+	return nil
+}
+
+// Add the messages in the store from the given index onwards to the key index
+func replayKeys(k *keyIndex, store *FileStorage, from uint64) error {
+	r, _, err := store.RawRange(from, store.Size)
+	if err != nil {
+		return err
+	}
+	defer r.(io.Closer).Close()
+	for i := from; i < store.Size; i++ {
+		size, err := store.SizeOf(i)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return err
+		}
+		k.add(store.baseOffset+i, data)
+	}
+	return nil
+}
+
+// Add the message just written at the given index in the store to the key index
+func (t *Track) indexKey(store *FileStorage, index uint64, data []byte) {
+	if data == nil {
+		// Copied from a reader, so we have to read it back
+		r, size, err := store.RawRange(index, index+1)
+		if err != nil {
+			return
+		}
+		defer r.(io.Closer).Close()
+		data = make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return
+		}
+	}
+	t.keys.add(store.baseOffset+index, data)
+}
+
+// Get returns the latest message written with the given key, and whether there is one.
+// Keys which have been deleted with a tombstone aren't found. The track must have been
+// created or opened with IndexKeys set. If the key's latest message has been trimmed
+// from the track, Get returns ErrOffsetTrimmed
+func (t *Track) Get(key []byte) (Message, bool, error) {
+	if t.keys == nil {
+		return Message{}, false, errors.New("Track isn't indexing keys, set IndexKeys in its config")
+	}
+	offset, ok := t.keys.lookup(key)
+	if !ok {
+		return Message{}, false, nil
+	}
+	r, err := t.ReaderAt(offset)
+	if err != nil {
+		return Message{}, false, err
+	}
+	defer r.Close()
+	data, err := r.Next()
+	if err != nil {
+		return Message{}, false, err
+	} else if len(data) == 0 {
+		return Message{}, false, nil // Expired, and compacted away since we looked it up
+	}
+	m, err := ParseMessage(data)
+	if err != nil {
+		return Message{}, false, err
+	}
+	return m, true, nil
+}
@@ -0,0 +1,99 @@
+package track
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func indexedConfig() TrackConfig {
+	config := DefaultTrackConfig()
+	config.IndexKeys = true
+	return config
+}
+
+func checkGet(track *Track, key, expected string, t *testing.T) {
+	m, ok, err := track.Get([]byte(key))
+	testutils.CheckErr(err, t)
+	if expected == "" {
+		testutils.ExpectTrue(!ok, "Expected "+key+" not to be found", t)
+		return
+	}
+	testutils.ExpectTrue(ok, "Expected "+key+" to be found", t)
+	testutils.CheckString(expected, string(m.Value), t)
+}
+
+func TestKeyIndex(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 3
+
+	track, err := NewTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("a"), []byte("1"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("b"), []byte("2"))), t)
+	testutils.CheckErr(track.WriteMessage([]byte{}), t) // Not keyed
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("a"), []byte("3"))), t)
+	testutils.CheckErr(track.WriteKeyed(Tombstone([]byte("b"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("c"), []byte("4"))), t)
+	testutils.CheckErr(track.Sync(), t)
+
+	checkGet(track, "a", "3", t)
+	checkGet(track, "b", "", t)
+	checkGet(track, "c", "4", t)
+	checkGet(track, "d", "", t)
+	testutils.CheckErr(track.Close(), t)
+
+	// The saved index is used when reopening
+	track, err = OpenTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(6, track.keys.covered, t)
+	checkGet(track, "a", "3", t)
+	checkGet(track, "c", "4", t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Tracks which aren't indexed can't be searched
+	track = OpenTrack("", "id")
+	_, _, err = track.Get([]byte("a"))
+	testutils.ExpectTrue(err != nil, "Expected Get to need an index", t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestKeyIndexRebuiltAfterCrash(t *testing.T) {
+	cleanupTrack()
+	track, err := NewTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("a"), []byte("1"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("b"), []byte("2"))), t)
+	testutils.CheckErr(track.Close(), t)
+	stale, err := ioutil.ReadFile(keyIndexName("", "id"))
+	testutils.CheckErr(err, t)
+
+	track, err = OpenTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("a"), []byte("3"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("c"), []byte("4"))), t)
+	testutils.CheckErr(track.Close(), t)
+
+	// A crash would have left the index as it was when the track was last closed
+	testutils.CheckErr(ioutil.WriteFile(keyIndexName("", "id"), stale, 0644), t)
+	track, err = OpenTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	checkGet(track, "a", "3", t)
+	checkGet(track, "b", "2", t)
+	checkGet(track, "c", "4", t)
+	testutils.CheckErr(track.Close(), t)
+
+	// An index which can't be trusted is rebuilt from the whole track
+	stale[0] = 0xff
+	testutils.CheckErr(ioutil.WriteFile(keyIndexName("", "id"), stale, 0644), t)
+	track, err = OpenTrackWithConfig("", "id", indexedConfig())
+	testutils.CheckErr(err, t)
+	checkGet(track, "a", "3", t)
+	checkGet(track, "b", "2", t)
+	checkGet(track, "c", "4", t)
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
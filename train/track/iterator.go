@@ -0,0 +1,78 @@
+package track
+
+import (
+	"io"
+)
+
+// A MessageIterator walks a sequence of messages. Next advances to the next message and
+// returns false once there are no more, or there's been an error, which Err returns
+type MessageIterator interface {
+	Next() bool
+	Message() []byte
+	Err() error
+	Close() error
+}
+
+// An Iterator walks the messages in a track, keeping track of the offset of each one.
+// Consumers can record the offset of the last message they processed, and later resume
+// with IteratorAt(offset + 1) without seeing any message twice.
+//
+//	it, _ := track.IteratorAt(0)
+//	for it.Next() {
+//		process(it.Offset(), it.Message())
+//	}
+//	err := it.Err()
+type Iterator struct {
+	reader  *StorageReader
+	offset  uint64
+	message []byte
+	err     error
+}
+
+// Create an iterator whose first message will be the one at the given offset
+func (t *Track) IteratorAt(offset uint64) (*Iterator, error) {
+	r, err := t.ReaderAt(offset)
+	if err != nil {
+		return nil, err
+	}
+	return &Iterator{reader: r}, nil
+}
+
+// Next advances to the next message, blocking until one is available. Returns
+// false once a finished track has no more messages, or if there was an error
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	offset := it.reader.Offset
+	msg, err := it.reader.Next()
+	if err != nil {
+		it.message = nil
+		if err != io.EOF {
+			it.err = err
+		}
+		return false
+	}
+	it.offset = offset
+	it.message = msg
+	return true
+}
+
+// Offset of the current message
+func (it *Iterator) Offset() uint64 {
+	return it.offset
+}
+
+// The current message
+func (it *Iterator) Message() []byte {
+	return it.message
+}
+
+// Err returns the error which stopped the iterator, or nil if it simply ran out of messages
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() error {
+	return it.reader.Close()
+}
@@ -0,0 +1,45 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestIteratorResume(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	track.Close()
+	track.WaitForShutdown()
+
+	it, err := track.IteratorAt(0)
+	testutils.CheckErr(err, t)
+	var lastProcessed uint64
+	for i := 0; i < 4 && it.Next(); i++ {
+		testutils.CheckUint64(uint64(i), it.Offset(), t)
+		testutils.CheckByteSlice(msgs[i], it.Message(), t)
+		lastProcessed = it.Offset()
+	}
+	it.Close()
+	testutils.CheckUint64(3, lastProcessed, t)
+
+	// Resume after the last processed message
+	it, err = track.IteratorAt(lastProcessed + 1)
+	testutils.CheckErr(err, t)
+	defer it.Close()
+	seen := 0
+	for it.Next() {
+		testutils.ExpectTrue(it.Offset() > lastProcessed, "Expected no message to be reprocessed", t)
+		testutils.CheckByteSlice(msgs[it.Offset()], it.Message(), t)
+		seen++
+	}
+	testutils.CheckErr(it.Err(), t)
+	testutils.CheckInt(6, seen, t)
+}
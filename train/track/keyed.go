@@ -0,0 +1,128 @@
+package track
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Keyed messages let a track be used as a changelog for a key/value store.
+// Each keyed message is wrapped in a small envelope:
+// Byte Range: Contents
+//          0: flags      // FLAG_TOMBSTONE marks the key as deleted
+//        1-n: len(key)   // uvarint
+//     n+1...: key, followed by the value, which fills the rest of the message
+//
+// Compact rewrites such a track keeping only the latest value for each key.
+
+const FLAG_TOMBSTONE byte = 1 << 0
+
+type Message struct {
+	Key       []byte
+	Value     []byte
+	Tombstone bool
+}
+
+// Create a message setting key to value
+func KeyedMessage(key, value []byte) Message {
+	return Message{Key: key, Value: value}
+}
+
+// Create a message marking key as deleted
+func Tombstone(key []byte) Message {
+	return Message{Key: key, Tombstone: true}
+}
+
+// Encode the message and its envelope for writing to a track
+func (m Message) Bytes() []byte {
+	var flags byte
+	if m.Tombstone {
+		flags |= FLAG_TOMBSTONE
+	}
+	data := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(m.Key)+len(m.Value))
+	data[0] = flags
+	n := binary.PutUvarint(data[1:], uint64(len(m.Key)))
+	data = data[:1+n]
+	data = append(data, m.Key...)
+	return append(data, m.Value...)
+}
+
+// Decode a message previously encoded with Bytes
+func ParseMessage(data []byte) (Message, error) {
+	if len(data) == 0 {
+		return Message{}, errors.New("Keyed message is missing its envelope")
+	}
+	keyLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || keyLen > uint64(len(data)-1-n) {
+		return Message{}, errors.New("Keyed message has a corrupt key length")
+	}
+	keyStart := 1 + n
+	keyEnd := keyStart + int(keyLen)
+	return Message{
+		Key:       data[keyStart:keyEnd],
+		Value:     data[keyEnd:],
+		Tombstone: data[0]&FLAG_TOMBSTONE != 0,
+	}, nil
+}
+
+// Write the given keyed message to the track
+func (t *Track) WriteKeyed(m Message) error {
+	return t.WriteMessage(m.Bytes())
+}
+
+// ReadMessage reads and decodes the next keyed message. Like Read, it blocks until
+// a message is available. Empty messages, which are left behind by compaction, are skipped
+func (sr *StorageReader) ReadMessage() (Message, error) {
+	for {
+		data, err := sr.Next()
+		if err != nil {
+			return Message{}, err
+		} else if len(data) > 0 {
+			return ParseMessage(data)
+		}
+	}
+}
+
+// Compact writes a new track with the given root and id containing the latest value
+// for each key in src. Keys whose latest message is a tombstone are removed entirely.
+// The surviving messages keep the relative order of their last write.
+// src must be closed or read-only, since compaction reads it until EOF
+func Compact(src *Track, root, id string) error {
+	if !src.finished() {
+		return errors.New("Cannot compact a track which is still being written")
+	}
+	r, err := src.ReaderAt(src.EarliestOffset())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	latest := make(map[string]uint64)
+	messages := make([]Message, 0)
+	for {
+		m, err := r.ReadMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		latest[string(m.Key)] = uint64(len(messages))
+		messages = append(messages, m)
+	}
+
+	dst, err := NewTrackWithConfig(root, id, DefaultTrackConfig())
+	if err != nil {
+		return err
+	}
+	for i, m := range messages {
+		if latest[string(m.Key)] != uint64(i) || m.Tombstone {
+			continue
+		}
+		err = dst.WriteKeyed(m)
+		if err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	return dst.Close()
+}
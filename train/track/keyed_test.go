@@ -0,0 +1,87 @@
+package track
+
+import (
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestParseMessage(t *testing.T) {
+	m, err := ParseMessage(KeyedMessage([]byte("key"), testData).Bytes())
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("key"), m.Key, t)
+	testutils.CheckByteSlice(testData, m.Value, t)
+	testutils.ExpectTrue(!m.Tombstone, "Expected a live message", t)
+
+	m, err = ParseMessage(Tombstone([]byte("key")).Bytes())
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("key"), m.Key, t)
+	testutils.CheckInt(0, len(m.Value), t)
+	testutils.ExpectTrue(m.Tombstone, "Expected a tombstone", t)
+
+	_, err = ParseMessage([]byte{0, 100})
+	testutils.ExpectTrue(err != nil, "Expected corrupt key length to be rejected", t)
+}
+
+func TestCompactTombstone(t *testing.T) {
+	cleanupTrack()
+	cleanupTrackId("compacted")
+	track := NewTrack("", "id")
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("a"), []byte("1"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("b"), []byte("2"))), t)
+	testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("b"), []byte("3"))), t)
+	testutils.CheckErr(track.WriteKeyed(Tombstone([]byte("a"))), t)
+
+	err := Compact(track, "", "compacted")
+	testutils.ExpectTrue(err != nil, "Expected compaction of a live track to fail", t)
+	track.Close()
+	track.WaitForShutdown()
+	testutils.CheckErr(Compact(track, "", "compacted"), t)
+
+	compacted, err := OpenTrackReadOnly("", "compacted")
+	testutils.CheckErr(err, t)
+	r, err := compacted.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	m, err := r.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("b"), m.Key, t)
+	testutils.CheckByteSlice([]byte("3"), m.Value, t)
+
+	_, err = r.ReadMessage()
+	testutils.ExpectTrue(err == io.EOF, "Expected deleted key to be compacted away", t)
+}
+
+func TestCompactTrimmed(t *testing.T) {
+	cleanupTrack()
+	cleanupTrackId("compacted")
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	for i := 0; i < 7; i++ {
+		testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte{'a' + byte(i%2)}, []byte{'0' + byte(i)})), t)
+	}
+	testutils.CheckErr(track.Trim(5), t)
+	track.Close()
+	track.WaitForShutdown()
+	testutils.CheckErr(Compact(track, "", "compacted"), t)
+
+	compacted, err := OpenTrackReadOnly("", "compacted")
+	testutils.CheckErr(err, t)
+	defer compacted.Close()
+	r, err := compacted.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	m, err := r.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("b"), m.Key, t)
+	testutils.CheckByteSlice([]byte("5"), m.Value, t)
+	m, err = r.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("a"), m.Key, t)
+	testutils.CheckByteSlice([]byte("6"), m.Value, t)
+	_, err = r.ReadMessage()
+	testutils.ExpectTrue(err == io.EOF, "Expected only the messages after the trimmed chunk", t)
+	cleanupTrackId("compacted")
+}
@@ -0,0 +1,109 @@
+package kv
+
+import (
+	"io"
+	"sync"
+
+	"github.com/asp2insp/toybox/train/track"
+)
+
+// The kv package is a simple embedded key/value store built on top of a Track.
+// Every Put or Delete is appended to the track as a keyed message, and the latest
+// value for each key is kept in an in-memory map. The map is rebuilt when the
+// store is opened by replaying the track from the beginning.
+
+type Store struct {
+	track *track.Track
+	data  map[string][]byte
+	mutex *sync.RWMutex
+}
+
+// Open the store backed by the track with the given root and id,
+// creating it if it doesn't exist yet
+func Open(root, id string) (*Store, error) {
+	s := Store{
+		data:  make(map[string][]byte),
+		mutex: &sync.RWMutex{},
+	}
+	err := s.replay(root, id)
+	if err != nil {
+		return nil, err
+	}
+	s.track, err = track.OpenTrackWithConfig(root, id, track.DefaultTrackConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Set key to value
+func (s *Store) Put(key, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.track.WriteKeyed(track.KeyedMessage(key, value))
+	if err != nil {
+		return err
+	}
+	// Copy the value, so that the caller can reuse its buffer
+	s.data[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+// Return the latest value for key, and whether it was found
+func (s *Store) Get(key []byte) ([]byte, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	value, ok := s.data[string(key)]
+	return value, ok
+}
+
+// Remove key from the store
+func (s *Store) Delete(key []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.track.WriteKeyed(track.Tombstone(key))
+	if err != nil {
+		return err
+	}
+	delete(s.data, string(key))
+	return nil
+}
+
+// Return the number of live keys in the store
+func (s *Store) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.data)
+}
+
+// Close the store, waiting for all pending writes to reach the track
+func (s *Store) Close() error {
+	return s.track.Close()
+}
+
+// Rebuild the in-memory map from the existing contents of the track
+func (s *Store) replay(root, id string) error {
+	t, err := track.OpenTrackReadOnly(root, id)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	r, err := t.ReaderAt(t.EarliestOffset())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for {
+		m, err := r.ReadMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if m.Tombstone {
+			delete(s.data, string(m.Key))
+		} else {
+			s.data[string(m.Key)] = m.Value
+		}
+	}
+}
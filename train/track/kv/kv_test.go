@@ -0,0 +1,96 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestPutGet(t *testing.T) {
+	cleanup()
+	store, err := Open("", "kv")
+	testutils.CheckErr(err, t)
+	defer store.Close()
+
+	_, ok := store.Get([]byte("a"))
+	testutils.ExpectTrue(!ok, "Expected missing key", t)
+
+	testutils.CheckErr(store.Put([]byte("a"), []byte("1")), t)
+	value, ok := store.Get([]byte("a"))
+	testutils.ExpectTrue(ok, "Expected key to be found", t)
+	testutils.CheckByteSlice([]byte("1"), value, t)
+
+	// Overwrite
+	testutils.CheckErr(store.Put([]byte("a"), []byte("2")), t)
+	value, _ = store.Get([]byte("a"))
+	testutils.CheckByteSlice([]byte("2"), value, t)
+	testutils.CheckInt(1, store.Len(), t)
+
+	// The store keeps its own copy of the value
+	buf := []byte("3")
+	testutils.CheckErr(store.Put([]byte("a"), buf), t)
+	buf[0] = 'x'
+	value, _ = store.Get([]byte("a"))
+	testutils.CheckByteSlice([]byte("3"), value, t)
+}
+
+func TestDelete(t *testing.T) {
+	cleanup()
+	store, err := Open("", "kv")
+	testutils.CheckErr(err, t)
+	defer store.Close()
+
+	testutils.CheckErr(store.Put([]byte("a"), []byte("1")), t)
+	testutils.CheckErr(store.Delete([]byte("a")), t)
+	_, ok := store.Get([]byte("a"))
+	testutils.ExpectTrue(!ok, "Expected deleted key to be missing", t)
+	testutils.CheckInt(0, store.Len(), t)
+}
+
+func TestRecovery(t *testing.T) {
+	cleanup()
+	store, err := Open("", "kv")
+	testutils.CheckErr(err, t)
+	for i := 0; i < 10; i++ {
+		testutils.CheckErr(store.Put([]byte(fmt.Sprintf("%d", i%5)), []byte(fmt.Sprintf("%d", i))), t)
+	}
+	testutils.CheckErr(store.Delete([]byte("0")), t)
+	store.Close()
+
+	store, err = Open("", "kv")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(4, store.Len(), t)
+	_, ok := store.Get([]byte("0"))
+	testutils.ExpectTrue(!ok, "Expected deleted key to stay deleted", t)
+	for i := 1; i < 5; i++ {
+		value, ok := store.Get([]byte(fmt.Sprintf("%d", i)))
+		testutils.ExpectTrue(ok, "Expected key to be recovered", t)
+		testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i+5)), value, t)
+	}
+
+	// Writes after recovery are appended to the same track
+	testutils.CheckErr(store.Put([]byte("0"), []byte("new")), t)
+	store.Close()
+	store, err = Open("", "kv")
+	testutils.CheckErr(err, t)
+	defer store.Close()
+	value, _ := store.Get([]byte("0"))
+	testutils.CheckByteSlice([]byte("new"), value, t)
+}
+
+func cleanup() {
+	for i := 0; ; i++ {
+		name := filepath.Join(os.TempDir(), fmt.Sprintf("kv.chunk.%d", i))
+		legacy := filepath.Join(os.TempDir(), fmt.Sprintf("kv%d", i))
+		_, err := os.Stat(name)
+		_, legacyErr := os.Stat(legacy)
+		if os.IsNotExist(err) && os.IsNotExist(legacyErr) {
+			break
+		}
+		os.Remove(name)
+		os.Remove(legacy)
+	}
+}
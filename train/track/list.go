@@ -0,0 +1,116 @@
+package track
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// ListTracks returns the ids of the tracks with files in the given directory, in order.
+// Chunk names have a separator between the id and the chunk number, but legacy chunks were
+// named by appending the number to the id, which is ambiguous for ids which end in digits:
+// log10 could be chunk 0 of log1, or chunk 10 of log. Tracks have a manifest from their
+// first write, which settles most cases: a legacy chunk belongs to the track whose manifest
+// lists it, or else to the longest id with a manifest it could belong to. Tracks older than
+// manifests are told apart by their first chunk, so a chunk goes with the shortest id which
+// has a chunk 0. Chunks named by a custom ChunkNamer may be mistaken for tracks of their own
+func ListTracks(root string) ([]string, error) {
+	files, err := ioutil.ReadDir(rootDir(root))
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(files))
+	known := make(map[string]bool)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		} else if strings.HasSuffix(f.Name(), ".manifest") {
+			known[strings.TrimSuffix(f.Name(), ".manifest")] = true
+		} else {
+			names[f.Name()] = true
+		}
+	}
+	owners := make(map[string]string)
+	for id := range known {
+		entries, err := readManifest(root, id)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read the manifest of track %s: %v", id, err)
+		}
+		for _, e := range entries {
+			owners[legacyChunkName(id, e.number)] = id
+		}
+	}
+	found := make(map[string]bool, len(known))
+	for id := range known {
+		found[id] = true
+	}
+	for name := range names {
+		if i := strings.LastIndex(name, chunkSeparator); i > 0 {
+			if _, ok := parseChunkNumber(name[i+len(chunkSeparator):]); ok {
+				found[name[:i]] = true
+			}
+			continue // Either a chunk, or one of the files beside it
+		} else if isColumnName(name) {
+			continue
+		}
+		if id, ok := owners[name]; ok {
+			found[id] = true
+		} else if id, ok := chunkOwner(name, known, names); ok {
+			found[id] = true
+		}
+	}
+	ids := make([]string, 0, len(found))
+	for id := range found {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Work out which track the legacy chunk file with the given name belongs to, if it's a
+// chunk at all. See ListTracks
+func chunkOwner(name string, known, names map[string]bool) (string, bool) {
+	// Every way of splitting the name into an id and a chunk number, longest id first
+	candidates := make([]string, 0)
+	for i := len(name) - 1; i > 0 && name[i] >= '0' && name[i] <= '9'; i-- {
+		if _, ok := parseChunkNumber(name[i:]); ok {
+			candidates = append(candidates, name[:i])
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	for _, id := range candidates {
+		if known[id] {
+			return id, true
+		}
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if names[candidates[i]+"0"] {
+			return candidates[i], true
+		}
+	}
+	return candidates[0], true
+}
+
+// OpenAll opens every track found by ListTracks in the given directory, keyed by id.
+// If any of them fails to open, those already opened are closed again
+func OpenAll(root string) (map[string]*Track, error) {
+	ids, err := ListTracks(root)
+	if err != nil {
+		return nil, err
+	}
+	tracks := make(map[string]*Track, len(ids))
+	for _, id := range ids {
+		t, err := OpenTrackWithConfig(root, id, DefaultTrackConfig())
+		if err != nil {
+			for _, opened := range tracks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("Cannot open track %s: %v", id, err)
+		}
+		tracks[id] = t
+	}
+	return tracks, nil
+}
@@ -0,0 +1,45 @@
+package track
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestListTracks(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 2
+	root, err := ioutil.TempDir("", "tracks")
+	testutils.CheckErr(err, t)
+	defer os.RemoveAll(root)
+
+	// Ids ending in digits give chunk names like log10, which could belong to log
+	counts := map[string]int{"log1": 5, "log2": 1, "a2b": 3, "old7": 3}
+	for id, n := range counts {
+		track, err := NewTrackWithConfig(root, id, DefaultTrackConfig())
+		testutils.CheckErr(err, t)
+		for i := 0; i < n; i++ {
+			_, err = track.WriteMessageCommit([]byte(fmt.Sprintf("%s %d", id, i)))
+			testutils.CheckErr(err, t)
+		}
+		testutils.CheckErr(track.Close(), t)
+	}
+	// As if it was written before manifests
+	testutils.CheckErr(os.Remove(manifestName(root, "old7")), t)
+
+	ids, err := ListTracks(root)
+	testutils.CheckErr(err, t)
+	testutils.CheckString("a2b log1 log2 old7", strings.Join(ids, " "), t)
+
+	tracks, err := OpenAll(root)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(counts), len(tracks), t)
+	for id, track := range tracks {
+		testutils.CheckUint64(uint64(counts[id]), track.LatestOffset(), t)
+		testutils.CheckErr(track.Close(), t)
+	}
+}
@@ -0,0 +1,143 @@
+package track
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrManifestMismatch is returned when opening a track whose chunk files don't match its
+// manifest, because a sealed chunk is missing, has been altered, or shouldn't be there
+var ErrManifestMismatch = errors.New("Track chunks don't match the manifest")
+
+// The manifest lists every sealed chunk in a track, one per line:
+//
+//	NUMBER BASE_OFFSET SIZE CHECKSUM
+//
+// followed by a final line holding the CRC-32 of everything before it. It's rewritten
+// whenever the set of sealed chunks changes, and checked when the track is opened.
+// Tracks written before manifests were added have none, and aren't checked
+type manifestEntry struct {
+	number   int
+	base     uint64
+	size     uint64
+	checksum uint32
+}
+
+func manifestName(root, id string) string {
+	return fname(id+".manifest", root)
+}
+
+// Rewrite the manifest to match the track's sealed chunks
+func (t *Track) writeManifest() error {
+	return t.writeManifestOf(func(*FileStorage) bool { return true })
+}
+
+// Rewrite the manifest to list the track's sealed chunks which keep returns true for
+func (t *Track) writeManifestOf(keep func(*FileStorage) bool) error {
+	t.manifestMutex.Lock()
+	defer t.manifestMutex.Unlock()
+	t.dataCond.L.Lock()
+	entries := make([]manifestEntry, 0, len(t.stores))
+	for _, store := range t.stores {
+		if store.sealed && keep(store) {
+			entries = append(entries, manifestEntry{t.chunkNumber(store), store.baseOffset, store.Size, store.checksum})
+		}
+	}
+	name := manifestName(t.RootPath, t.Id)
+	t.dataCond.L.Unlock()
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%d %d %d %08x\n", e.number, e.base, e.size, e.checksum)
+	}
+	fmt.Fprintf(&buf, "%08x\n", crc32.Update(0, crcTable, buf.Bytes()))
+	return replaceFile(name, buf.Bytes())
+}
+
+// Write data to a new file and rename it over the named one, so that a crash
+// leaves either the old file or the new one, and never half of either
+func replaceFile(name string, data []byte) error {
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = firstErr(err, f.Close())
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+	}
+	return err
+}
+
+// Read the track's manifest. Returns nil entries if the track has no manifest
+func readManifest(root, id string) ([]manifestEntry, error) {
+	data, err := ioutil.ReadFile(manifestName(root, id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	end := bytes.LastIndexByte(bytes.TrimSuffix(data, []byte("\n")), '\n') + 1
+	var sum uint32
+	_, err = fmt.Sscanf(strings.TrimSpace(string(data[end:])), "%x", &sum)
+	if err != nil || sum != crc32.Update(0, crcTable, data[:end]) {
+		return nil, ErrManifestMismatch
+	}
+	entries := make([]manifestEntry, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data[:end]))
+	for scanner.Scan() {
+		var e manifestEntry
+		_, err = fmt.Sscanf(scanner.Text(), "%d %d %d %x", &e.number, &e.base, &e.size, &e.checksum)
+		if err != nil {
+			return nil, ErrManifestMismatch
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Check the track's chunks against its manifest. Every listed chunk must be present
+// and unchanged, and nothing else may be numbered between the first and last listed
+// chunks. Chunks after them may have been sealed just before a crash, before the manifest
+// was rewritten, and chunks before them may be left over from an interrupted trim, so
+// they're allowed
+func (t *Track) checkManifest() error {
+	entries, err := readManifest(t.RootPath, t.Id)
+	if err != nil || entries == nil {
+		return err
+	}
+	stores := make(map[int]*FileStorage, len(t.stores))
+	for _, store := range t.stores {
+		stores[t.chunkNumber(store)] = store
+	}
+	first, last := -1, -1
+	for _, e := range entries {
+		store, ok := stores[e.number]
+		if !ok || store.baseOffset != e.base || store.Size != e.size || store.checksum != e.checksum {
+			return ErrManifestMismatch
+		}
+		delete(stores, e.number)
+		if first < 0 {
+			first = e.number
+		}
+		last = e.number
+	}
+	for n := range stores {
+		if n > first && n < last {
+			return ErrManifestMismatch
+		}
+	}
+	return nil
+}
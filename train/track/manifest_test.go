@@ -0,0 +1,87 @@
+package track
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestManifestDetectsMissingChunk(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+	entries, err := readManifest("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(entries), t)
+
+	// Reopening an untouched track is fine
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	testutils.CheckErr(os.Remove(fname(chunkName("id", 1), "")), t)
+	_, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.ExpectTrue(err == ErrManifestMismatch, "Expected the missing chunk to be caught", t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.ExpectTrue(err == ErrManifestMismatch, "Expected the missing chunk to be caught read-only", t)
+	cleanupTrack()
+}
+
+func TestManifestDetectsAlteredChunk(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Replace the sealed chunk with one holding different messages
+	testutils.CheckErr(os.Remove(fname(chunkName("id", 0), "")), t)
+	store := NewFileStorage("", chunkName("id", 0), 5)
+	for i := 0; i < 5; i++ {
+		testutils.CheckErr(store.WriteMessage(i, []byte("other")), t)
+	}
+	testutils.CheckErr(store.seal(), t)
+	testutils.CheckErr(store.Close(), t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.ExpectTrue(err == ErrManifestMismatch, "Expected the altered chunk to be caught", t)
+	cleanupTrack()
+}
+
+func TestCorruptManifest(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	data, err := ioutil.ReadFile(manifestName("", "id"))
+	testutils.CheckErr(err, t)
+	data[0] = '7'
+	testutils.CheckErr(ioutil.WriteFile(manifestName("", "id"), data, 0644), t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.ExpectTrue(err == ErrManifestMismatch, "Expected the corrupt manifest to be caught", t)
+
+	// Without a manifest there's nothing to check against
+	testutils.CheckErr(os.Remove(manifestName("", "id")), t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	cleanupTrack()
+}
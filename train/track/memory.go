@@ -0,0 +1,157 @@
+package track
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/asp2insp/go-misc/utils"
+)
+
+// A MemoryTrack has the same write, read and offset semantics as a Track, but keeps its
+// messages in a fixed size ring buffer in memory rather than on disk. It's meant for
+// ephemeral, high-throughput uses where nothing needs to survive a restart.
+// Once the ring is full, each new message either replaces the oldest one or is rejected
+// with ErrTrackFull, depending on the RingPolicy. Readers which fall so far behind that
+// their next message has been replaced get ErrOffsetTrimmed.
+type MemoryTrack struct {
+	ring     [][]byte
+	first    uint64 // Offset of the oldest message still in the ring
+	next     uint64 // Offset at which the next message will be written
+	policy   RingPolicy
+	alive    bool
+	dataCond *sync.Cond
+}
+
+// What a MemoryTrack does with new messages once its ring is full
+type RingPolicy int
+
+const (
+	RING_DROP_OLDEST RingPolicy = iota
+	RING_REJECT
+)
+
+// Create a memory track holding up to capacity messages, which drops
+// the oldest message once it's full
+func NewMemoryTrack(capacity uint64) *MemoryTrack {
+	t, err := NewMemoryTrackWithPolicy(capacity, RING_DROP_OLDEST)
+	utils.Check(err)
+	return t
+}
+
+func NewMemoryTrackWithPolicy(capacity uint64, policy RingPolicy) (*MemoryTrack, error) {
+	if capacity == 0 {
+		return nil, errors.New("Memory tracks must be able to hold at least one message")
+	}
+	return &MemoryTrack{
+		ring:     make([][]byte, capacity),
+		policy:   policy,
+		alive:    true,
+		dataCond: &sync.Cond{L: &sync.Mutex{}},
+	}, nil
+}
+
+// Write a copy of the given message to the track. Unlike Track, there's no
+// writer goroutine, so the message is readable as soon as this returns
+func (t *MemoryTrack) WriteMessage(data []byte) error {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	if !t.alive {
+		return errors.New("Track is closed, could not write message")
+	}
+	if t.next-t.first == uint64(len(t.ring)) {
+		if t.policy == RING_REJECT {
+			return ErrTrackFull
+		}
+		t.first++
+	}
+	t.ring[t.next%uint64(len(t.ring))] = append([]byte(nil), data...)
+	t.next++
+	t.dataCond.Broadcast()
+	return nil
+}
+
+// LatestOffset returns the offset at which the next message will be written
+func (t *MemoryTrack) LatestOffset() uint64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.next
+}
+
+// OldestOffset returns the offset of the oldest message still in the ring
+func (t *MemoryTrack) OldestOffset() uint64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.first
+}
+
+func (t *MemoryTrack) ReaderAt(offset uint64) (*MemoryReader, error) {
+	return &MemoryReader{parent: t, Offset: offset, mutex: &sync.Mutex{}}, nil
+}
+
+// Close the track to further writes. Readers get io.EOF once they've read everything
+func (t *MemoryTrack) Close() error {
+	t.dataCond.L.Lock()
+	t.alive = false
+	t.dataCond.L.Unlock()
+	t.dataCond.Broadcast()
+	return nil
+}
+
+// MEMORY READER -- Reads messages from a MemoryTrack in order
+type MemoryReader struct {
+	parent *MemoryTrack
+	Offset uint64
+	mutex  *sync.Mutex
+}
+
+// Read the next message into p. Like StorageReader.Read, it blocks until a message
+// is available, and returns ErrShortBuffer if the message doesn't fit. Read is thread-safe
+func (r *MemoryReader) Read(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	msg, err := r.waitForNext()
+	if err != nil {
+		return 0, err
+	}
+	if len(msg) > len(p) {
+		return 0, ErrShortBuffer
+	}
+	r.Offset++
+	return copy(p, msg), nil
+}
+
+// Next returns a copy of the next message, blocking until one is available. Next is thread-safe
+func (r *MemoryReader) Next() ([]byte, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	msg, err := r.waitForNext()
+	if err != nil {
+		return nil, err
+	}
+	r.Offset++
+	return append([]byte(nil), msg...), nil
+}
+
+// Block until the message at the current offset has been written, and return it.
+// Returns ErrOffsetTrimmed if the message has already been dropped from the ring,
+// and io.EOF if the track is closed and there is no more data
+func (r *MemoryReader) waitForNext() ([]byte, error) {
+	t := r.parent
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	for {
+		if r.Offset < t.first {
+			return nil, ErrOffsetTrimmed
+		} else if r.Offset < t.next {
+			return t.ring[r.Offset%uint64(len(t.ring))], nil
+		} else if !t.alive {
+			return nil, io.EOF
+		}
+		t.dataCond.Wait()
+	}
+}
+
+func (r *MemoryReader) Close() error {
+	return nil
+}
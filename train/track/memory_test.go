@@ -0,0 +1,74 @@
+package track
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestMemoryTrackWraparound(t *testing.T) {
+	track := NewMemoryTrack(3)
+	for i := 0; i < 5; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprintf("%d", i))), t)
+	}
+	testutils.CheckUint64(2, track.OldestOffset(), t)
+	testutils.CheckUint64(5, track.LatestOffset(), t)
+	testutils.CheckErr(track.Close(), t)
+
+	r, err := track.ReaderAt(2)
+	testutils.CheckErr(err, t)
+	for i := 2; i < 5; i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i)), msg, t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected EOF at the end of a closed track", t)
+}
+
+func TestMemoryReaderLapped(t *testing.T) {
+	track := NewMemoryTrack(2)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.WriteMessage([]byte("a")), t)
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("a"), msg, t)
+
+	// The writer laps the reader, which is told rather than silently skipping
+	for _, m := range []string{"b", "c", "d"} {
+		testutils.CheckErr(track.WriteMessage([]byte(m)), t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the reader to have been lapped", t)
+	r.Offset = track.OldestOffset()
+	buf := make([]byte, 1)
+	n, err := r.Read(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("c"), buf[:n], t)
+}
+
+func TestMemoryTrackReject(t *testing.T) {
+	track, err := NewMemoryTrackWithPolicy(2, RING_REJECT)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.WriteMessage([]byte("a")), t)
+	testutils.CheckErr(track.WriteMessage([]byte("b")), t)
+	testutils.ExpectTrue(track.WriteMessage([]byte("c")) == ErrTrackFull, "Expected a full ring to reject writes", t)
+	testutils.CheckUint64(0, track.OldestOffset(), t)
+	testutils.CheckUint64(2, track.LatestOffset(), t)
+}
+
+func TestMemoryReaderBlocks(t *testing.T) {
+	track := NewMemoryTrack(4)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	done := make(chan []byte)
+	go func() {
+		msg, _ := r.Next()
+		done <- msg
+	}()
+	testutils.CheckErr(track.WriteMessage(testData), t)
+	testutils.CheckByteSlice(testData, <-done, t)
+}
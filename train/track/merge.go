@@ -0,0 +1,242 @@
+package track
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MergeChunks rewrites runs of adjacent sealed chunks into fewer, larger chunks which each
+// hold at most maxMessagesPerChunk messages. The active chunk is never merged. Every offset
+// still resolves to the same message afterwards, and open readers are unaffected.
+// Chunks on either side of a missing chunk are never merged together.
+// Chunk files are renumbered to close up the numbers freed by merging, so the track must
+// not be opened by anyone else while a merge is running
+func (t *Track) MergeChunks(maxMessagesPerChunk uint64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	} else if maxMessagesPerChunk == 0 {
+		return errors.New("Chunks must be allowed to hold at least one message")
+	}
+	err := t.mergeChunks(maxMessagesPerChunk)
+	if err != nil {
+		return err
+	}
+	return t.writeManifest()
+}
+
+func (t *Track) mergeChunks(maxMessagesPerChunk uint64) error {
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+
+	// Sealed chunks never change, so we can read them without holding the lock
+	t.dataCond.L.Lock()
+	sealed := make([]*FileStorage, 0)
+	for _, store := range t.stores {
+		if !store.readOnly {
+			break
+		}
+		sealed = append(sealed, store)
+	}
+	t.dataCond.L.Unlock()
+
+	// Greedily group adjacent chunks while they fit
+	groups := make([][]*FileStorage, 0)
+	var groupSize uint64
+	for i, store := range sealed {
+		last := len(groups) - 1
+		contiguous := i > 0 && sealed[i-1].baseOffset+sealed[i-1].Capacity == store.baseOffset
+		if last >= 0 && contiguous && groupSize+store.Size <= maxMessagesPerChunk {
+			groups[last] = append(groups[last], store)
+			groupSize += store.Size
+		} else {
+			groups = append(groups, []*FileStorage{store})
+			groupSize = store.Size
+		}
+	}
+
+	merged := make([]*FileStorage, 0, len(groups))
+	created := make([]*FileStorage, 0)
+	// The range of original chunk numbers that each merged store replaces
+	first := make([]int, 0, len(groups))
+	last := make([]int, 0, len(groups))
+	for i, group := range groups {
+		first = append(first, t.chunkNumber(group[0]))
+		last = append(last, t.chunkNumber(group[len(group)-1]))
+		if len(group) == 1 {
+			merged = append(merged, group[0])
+			continue
+		}
+		store, err := mergeStores(t.RootPath, fmt.Sprintf("%s.merge%d", t.Id, i), group)
+		if err != nil {
+			discardStores(created)
+			return err
+		}
+		merged = append(merged, store)
+		created = append(created, store)
+	}
+	if len(created) == 0 {
+		return nil // Nothing to merge
+	}
+	// Only list the chunks before the first merged group while the files are replaced and
+	// renumbered, so that a crash part way through leaves a track which still opens
+	var unchanged uint64
+	for _, group := range groups {
+		if len(group) > 1 {
+			unchanged = group[0].baseOffset
+			break
+		}
+	}
+	err := t.writeManifestOf(func(store *FileStorage) bool {
+		return store.baseOffset < unchanged
+	})
+	if err != nil {
+		discardStores(created)
+		return err
+	}
+
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	active := t.stores[len(sealed):]
+	stores := make([]*FileStorage, 0, len(merged)+len(active))
+	for i, group := range groups {
+		if len(group) == 1 {
+			stores = append(stores, group[0])
+			continue
+		}
+		err = swapMerged(merged[i], group)
+		if err != nil {
+			// Leave the track as it is on disk: the group is still there unless the merged
+			// store took its place, and the groups after it haven't been touched
+			if merged[i].fileId == group[0].fileId {
+				stores = append(stores, merged[i])
+			} else {
+				stores = append(stores, group...)
+				discardStores(merged[i : i+1])
+			}
+			for j, later := range groups[i+1:] {
+				stores = append(stores, later...)
+				if len(later) > 1 {
+					discardStores(merged[i+1+j : i+2+j])
+				}
+			}
+			t.stores = append(stores, active...)
+			return err
+		}
+		stores = append(stores, merged[i])
+	}
+	stores = append(stores, active...)
+	for _, store := range active {
+		first = append(first, t.chunkNumber(store))
+		last = append(last, t.chunkNumber(store))
+	}
+	t.stores = stores
+	// Renumber in ascending order, keeping any gaps left by missing chunks. Each store
+	// only ever moves to a lower number, which has either been removed or already vacated.
+	// Each store's id is updated as it's renamed, so t.stores always matches the files
+	number := first[0]
+	for i, store := range stores {
+		if i > 0 {
+			number += first[i] - last[i-1]
+		}
+		storeId := t.chunkId(number)
+		if store.fileId == storeId {
+			continue
+		}
+		err := renameStorage(store.fileId, store.rootPath, storeId, store.rootPath)
+		if err != nil {
+			return err
+		}
+		store.fileId = storeId
+	}
+	return nil
+}
+
+// Put the merged store in place of its group: rename it over the group's first chunk,
+// then close the group and delete the rest of it. A crash in between leaves the rest of
+// the group inside the merged chunk's offsets, and opening the track drops them.
+// Must be called with dataCond.L held
+func swapMerged(store *FileStorage, group []*FileStorage) error {
+	first := group[0]
+	err := renameStorage(store.fileId, store.rootPath, first.fileId, first.rootPath)
+	if err != nil {
+		return err
+	}
+	store.fileId = first.fileId
+	// Readers in the group have their own open files, and carry on reading them
+	for i, src := range group {
+		err = firstErr(err, src.Close())
+		if i > 0 {
+			err = firstErr(err, removeStorage(src.fileId, src.rootPath))
+		}
+	}
+	return err
+}
+
+// Close stores which were being created, and delete their files
+func discardStores(stores []*FileStorage) {
+	for _, store := range stores {
+		store.Close()
+		removeStorage(store.fileId, store.rootPath)
+	}
+}
+
+// Copy all of the messages in the given stores into a single new sealed store,
+// which starts at the same offset as the group
+func mergeStores(root, id string, group []*FileStorage) (*FileStorage, error) {
+	var capacity uint64
+	for _, store := range group {
+		capacity += store.Size
+	}
+	merged, err := CreateFileStorage(root, id, capacity, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = merged.setBaseOffset(group[0].baseOffset)
+	if err == nil {
+		err = copyMessages(merged, group)
+	}
+	if err == nil {
+		err = mergeTimestamps(root, id, group)
+	}
+	if err == nil {
+		err = mergeColumns(root, id, group)
+	}
+	if err != nil {
+		merged.Close()
+		removeStorage(id, root)
+		return nil, err
+	}
+	err = merged.seal()
+	if err != nil {
+		merged.Close()
+		removeStorage(id, root)
+		return nil, err
+	}
+	return merged, nil
+}
+
+// Append every message from the sources to dst, in order
+func copyMessages(dst *FileStorage, sources []*FileStorage) error {
+	for _, src := range sources {
+		if src.Size == 0 {
+			continue
+		}
+		r, err := src.ReaderAt(0)
+		if err != nil {
+			return err
+		}
+		var i uint64
+		for i = 0; i < src.Size; i++ {
+			size, err := src.SizeOf(i)
+			if err == nil {
+				err = dst.WriteMessageFrom(int(dst.Size), r, int64(size))
+			}
+			if err != nil {
+				r.Close()
+				return err
+			}
+		}
+		r.Close()
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package track
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestMergeChunks(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 23)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(5, len(track.stores), t)
+
+	// A reader part way through a chunk which is about to be merged away
+	r, err := track.ReaderAt(7)
+	testutils.CheckErr(err, t)
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[7], msg, t)
+
+	// The four sealed chunks are merged, the active chunk is left alone
+	testutils.CheckErr(track.MergeChunks(20), t)
+	testutils.CheckInt(2, len(track.stores), t)
+	testutils.CheckUint64(20, track.stores[0].Size, t)
+	testutils.CheckUint64(20, track.stores[1].baseOffset, t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 2), "")), "Expected merged chunk files to be removed", t)
+
+	for i := 8; i < len(msgs); i++ {
+		msg, err = r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	for i := range msgs {
+		r, err := track.ReaderAt(uint64(i))
+		testutils.CheckErr(err, t)
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+		r.Close()
+	}
+
+	// The writer carries on in the renumbered active chunk
+	offset, err := track.WriteAllSync([][]byte{testData, testData, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(23, offset, t)
+	testutils.CheckInt(3, len(track.stores), t)
+	track.Close()
+	track.WaitForShutdown()
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(3, len(track.stores), t)
+	r, err = track.ReaderAt(19)
+	testutils.CheckErr(err, t)
+	for i := 19; i < len(msgs); i++ {
+		msg, err = r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	msg, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, msg, t)
+}
+
+func TestMergeAroundMissingChunk(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 30)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+	testutils.CheckErr(os.Remove(fname(chunkName("id", 2), "")), t)
+	// Chunks deleted by hand must be dropped from the manifest too, or opening refuses the gap
+	testutils.CheckErr(os.Remove(manifestName("", "id")), t)
+
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.MergeChunks(100), t)
+	testutils.CheckInt(3, len(track.stores), t) // The last chunk is still active
+	testutils.CheckErr(track.Close(), t)
+
+	// The gap survives both the merge and reopening
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 2), "")), "Expected the chunks after the gap to keep it", t)
+	r, err := track.ReaderAt(10)
+	testutils.CheckErr(err, t)
+	_, err = r.Next()
+	testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the missing chunk to be trimmed", t)
+	r.Close()
+	for _, start := range []int{0, 15} {
+		r, err = track.ReaderAt(uint64(start))
+		testutils.CheckErr(err, t)
+		for i := start; i < start+10; i++ {
+			msg, err := r.Next()
+			testutils.CheckErr(err, t)
+			testutils.CheckByteSlice(msgs[i], msg, t)
+		}
+		r.Close()
+	}
+	cleanupTrack()
+}
+
+// A crash after the merged chunk has been renamed over the first of its group, but before
+// the rest of the group has been deleted
+func TestMergeInterrupted(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 23)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	sources := make(map[int][]byte)
+	for n := 1; n <= 3; n++ {
+		sources[n], err = ioutil.ReadFile(fname(chunkName("id", n), ""))
+		testutils.CheckErr(err, t)
+	}
+	testutils.CheckErr(track.MergeChunks(20), t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Put the files back as they were before the rest of the group was deleted, and
+	// before the active chunk was renumbered
+	testutils.CheckErr(os.Rename(fname(chunkName("id", 1), ""), fname(chunkName("id", 4), "")), t)
+	for n, data := range sources {
+		testutils.CheckErr(ioutil.WriteFile(fname(chunkName("id", n), ""), data, 0666), t)
+	}
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(track.stores), t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 1), "")), "Expected opening read-only to leave the files alone", t)
+
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(track.stores), t)
+	for n := 1; n <= 3; n++ {
+		testutils.ExpectTrue(!exists(fname(chunkName("id", n), "")), fmt.Sprintf("Expected leftover chunk %d to be deleted", n), t)
+	}
+	offset, err := track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(23, offset, t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	for i := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	r.Close()
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestMergeFailedManifest(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 23)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	// The manifest can't be rewritten while something's in the way of its temporary file
+	blocker := manifestName("", "id") + ".tmp"
+	testutils.CheckErr(os.Mkdir(blocker, 0755), t)
+	defer os.Remove(blocker)
+	testutils.ExpectTrue(track.MergeChunks(20) != nil, "Expected the merge to fail", t)
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(5, len(track.stores), t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	cleanupTrack()
+}
+
+func TestBaseOffsetRecordedInHeader(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	// After merging, the first chunk holds 10 messages rather than CHUNK_SIZE
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 20)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.MergeChunks(10), t)
+	testutils.CheckUint64(10, track.stores[1].baseOffset, t)
+	testutils.CheckErr(track.Close(), t)
+	testutils.CheckErr(os.Remove(fname(chunkName("id", 0), "")), t)
+	// Chunks deleted by hand must be dropped from the manifest too, or opening refuses the gap
+	testutils.CheckErr(os.Remove(manifestName("", "id")), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(10, track.stores[0].baseOffset, t)
+	for i := 0; i < 10; i++ {
+		r, err := track.ReaderAt(uint64(i))
+		testutils.CheckErr(err, t)
+		_, err = r.Next()
+		testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the first chunk to be trimmed", t)
+		r.Close()
+	}
+	r, err := track.ReaderAt(10)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := 10; i < len(msgs); i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	cleanupTrack()
+}
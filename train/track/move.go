@@ -0,0 +1,71 @@
+package track
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// The files which belong to a track besides its chunks, by name
+var trackFiles = []func(root, id string) string{manifestName, keyIndexName}
+
+// MoveTo renames all of the track's files to the given root and id, and carries on
+// using them there. Writes and reads pause while the files are moved, but nothing needs to
+// be closed: open files are unaffected by being renamed. Files are only ever renamed, so
+// moving to a different filesystem fails with an error, and the track is left where it was
+func (t *Track) MoveTo(newRoot, newId string) error {
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+	t.manifestMutex.Lock()
+	defer t.manifestMutex.Unlock()
+	t.readersMutex.Lock() // Reader ids are derived from the track id
+	defer t.readersMutex.Unlock()
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+
+	newIds := make([]string, len(t.stores))
+	for i, store := range t.stores {
+		newIds[i] = t.namer().ChunkName(newId, t.chunkNumber(store))
+		if exists(fname(newIds[i], newRoot)) || exists(sidecarName(newIds[i], newRoot)) {
+			return fmt.Errorf("Cannot move track %s, %s already exists", t.Id, fname(newIds[i], newRoot))
+		}
+	}
+	for _, name := range trackFiles {
+		if exists(name(newRoot, newId)) {
+			return fmt.Errorf("Cannot move track %s, %s already exists", t.Id, name(newRoot, newId))
+		}
+	}
+	for i, store := range t.stores {
+		err := renameStorage(store.fileId, store.rootPath, newIds[i], newRoot)
+		if err != nil {
+			// Put back everything we've moved so far
+			for j := 0; j < i; j++ {
+				renameStorage(newIds[j], newRoot, t.stores[j].fileId, t.stores[j].rootPath)
+			}
+			if le, ok := err.(*os.LinkError); ok && le.Err == syscall.EXDEV {
+				return fmt.Errorf("Cannot move track %s to %s, it's on a different filesystem and would have to be copied", t.Id, newRoot)
+			}
+			return err
+		}
+	}
+	// The manifest lists chunks by number, so it's still correct once it has been moved
+	for i, name := range trackFiles {
+		err := os.Rename(name(t.RootPath, t.Id), name(newRoot, newId))
+		if err != nil && !os.IsNotExist(err) {
+			for _, moved := range trackFiles[:i] {
+				os.Rename(moved(newRoot, newId), moved(t.RootPath, t.Id))
+			}
+			for j, store := range t.stores {
+				renameStorage(newIds[j], newRoot, store.fileId, store.rootPath)
+			}
+			return err
+		}
+	}
+	for i, store := range t.stores {
+		store.fileId = newIds[i]
+		store.rootPath = newRoot
+	}
+	t.Id = newId
+	t.RootPath = newRoot
+	return nil
+}
@@ -0,0 +1,75 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestMoveTo(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	cleanupTrackId("moved")
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync(msgs[:8])
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+
+	testutils.CheckErr(track.MoveTo("", "moved"), t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 0), "")) && !exists(fname(chunkName("id", 1), "")), "Expected the old files to be gone", t)
+	testutils.ExpectTrue(exists(fname(chunkName("moved", 0), "")) && exists(fname(chunkName("moved", 1), "")), "Expected the files at the new location", t)
+
+	// Writing carries on at the new location, and readers don't notice the move
+	_, err = track.WriteAllSync(msgs[8:])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(exists(fname(chunkName("moved", 2), "")), "Expected new chunks at the new location", t)
+	for i := 1; i < len(msgs); i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackReadOnly("", "moved")
+	testutils.CheckErr(err, t)
+	r, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	cleanupTrackId("moved")
+}
+
+func TestMoveToExisting(t *testing.T) {
+	cleanupTrack()
+	cleanupTrackId("moved")
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync([][]byte{testData})
+	testutils.CheckErr(err, t)
+	other := NewTrack("", "moved")
+	_, err = other.WriteAllSync([][]byte{testData})
+	testutils.CheckErr(err, t)
+
+	testutils.ExpectTrue(track.MoveTo("", "moved") != nil, "Expected moving over another track to fail", t)
+	testutils.CheckString("id", track.Id, t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 0), "")), "Expected the track to stay where it was", t)
+	track.Close()
+	other.Close()
+	cleanupTrack()
+	cleanupTrackId("moved")
+}
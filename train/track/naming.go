@@ -0,0 +1,41 @@
+package track
+
+// A ChunkNamer decides the file names of a track's chunks, for example to zero-pad the
+// chunk numbers so that the files sort in order in an object store. ParseChunkName must
+// recognize every name ChunkName makes, and nothing else in the directory: not the
+// chunks of other tracks, nor the files kept beside each chunk, whose names add a
+// suffix to the chunk's name
+type ChunkNamer interface {
+	// The name of the chunk with the given number in the track with the given id
+	ChunkName(id string, n int) string
+	// The number of the chunk with the given file name, if it's one of the track's chunks
+	ParseChunkName(id, name string) (int, bool)
+}
+
+// DefaultChunkNamer names chunks by the track id, chunkSeparator and the chunk number,
+// and also recognizes the legacy names without the separator
+type DefaultChunkNamer struct{}
+
+func (DefaultChunkNamer) ChunkName(id string, n int) string {
+	return chunkName(id, n)
+}
+
+func (DefaultChunkNamer) ParseChunkName(id, name string) (int, bool) {
+	return parseChunkName(id, name)
+}
+
+// The track's ChunkNamer
+func (t *Track) namer() ChunkNamer {
+	if t.config.ChunkNamer == nil {
+		return DefaultChunkNamer{}
+	}
+	return t.config.ChunkNamer
+}
+
+// The name of the existing file for the track's chunk with the given number
+func (t *Track) chunkFile(n int) string {
+	if _, ok := t.namer().(DefaultChunkNamer); ok {
+		return existingChunkName(t.RootPath, t.Id, n)
+	}
+	return t.namer().ChunkName(t.Id, n)
+}
@@ -0,0 +1,78 @@
+package track
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+// Names chunks with zero-padded numbers, so they sort in order by name
+type paddedNamer struct{}
+
+func (paddedNamer) ChunkName(id string, n int) string {
+	return fmt.Sprintf("%s-%04d", id, n)
+}
+
+func (paddedNamer) ParseChunkName(id, name string) (int, bool) {
+	if !strings.HasPrefix(name, id+"-") || len(name) != len(id)+5 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(name[len(id)+1:])
+	return n, err == nil && n >= 0
+}
+
+func cleanupPadded(id string) {
+	for i := 0; i < 20; i++ {
+		removeStorage(paddedNamer{}.ChunkName(id, i), "")
+	}
+	cleanupTrackId(id)
+}
+
+func TestChunkNamer(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 2
+	cleanupPadded("id")
+	defer cleanupPadded("id")
+
+	config := DefaultTrackConfig()
+	config.ChunkNamer = paddedNamer{}
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	msgs := make([][]byte, 24)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err = track.WriteMessages(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	for i := 0; i < 12; i++ {
+		testutils.ExpectTrue(exists(fname(fmt.Sprintf("id-%04d", i), "")), fmt.Sprintf("Expected chunk %d to be id-%04d", i, i), t)
+	}
+	// Numbered in order, with nothing else in the directory mistaken for a chunk
+	chunks, err := discoverChunks("", "id", paddedNamer{})
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(12, len(chunks), t)
+	for i, n := range chunks {
+		testutils.CheckInt(i, n, t)
+	}
+
+	track, err = OpenTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	testutils.CheckUint64(24, track.LatestOffset(), t)
+	all, err := track.ReadAll(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(msgs), len(all), t)
+	for i, msg := range all {
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	// The writer carries on with the next name
+	_, err = track.WriteMessageCommit(msgs[0])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(exists(fname("id-0012", "")), "Expected the next chunk to be id-0012", t)
+}
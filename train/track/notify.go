@@ -0,0 +1,46 @@
+package track
+
+// DurableNotify returns a channel which receives the durable offset, as returned by
+// DurableOffset, each time it advances. Sends never block the writer: if the last offset
+// sent hasn't been received yet, it's replaced by the new one, so a slow consumer only sees
+// the latest. The channel starts out holding the current durable offset, and is closed
+// once the writer stops, or straight away for a read-only track. TruncateTo can move the
+// durable offset back, which is sent like any other change
+func (t *Track) DurableNotify() <-chan uint64 {
+	ch := make(chan uint64, 1)
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	ch <- t.durable
+	if !t.alive {
+		close(ch)
+		return ch
+	}
+	t.durableNotify = append(t.durableNotify, ch)
+	return ch
+}
+
+// Move the durable offset, and let anyone waiting on DurableNotify know.
+// Must be called with dataCond.L held
+func (t *Track) setDurable(offset uint64) {
+	if offset == t.durable {
+		return
+	}
+	t.durable = offset
+	for _, ch := range t.durableNotify {
+		// Only this sends, under the lock, so once the stale offset is taken there's room
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- offset
+	}
+}
+
+// Close the channels returned by DurableNotify, once the writer has stopped.
+// Must be called with dataCond.L held
+func (t *Track) closeDurableNotify() {
+	for _, ch := range t.durableNotify {
+		close(ch)
+	}
+	t.durableNotify = nil
+}
@@ -0,0 +1,50 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestDurableNotify(t *testing.T) {
+	cleanupTrack()
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncInterval(5 * time.Millisecond)})
+	testutils.CheckErr(err, t)
+	notify := track.DurableNotify()
+	testutils.CheckUint64(0, <-notify, t)
+
+	// Each batch becomes durable on a later tick, and the offsets only go up
+	var last uint64
+	for batch := 1; batch <= 3; batch++ {
+		for i := 0; i < 10; i++ {
+			testutils.CheckErr(track.WriteMessage(testData), t)
+		}
+		want := uint64(batch * 10)
+		timeout := time.After(5 * time.Second)
+		for last < want {
+			select {
+			case offset := <-notify:
+				testutils.ExpectTrue(offset > last, fmt.Sprintf("Expected the durable offset to advance past %d, got %d", last, offset), t)
+				last = offset
+			case <-timeout:
+				t.Fatalf("Durable offset stuck at %d, expected %d", last, want)
+			}
+		}
+		testutils.CheckUint64(want, last, t)
+		testutils.CheckUint64(want, track.DurableOffset(), t)
+	}
+
+	testutils.CheckErr(track.Close(), t)
+	for range notify {
+		// Drain whatever was sent while closing
+	}
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	notify = track.DurableNotify()
+	testutils.CheckUint64(30, <-notify, t)
+	_, open := <-notify
+	testutils.ExpectTrue(!open, "Expected the channel of a read-only track to be closed", t)
+}
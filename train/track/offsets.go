@@ -0,0 +1,45 @@
+package track
+
+import (
+	"errors"
+)
+
+// ErrOffsetMismatch is returned by readers checking their offsets when a message's offset,
+// worked out from the chunk it's in, isn't the one the reader expected
+var ErrOffsetMismatch = errors.New("Message offset doesn't match the reader's count")
+
+// The state of a reader which is checking its offsets
+type offsetCheck struct {
+	expected uint64 // The offset of the next message, counted from where checking started
+}
+
+// VerifyOffsets makes the reader check the offset of every message it reads, to catch
+// bugs in how tracks are recovered. It counts messages from its current offset, and works
+// out each message's offset again from the base offset recorded in its chunk's header and
+// its index in the chunk. If they ever differ, the read fails with ErrOffsetMismatch.
+// Seeking starts the count again. It's meant for debugging, rather than everyday reads.
+// VerifyOffsets is thread-safe
+func (sr *StorageReader) VerifyOffsets() {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.verify = &offsetCheck{expected: sr.Offset}
+}
+
+// Start counting again from the reader's offset, once it has moved
+func (sr *StorageReader) restartOffsetCheck() {
+	if sr.verify != nil {
+		sr.verify = &offsetCheck{expected: sr.Offset}
+	}
+}
+
+// Check that the message with the given index in the store is the one expected next
+func (c *offsetCheck) check(store *FileStorage, index uint64) error {
+	base, ok := store.recordedBaseOffset()
+	if !ok {
+		base = store.baseOffset // Written before base offsets were recorded
+	}
+	if base+index != c.expected {
+		return ErrOffsetMismatch
+	}
+	return nil
+}
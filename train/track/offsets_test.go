@@ -0,0 +1,59 @@
+package track
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestVerifyOffsets(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	for i := 0; i < 12; i++ {
+		track.WriteMessage([]byte(fmt.Sprint(i)))
+	}
+	testutils.CheckErr(track.Close(), t)
+	track, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(3, len(track.stores), t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	r.VerifyOffsets()
+	for i := 0; i < 12; i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprint(i), string(msg), t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected EOF at the end of the track", t)
+	// Coalesced reads check every message too, so they take one at a time
+	testutils.CheckErr(r.SeekTo(3), t)
+	cr := r.Coalescing(64)
+	for i := 0; i < 2; i++ {
+		msgs, err := cr.ReadMessages()
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(1, len(msgs), t)
+	}
+	testutils.CheckUint64(5, r.Offset, t)
+	r.Close()
+
+	// Recovery got the second chunk's base offset wrong by one
+	track.stores[1].baseOffset--
+	r, err = track.ReaderAt(3)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.CheckErr(r.SetReadAhead(2), t)
+	r.VerifyOffsets()
+	for err == nil {
+		_, err = r.Next()
+	}
+	testutils.ExpectTrue(err == ErrOffsetMismatch, fmt.Sprintf("Expected ErrOffsetMismatch, got %v", err), t)
+	testutils.CheckUint64(5, r.Offset, t)
+	cleanupTrack()
+}
@@ -0,0 +1,34 @@
+package track
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// RECOVER_PANICS makes the package's entry points (WriteMessage, ReaderAt, the reads, and the
+// error-returning constructors like OpenFileStorage, NewTrackWithConfig and
+// OpenTrackWithConfig) turn a panic from deep inside into a returned *PanicError, so that
+// one bad file can't take down the whole process. It's a safety net while the remaining
+// utils.Check calls are converted to returned errors. Turn it off to let panics through,
+// which is handier when debugging
+var RECOVER_PANICS = true
+
+// PanicError is returned in place of a panic caught by an entry point
+type PanicError struct {
+	Value interface{} // What was passed to panic
+	Stack []byte      // Where it panicked
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Recovered from panic: %v\n%s", e.Value, e.Stack)
+}
+
+// Deferred by entry points to replace a panic with an error
+func recoverPanic(err *error) {
+	if !RECOVER_PANICS {
+		return
+	}
+	if r := recover(); r != nil {
+		*err = &PanicError{Value: r, Stack: debug.Stack()}
+	}
+}
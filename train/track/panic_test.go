@@ -0,0 +1,72 @@
+package track
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func expectPanicError(err error, t *testing.T) {
+	_, ok := err.(*PanicError)
+	testutils.ExpectTrue(ok, fmt.Sprintf("Expected a PanicError, got %v", err), t)
+}
+
+func TestWriteRecoversPanic(t *testing.T) {
+	// A track that wasn't made by NewTrack has nothing set up
+	track := &Track{}
+	expectPanicError(track.WriteMessage(testData), t)
+	_, err := track.ReaderAt(0)
+	expectPanicError(err, t)
+}
+
+func TestReadLostMessage(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, err := track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	// Lose the message's bytes from under the offset table
+	store := track.stores[0]
+	testutils.CheckErr(os.Truncate(fname(store.fileId, ""), int64(store.index[0])), t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	buf := make([]byte, 64)
+	_, err = r.Read(buf)
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF, got %v", err), t)
+	// The reader is still usable, it's just stuck on the missing message
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF, got %v", err), t)
+}
+
+func TestOpenRecoversPanic(t *testing.T) {
+	cleanup()
+	// A capacity so large that the size of its offset table overflows
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint64(data, 1<<61-1)
+	binary.LittleEndian.PutUint64(data[_nSize:], 64)
+	testutils.CheckErr(ioutil.WriteFile(fname("id", ""), data, 0666), t)
+	_, err := OpenFileStorage("", "id")
+	expectPanicError(err, t)
+
+	cleanupTrack()
+	testutils.CheckErr(ioutil.WriteFile(fname("id0", ""), data, 0666), t)
+	_, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	expectPanicError(err, t)
+	cleanupTrack()
+}
+
+func TestRecoverPanicsOff(t *testing.T) {
+	defer func(recover bool) { RECOVER_PANICS = recover }(RECOVER_PANICS)
+	RECOVER_PANICS = false
+	defer func() {
+		testutils.ExpectTrue(recover() != nil, "Expected the panic to get through", t)
+	}()
+	(&Track{}).WriteMessage(testData)
+}
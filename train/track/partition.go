@@ -0,0 +1,228 @@
+package track
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/asp2insp/go-misc/utils"
+)
+
+// A PartitionedTrack spreads messages across several tracks, each with its own writer, so
+// that producers don't all queue up behind one writer. Each message goes to the partition
+// chosen by hashing its key, so messages with the same key stay in order, but there's no
+// ordering between partitions. Each partition is an ordinary track with its own offsets,
+// named after the partitioned track's id and the partition number
+type PartitionedTrack struct {
+	Partitions []*Track
+	key        func(msg []byte) []byte
+	cond       *sync.Cond // Broadcast whenever any partition commits a message or closes
+}
+
+// A PartitionedMessage is a message read from one partition of a PartitionedTrack
+type PartitionedMessage struct {
+	Partition int
+	Offset    uint64
+	Data      []byte
+}
+
+// Create a new track with n partitions. key picks out the part of each message which
+// decides its partition. If it's nil, messages are partitioned by the key of the keyed
+// message they hold, and messages which aren't keyed all go to the first partition
+func NewPartitionedTrack(root, id string, n int, key func(msg []byte) []byte) *PartitionedTrack {
+	p, err := NewPartitionedTrackWithConfig(root, id, n, key, DefaultTrackConfig())
+	utils.Check(err)
+	return p
+}
+
+func NewPartitionedTrackWithConfig(root, id string, n int, key func(msg []byte) []byte, config TrackConfig) (*PartitionedTrack, error) {
+	return newPartitionedTrack(root, id, n, key, config, NewTrackWithConfig)
+}
+
+// Open an existing track with n partitions, which must be the number it was created with
+func OpenPartitionedTrack(root, id string, n int, key func(msg []byte) []byte) *PartitionedTrack {
+	p, err := OpenPartitionedTrackWithConfig(root, id, n, key, DefaultTrackConfig())
+	utils.Check(err)
+	return p
+}
+
+func OpenPartitionedTrackWithConfig(root, id string, n int, key func(msg []byte) []byte, config TrackConfig) (*PartitionedTrack, error) {
+	return newPartitionedTrack(root, id, n, key, config, OpenTrackWithConfig)
+}
+
+func newPartitionedTrack(root, id string, n int, key func(msg []byte) []byte, config TrackConfig,
+	create func(root, id string, config TrackConfig) (*Track, error)) (*PartitionedTrack, error) {
+	if n <= 0 {
+		return nil, errors.New("A partitioned track needs at least one partition")
+	}
+	if key == nil {
+		key = messageKey
+	}
+	p := &PartitionedTrack{
+		Partitions: make([]*Track, 0, n),
+		key:        key,
+		cond:       &sync.Cond{L: &sync.Mutex{}},
+	}
+	onCommit := config.OnCommit
+	config.OnCommit = func(offset uint64, msg []byte) {
+		if onCommit != nil {
+			onCommit(offset, msg)
+		}
+		p.broadcast()
+	}
+	for i := 0; i < n; i++ {
+		t, err := create(root, partitionId(id, i), config)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.Partitions = append(p.Partitions, t)
+	}
+	return p, nil
+}
+
+// The id of a partition's track. The trailing separator keeps the chunk files of
+// partition 1 from being mistaken for those of partition 11
+func partitionId(id string, i int) string {
+	return fmt.Sprintf("%s.%d.", id, i)
+}
+
+// The key of a keyed message, or nil if it isn't one
+func messageKey(msg []byte) []byte {
+	m, err := ParseMessage(msg)
+	if err != nil {
+		return nil
+	}
+	return m.Key
+}
+
+// Partition returns the partition the message would be written to
+func (p *PartitionedTrack) Partition(msg []byte) int {
+	key := p.key(msg)
+	if key == nil {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(p.Partitions)))
+}
+
+// WriteMessage hands the message to its partition's writer
+func (p *PartitionedTrack) WriteMessage(msg []byte) error {
+	return p.Partitions[p.Partition(msg)].WriteMessage(msg)
+}
+
+// Append writes the message, and waits for it to be committed to its partition.
+// Returns the partition and the message's offset within it
+func (p *PartitionedTrack) Append(msg []byte) (int, uint64, error) {
+	i := p.Partition(msg)
+	offset, err := p.Partitions[i].commit(writeRequest{data: msg})
+	return i, offset, err
+}
+
+// LatestOffsets returns the latest offset of each partition
+func (p *PartitionedTrack) LatestOffsets() []uint64 {
+	offsets := make([]uint64, len(p.Partitions))
+	for i, t := range p.Partitions {
+		offsets[i] = t.LatestOffset()
+	}
+	return offsets
+}
+
+// Close all of the partitions, waiting for their writers to finish.
+// Returns the first error from any of them
+func (p *PartitionedTrack) Close() error {
+	var err error
+	for _, t := range p.Partitions {
+		err = firstErr(err, t.Close())
+	}
+	p.broadcast() // Wake merged readers so they can see EOF
+	return err
+}
+
+func (p *PartitionedTrack) broadcast() {
+	p.cond.L.Lock()
+	p.cond.Broadcast()
+	p.cond.L.Unlock()
+}
+
+// PARTITIONED READER -- Reads every partition, in whatever order messages become available
+type PartitionedReader struct {
+	parent  *PartitionedTrack
+	readers []*StorageReader
+	next    int // The partition to check first, so that every partition gets a turn
+}
+
+// Reader returns a reader starting from the earliest message in each partition
+func (p *PartitionedTrack) Reader() (*PartitionedReader, error) {
+	offsets := make([]uint64, len(p.Partitions))
+	for i, t := range p.Partitions {
+		offsets[i] = t.EarliestOffset()
+	}
+	return p.ReaderAt(offsets)
+}
+
+// ReaderAt returns a reader starting from the given offset in each partition
+func (p *PartitionedTrack) ReaderAt(offsets []uint64) (*PartitionedReader, error) {
+	if len(offsets) != len(p.Partitions) {
+		return nil, fmt.Errorf("Expected %d offsets, one for each partition, but got %d", len(p.Partitions), len(offsets))
+	}
+	r := &PartitionedReader{parent: p, readers: make([]*StorageReader, 0, len(offsets))}
+	for i, t := range p.Partitions {
+		sr, err := t.ReaderAt(offsets[i])
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.readers = append(r.readers, sr)
+	}
+	return r, nil
+}
+
+// Next returns the next message from any partition, taking turns between partitions
+// which have messages waiting. Blocks until a message is available, and returns io.EOF
+// once every partition has been read to the end and closed. Next is not thread-safe
+func (r *PartitionedReader) Next() (PartitionedMessage, error) {
+	p := r.parent
+	p.cond.L.Lock()
+	for {
+		finished := true
+		for i := range r.readers {
+			j := (r.next + i) % len(r.readers)
+			sr, t := r.readers[j], p.Partitions[j]
+			offset := atomic.LoadUint64(&sr.Offset)
+			if offset < t.LatestOffset() {
+				p.cond.L.Unlock()
+				r.next = j + 1
+				data, err := sr.Next()
+				return PartitionedMessage{Partition: j, Offset: offset, Data: data}, err
+			}
+			finished = finished && t.finished()
+		}
+		if finished {
+			p.cond.L.Unlock()
+			return PartitionedMessage{}, io.EOF
+		}
+		p.cond.Wait()
+	}
+}
+
+// Offsets returns the offset the reader has reached in each partition
+func (r *PartitionedReader) Offsets() []uint64 {
+	offsets := make([]uint64, len(r.readers))
+	for i, sr := range r.readers {
+		offsets[i] = atomic.LoadUint64(&sr.Offset)
+	}
+	return offsets
+}
+
+func (r *PartitionedReader) Close() error {
+	var err error
+	for _, sr := range r.readers {
+		err = firstErr(err, sr.Close())
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package track
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func cleanupPartitions(n int) {
+	for i := 0; i < n; i++ {
+		cleanupTrackId(partitionId("id", i))
+	}
+}
+
+func TestPartitionedTrack(t *testing.T) {
+	cleanupPartitions(4)
+	p := NewPartitionedTrack("", "id", 4, nil)
+	partitions := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i%10)
+		partition, _, err := p.Append(KeyedMessage([]byte(key), []byte(fmt.Sprintf("%d", i))).Bytes())
+		testutils.CheckErr(err, t)
+		if seen, ok := partitions[key]; ok {
+			testutils.CheckInt(seen, partition, t)
+		}
+		partitions[key] = partition
+	}
+	var total uint64
+	for _, offset := range p.LatestOffsets() {
+		total += offset
+	}
+	testutils.CheckUint64(100, total, t)
+
+	// Reading merges the partitions, keeping each key's messages in order
+	r, err := p.Reader()
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	last := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		pm, err := r.Next()
+		testutils.CheckErr(err, t)
+		m, err := ParseMessage(pm.Data)
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(partitions[string(m.Key)], pm.Partition, t)
+		var value int
+		fmt.Sscanf(string(m.Value), "%d", &value)
+		if prev, ok := last[string(m.Key)]; ok {
+			testutils.CheckInt(prev+10, value, t)
+		}
+		last[string(m.Key)] = value
+	}
+	testutils.CheckInt(10, len(last), t)
+
+	// The reader waits for new messages, and sees EOF once the track is closed
+	go func() {
+		p.WriteMessage(KeyedMessage([]byte("late"), testData).Bytes())
+		p.Close()
+	}()
+	pm, err := r.Next()
+	testutils.CheckErr(err, t)
+	m, err := ParseMessage(pm.Data)
+	testutils.CheckErr(err, t)
+	testutils.CheckString("late", string(m.Key), t)
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected EOF once every partition is closed", t)
+
+	// Reopening finds the same partitions
+	p, err = OpenPartitionedTrackWithConfig("", "id", 4, nil, DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	total = 0
+	for _, offset := range p.LatestOffsets() {
+		total += offset
+	}
+	testutils.CheckUint64(101, total, t)
+	testutils.CheckErr(p.Close(), t)
+	cleanupPartitions(4)
+}
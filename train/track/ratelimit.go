@@ -0,0 +1,47 @@
+package track
+
+import (
+	"time"
+)
+
+// A token bucket which refills at rate tokens per second, holding at most a tenth of
+// a second's worth. Taking more tokens than the bucket holds puts it into debt, which
+// the next take waits to pay off, so a single write larger than the bucket still goes
+// through, but the average rate never exceeds the limit
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Returns nil if rate is 0, meaning there's no limit
+func newRateLimiter(rate uint64) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	burst := float64(rate) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Block until n tokens may be spent, and spend them. A nil limiter never blocks
+func (l *rateLimiter) take(n uint64) {
+	if l == nil {
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 0 {
+		// Still paying off the last write
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+		l.tokens, l.last = 0, time.Now()
+	}
+	l.tokens -= float64(n)
+}
@@ -0,0 +1,196 @@
+package track
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// With read-ahead, a goroutine reads the messages after the reader's offset into memory
+// before they're asked for, so that reads don't wait on the disk. It reads them with a
+// reader of its own, and hands them over through a buffered channel. Whenever the reader
+// moves on to the next message, it takes one from the channel instead of reading its
+// chunk, so everything else about reading works as before
+
+// Open the chunk to read from the message with the given index. Tests replace it to slow
+// reads down
+var openChunk = (*FileStorage).ReaderAt
+
+// A message read ahead of the reader
+type prefetched struct {
+	offset uint64
+	size   uint64 // The whole size of the message. The data is only the rest of it if the read started part way through
+	data   []byte
+	err    error
+	gen    uint64 // The track's truncations when the message was read
+}
+
+// Returned to the goroutine reading ahead when it's stopped while waiting for messages
+var errReadAheadStopped = errors.New("Read-ahead was stopped")
+
+type readAhead struct {
+	inner *StorageReader // Reads the messages ahead
+	msgs  chan prefetched
+	stop  chan struct{} // Closed to stop the goroutine
+	done  chan struct{} // Closed once the goroutine has stopped
+	size  uint64        // The size of the message the reader is part way through
+}
+
+// SetReadAhead makes the reader read up to n messages ahead in the background, so that
+// reads return them from memory. The messages read ahead are dropped by SeekTo and
+// SeekToLatest, and read again from the new offset. With read-ahead, TryRead only returns
+// messages which have already been read ahead. n of 0 turns read-ahead off.
+// SetReadAhead is thread-safe
+func (sr *StorageReader) SetReadAhead(n int) error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	err := sr.dropSub()
+	sr.readAhead = n
+	return err
+}
+
+// SeekTo moves the reader to the given offset, so that the next read returns the message
+// there. SeekTo is thread-safe
+func (sr *StorageReader) SeekTo(offset uint64) error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	err := sr.dropSub()
+	sr.partial = 0
+	t := sr.parent
+	t.dataCond.L.Lock()
+	sr.truncated = false
+	atomic.StoreUint64(&sr.Offset, offset)
+	t.dataCond.L.Unlock()
+	sr.restartOffsetCheck()
+	return err
+}
+
+// Take the next message which has been read ahead, in place of findNext. The messages are
+// read ahead from the current offset, starting the goroutine if it isn't running
+func (sr *StorageReader) nextPrefetched(block bool) (uint64, error) {
+	if sr.currentSub != nil {
+		return sr.ahead.size, nil // Still reading the last message taken
+	}
+	var p prefetched
+	for {
+		if sr.ahead == nil {
+			sr.startReadAhead()
+		}
+		if block {
+			p = <-sr.ahead.msgs
+		} else {
+			select {
+			case p = <-sr.ahead.msgs:
+			default:
+				return 0, ErrWouldBlock
+			}
+		}
+		if p.err != nil {
+			// The goroutine has stopped, so the next read starts it again
+			sr.stopReadAhead()
+			return 0, p.err
+		}
+		t := sr.parent
+		t.dataCond.L.Lock()
+		current := p.gen == t.truncations
+		t.dataCond.L.Unlock()
+		if current {
+			break
+		}
+		// The track has been truncated since, so the message may be gone
+		sr.stopReadAhead()
+	}
+	sr.ahead.size = p.size
+	sr.currentSub = ioutil.NopCloser(bytes.NewReader(p.data))
+	sr.subEnd = p.offset + 1 // So that it's dropped once the message has been read
+	return p.size, nil
+}
+
+func (sr *StorageReader) startReadAhead() {
+	inner := &StorageReader{
+		Id:          sr.Id + "-ahead",
+		parent:      sr.parent,
+		Offset:      sr.Offset,
+		OnlyDurable: sr.OnlyDurable,
+		snapshot:    sr.snapshot,
+		snapshotEnd: sr.snapshotEnd,
+		partial:     sr.partial,
+		mutex:       &sync.Mutex{},
+	}
+	if sr.verify != nil {
+		check := *sr.verify // The inner reader counts for itself
+		inner.verify = &check
+	}
+	ra := &readAhead{
+		inner: inner,
+		msgs:  make(chan prefetched, sr.readAhead),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	sr.ahead = ra
+	go func() {
+		defer close(ra.done)
+		defer inner.Close()
+		for {
+			p := inner.prefetch()
+			select {
+			case ra.msgs <- p:
+			case <-ra.stop:
+				return
+			}
+			if p.err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Read the next message, or the rest of it if the reader is part way through it
+func (sr *StorageReader) prefetch() (p prefetched) {
+	defer recoverPanic(&p.err)
+	t := sr.parent
+	t.dataCond.L.Lock()
+	p.gen = t.truncations
+	t.dataCond.L.Unlock()
+	p.offset = sr.Offset
+	p.size, p.err = sr.findNext(true)
+	if p.err == nil {
+		p.data = make([]byte, p.size-sr.partial)
+		p.err = sr.readNext(p.data)
+		if p.err == nil {
+			p.err = sr.takeNext(p.data, p.size)
+		}
+	}
+	return p
+}
+
+// Stop reading ahead, and drop the messages read so far
+func (sr *StorageReader) stopReadAhead() {
+	ra := sr.ahead
+	if ra == nil {
+		return
+	}
+	sr.ahead = nil
+	t := sr.parent
+	close(ra.stop)
+	// Wake the goroutine if it's waiting for messages to be written
+	t.dataCond.L.Lock()
+	ra.inner.stopped = true
+	t.dataCond.L.Unlock()
+	t.dataCond.Broadcast()
+	<-ra.done
+}
+
+// Close the chunk the reader is part way through, so that the next read reopens it at the
+// current offset. Anything read ahead is dropped
+func (sr *StorageReader) dropSub() error {
+	sr.stopReadAhead()
+	var err error
+	if sr.currentSub != nil {
+		err = sr.currentSub.Close()
+		sr.currentSub = nil
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package track
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+	"github.com/asp2insp/go-misc/utils"
+)
+
+func TestReadAhead(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 8
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 50)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteMessages(msgs)
+	testutils.CheckErr(err, t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.CheckErr(r.SetReadAhead(5), t)
+	buf := make([]byte, 64)
+	expect := func(i int) {
+		n, err := r.Read(buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckString(string(msgs[i]), string(buf[:n]), t)
+	}
+	for i := 0; i < 10; i++ {
+		expect(i)
+	}
+	testutils.CheckUint64(10, r.Offset, t)
+
+	// Seeking drops the messages read ahead, both forwards and back
+	testutils.CheckErr(r.SeekTo(30), t)
+	expect(30)
+	expect(31)
+	testutils.CheckErr(r.SeekTo(5), t)
+	expect(5)
+
+	// Part way through a message, the rest of it comes next, and a seek starts afresh
+	r.PartialReads = true
+	n, err := r.Read(buf[:4])
+	testutils.CheckErr(err, t)
+	testutils.CheckString("mess", string(buf[:n]), t)
+	size, err := r.PeekSize()
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(uint64(len(msgs[6])), size, t)
+	n, err = r.Read(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckString("age 6", string(buf[:n]), t)
+	n, err = r.Read(buf[:4])
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(r.SeekTo(20), t)
+	expect(20)
+	r.PartialReads = false
+
+	// Turning read-ahead off and on carries on from the same place
+	testutils.CheckErr(r.SetReadAhead(0), t)
+	expect(21)
+	testutils.CheckErr(r.SetReadAhead(3), t)
+	expect(22)
+
+	// At the tail it waits for new messages like any other reader
+	testutils.CheckErr(r.SeekToLatest(), t)
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == ErrWouldBlock, fmt.Sprintf("Expected ErrWouldBlock at the tail, got %v", err), t)
+	done := make(chan error)
+	go func() {
+		msg, err := r.Next()
+		if err == nil && string(msg) != "new" {
+			err = fmt.Errorf("Expected new but got %s", msg)
+		}
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, err = track.WriteMessageCommit([]byte("new"))
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(<-done, t)
+	testutils.CheckErr(track.Close(), t)
+	_, err = r.Read(buf)
+	testutils.ExpectTrue(err == io.EOF, fmt.Sprintf("Expected io.EOF once the track is closed, got %v", err), t)
+}
+
+// Sleeps before every read, like a slow disk
+type slowReader struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.ReadCloser.Read(p)
+}
+
+func benchmarkSlowReads(readAhead int, b *testing.B) {
+	defer func(open func(*FileStorage, uint64) (io.ReadCloser, error)) { openChunk = open }(openChunk)
+	openChunk = func(store *FileStorage, index uint64) (io.ReadCloser, error) {
+		r, err := store.ReaderAt(index)
+		return &slowReader{r, 50 * time.Microsecond}, err
+	}
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 1000)
+	for i := range msgs {
+		msgs[i] = []byte("Hello World")
+	}
+	for i := 0; i < b.N; i += len(msgs) {
+		_, err := track.WriteMessages(msgs)
+		utils.Check(err)
+	}
+	r, err := track.ReaderAt(0)
+	utils.Check(err)
+	defer r.Close()
+	utils.Check(r.SetReadAhead(readAhead))
+	buf := make([]byte, 64)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := r.Read(buf)
+		utils.Check(err)
+		time.Sleep(50 * time.Microsecond) // Process the message
+	}
+}
+
+func BenchmarkSlowReads(b *testing.B) {
+	benchmarkSlowReads(0, b)
+}
+
+func BenchmarkSlowReadsWithReadAhead(b *testing.B) {
+	benchmarkSlowReads(16, b)
+}
@@ -0,0 +1,99 @@
+package track
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+// RestoreTrackMerged creates a new track with the given root and id from snapshots in the
+// format written by WriteTo and Tee, which may overlap. Snapshots are read in the order
+// given, so they should be oldest first, and each message is kept only the first time its
+// key is seen, so the result has no duplicates and keeps the order the messages were
+// first written in. keyOf returns the key of a message; if it's nil, each message is its
+// own key. Returns the new track, still open for writing. If the restore fails, the new
+// track's files are deleted
+func RestoreTrackMerged(root, id string, snapshots []io.Reader, keyOf func([]byte) []byte) (*Track, error) {
+	if keyOf == nil {
+		keyOf = func(msg []byte) []byte { return msg }
+	}
+	t, err := NewTrackWithConfig(root, id, DefaultTrackConfig())
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		r := bufio.NewReader(snapshot)
+		for {
+			msg, err := readFramed(r)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.discard()
+				return nil, err
+			}
+			key := string(keyOf(msg))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			err = t.WriteMessage(msg)
+			if err != nil {
+				t.discard()
+				return nil, err
+			}
+		}
+	}
+	// Any write which failed has stopped the writer, which Sync reports
+	err = t.Sync()
+	if err != nil {
+		t.discard()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Close a track which failed part way through being restored, and delete its files
+func (t *Track) discard() {
+	t.Close() // Any error is from the failure being cleaned up after
+	chunks, _ := discoverChunks(t.RootPath, t.Id, t.namer())
+	for _, n := range chunks {
+		removeStorage(t.chunkFile(n), t.RootPath)
+	}
+	os.Remove(manifestName(t.RootPath, t.Id))
+	os.Remove(keyIndexName(t.RootPath, t.Id))
+}
+
+// Messages up to this size are read into a buffer allocated up front. Bigger ones are read
+// into a buffer which grows as the data arrives, so that a corrupt length can't make us
+// allocate more than the stream holds
+const maxFramedPrealloc = 1 << 20
+
+// Read the next message from a stream of messages framed by their lengths as uvarints.
+// Returns io.EOF at the end of the stream, and io.ErrUnexpectedEOF if it ends part way
+// through a message, or if its length is more than the stream could hold
+func readFramed(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	} else if size > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if size <= maxFramedPrealloc {
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return msg, err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, int64(size))
+	if err == io.EOF || (err == nil && uint64(n) < size) {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
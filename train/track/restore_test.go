@@ -0,0 +1,106 @@
+package track
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+// Snapshot the track from the given offset in the format WriteTo writes
+func snapshotFrom(track *Track, offset uint64, t *testing.T) *bytes.Buffer {
+	r, err := track.ReaderSnapshotAt(offset)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	var buf bytes.Buffer
+	_, err = r.WriteTo(&buf)
+	testutils.CheckErr(err, t)
+	return &buf
+}
+
+func TestRestoreTrackMerged(t *testing.T) {
+	cleanupTrack()
+	cleanupTrackId("restored")
+	defer cleanupTrackId("restored")
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs[:6])
+	testutils.CheckErr(err, t)
+	older := snapshotFrom(track, 0, t)
+	_, err = track.WriteAllSync(msgs[6:])
+	testutils.CheckErr(err, t)
+	newer := snapshotFrom(track, 3, t)
+
+	restored, err := RestoreTrackMerged("", "restored", []io.Reader{older, newer}, nil)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(10, restored.LatestOffset(), t)
+	testutils.CheckErr(restored.Close(), t)
+	r, err := restored.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for _, expected := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(expected, msg, t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected no more messages", t)
+}
+
+func TestRestoreTrackMergedByKey(t *testing.T) {
+	cleanupTrackId("restored")
+	defer cleanupTrackId("restored")
+	var first, second bytes.Buffer
+	for _, msg := range []string{"a:1", "b:1"} {
+		writeFrame(&first, uint64(len(msg)))
+		first.WriteString(msg)
+	}
+	for _, msg := range []string{"b:2", "c:1"} {
+		writeFrame(&second, uint64(len(msg)))
+		second.WriteString(msg)
+	}
+	keyOf := func(msg []byte) []byte { return msg[:1] }
+	restored, err := RestoreTrackMerged("", "restored", []io.Reader{&first, &second}, keyOf)
+	testutils.CheckErr(err, t)
+	defer restored.Close()
+	testutils.CheckUint64(3, restored.LatestOffset(), t)
+	r, err := restored.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for _, expected := range []string{"a:1", "b:1", "c:1"} {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(expected, string(msg), t)
+	}
+
+	// A snapshot cut off part way through a message is rejected
+	cleanupTrackId("restored2")
+	defer cleanupTrackId("restored2")
+	truncated := bytes.NewReader([]byte{5, 'a', 'b'})
+	_, err = RestoreTrackMerged("", "restored2", []io.Reader{truncated}, nil)
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF, got %v", err), t)
+}
+
+func TestRestoreCorruptLength(t *testing.T) {
+	cleanupTrackId("restored")
+	defer cleanupTrackId("restored")
+	for _, size := range []uint64{1 << 40, 1<<63 + 1, ^uint64(0)} {
+		var snapshot bytes.Buffer
+		writeFrame(&snapshot, 1)
+		snapshot.WriteString("a")
+		writeFrame(&snapshot, size)
+		snapshot.WriteString("not that long")
+		_, err := RestoreTrackMerged("", "restored", []io.Reader{&snapshot}, nil)
+		testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF for length %d, got %v", size, err), t)
+		chunks, err := discoverChunks("", "restored", DefaultChunkNamer{})
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(0, len(chunks), t)
+		testutils.ExpectTrue(!exists(manifestName("", "restored")), "Expected the failed restore's manifest to be removed", t)
+	}
+}
@@ -0,0 +1,49 @@
+package track
+
+import (
+	"errors"
+)
+
+// ErrDiskFull is returned by writes to tracks with CheckDiskSpace set when the disk
+// doesn't have room for the message
+var ErrDiskFull = errors.New("Not enough disk space for the message")
+
+// Returns the number of bytes available to us on the filesystem holding the given
+// directory. Replaced in tests to simulate a full disk
+var freeSpace = diskFreeSpace
+
+// Check that there's room on disk for the given number of bytes of the track. If the
+// free space can't be found, for example on platforms without statfs, the write goes ahead
+func (t *Track) checkSpace(needed uint64) error {
+	if !t.config.CheckDiskSpace {
+		return nil
+	}
+	free, err := freeSpace(rootDir(t.RootPath))
+	if err == nil && free < needed {
+		return ErrDiskFull
+	}
+	return nil
+}
+
+// The bytes the message in the given request takes on disk. If it starts a new chunk,
+// that includes the chunk's header and preallocated space
+func chunkBytesNeeded(req writeRequest, newChunk bool) uint64 {
+	needed := uint64(len(req.data))
+	if req.source != nil {
+		needed = uint64(req.size)
+	}
+	for _, msg := range req.batch {
+		needed += uint64(len(msg))
+	}
+	if newChunk {
+		initial := (CHUNK_SIZE + 2 + _nExtra) * _nSize
+		if CHUNK_INITIAL_BYTES > initial {
+			initial = CHUNK_INITIAL_BYTES
+		}
+		if PAGE_ALIGN_FILES {
+			initial = pageAlign(initial)
+		}
+		needed += initial
+	}
+	return needed
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package track
+
+import (
+	"errors"
+)
+
+func diskFreeSpace(dir string) (uint64, error) {
+	return 0, errors.New("Free disk space isn't available on this platform")
+}
@@ -0,0 +1,45 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	defer func(f func(string) (uint64, error)) { freeSpace = f }(freeSpace)
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	var free uint64 = 1 << 30
+	freeSpace = func(string) (uint64, error) {
+		return free, nil
+	}
+	cleanupTrack()
+
+	config := DefaultTrackConfig()
+	config.CheckDiskSpace = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	for i := 0; i < 5; i++ {
+		_, err = track.WriteMessageCommit(testData)
+		testutils.CheckErr(err, t)
+	}
+
+	// Room for the message, but not for the chunk it would start
+	free = 1000
+	_, err = track.WriteMessageCommit(testData)
+	testutils.ExpectTrue(err == ErrDiskFull, fmt.Sprintf("Expected ErrDiskFull, got %v", err), t)
+	testutils.CheckInt(1, len(track.stores), t)
+	// No room at all
+	free = 10
+	err = track.WriteMessage(testData)
+	testutils.ExpectTrue(err == ErrDiskFull, fmt.Sprintf("Expected ErrDiskFull, got %v", err), t)
+	testutils.CheckUint64(5, track.LatestOffset(), t)
+
+	free = 1 << 30
+	offset, err := track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(5, offset, t)
+}
@@ -0,0 +1,162 @@
+package track
+
+import (
+	"errors"
+	"math/bits"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Number of buckets in a LatencyHistogram. The last bucket holds everything
+// from 2^30µs, which is about 18 minutes, up
+const latencyBuckets = 32
+
+// A LatencyHistogram counts durations in buckets which double in width. Bucket 0
+// counts durations under 1µs, and bucket i counts durations in [2^(i-1)µs, 2^iµs).
+// Recording a duration is a single atomic add, so the writer never allocates for it
+type LatencyHistogram struct {
+	Counts [latencyBuckets]uint64
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= latencyBuckets {
+		i = latencyBuckets - 1
+	}
+	atomic.AddUint64(&h.Counts[i], 1)
+}
+
+// Copy the counts, which may be changing underneath us
+func (h *LatencyHistogram) load() LatencyHistogram {
+	var c LatencyHistogram
+	for i := range h.Counts {
+		c.Counts[i] = atomic.LoadUint64(&h.Counts[i])
+	}
+	return c
+}
+
+// Count returns the total number of durations recorded
+func (h LatencyHistogram) Count() uint64 {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+// Quantile returns the upper bound of the bucket holding the qth quantile, so for
+// example Quantile(0.99) is at least as long as 99% of the recorded durations.
+// Returns 0 if nothing has been recorded
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	target := uint64(q * float64(total))
+	if target == 0 {
+		target = 1
+	}
+	var seen uint64
+	for i, n := range h.Counts {
+		seen += n
+		if seen >= target {
+			return time.Duration(uint64(1)<<uint(i)) * time.Microsecond
+		}
+	}
+	return time.Duration(uint64(1)<<(latencyBuckets-1)) * time.Microsecond
+}
+
+// Number of buckets in a SizeHistogram by default. The last bucket holds everything
+// over 2^31 bytes
+const sizeBuckets = 34
+
+// A SizeHistogram counts message sizes in buckets. Counts[i] counts sizes up to and
+// including Bounds[i], and over the bound before it. The last count, one more than there
+// are bounds, is for everything over the last bound. Like LatencyHistogram, recording a
+// size is a single atomic add
+type SizeHistogram struct {
+	Bounds []uint64
+	Counts []uint64
+}
+
+// Make a histogram with the given bounds, or by default with buckets which double in
+// width: Counts[0] counts empty messages, and Counts[i] sizes in (2^(i-2), 2^(i-1)]
+func newSizeHistogram(bounds []uint64) SizeHistogram {
+	if bounds == nil {
+		bounds = make([]uint64, sizeBuckets-1)
+		for i := 1; i < len(bounds); i++ {
+			bounds[i] = 1 << uint(i-1)
+		}
+	}
+	return SizeHistogram{Bounds: bounds, Counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *SizeHistogram) observe(size uint64) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return h.Bounds[i] >= size })
+	atomic.AddUint64(&h.Counts[i], 1)
+}
+
+// Copy the counts, which may be changing underneath us
+func (h *SizeHistogram) load() SizeHistogram {
+	c := SizeHistogram{Bounds: append([]uint64(nil), h.Bounds...), Counts: make([]uint64, len(h.Counts))}
+	for i := range h.Counts {
+		c.Counts[i] = atomic.LoadUint64(&h.Counts[i])
+	}
+	return c
+}
+
+// Count returns the total number of sizes recorded
+func (h SizeHistogram) Count() uint64 {
+	var total uint64
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+func checkSizeBuckets(config TrackConfig) error {
+	for i := 1; i < len(config.SizeBuckets); i++ {
+		if config.SizeBuckets[i] <= config.SizeBuckets[i-1] {
+			return errors.New("SizeBuckets must be in increasing order")
+		}
+	}
+	return nil
+}
+
+// TrackStats is a snapshot of how a track's writer has been performing
+type TrackStats struct {
+	// Number of times the writer has flushed to disk
+	Syncs uint64
+	// Number of queued messages dropped because Shutdown timed out, the track
+	// reached MaxChunks, or the writer stopped after a failed write
+	Dropped uint64
+	// Time from each message being handed to the writer until it was committed,
+	// which includes flushing it if it was written with WriteAllSync
+	CommitLatency LatencyHistogram
+	// Time from a message being handed to the writer until it was flushed to disk. Rather
+	// than one entry per message, each flush records the oldest message it made durable
+	DurableLatency LatencyHistogram
+	// Size in bytes of each message written, in the buckets set by SizeBuckets
+	MessageSizes SizeHistogram
+	// Number of sealed chunks rewritten by compaction, and the number and total size of the
+	// dead messages it dropped from them
+	Compactions       uint64
+	CompactedMessages uint64
+	CompactedBytes    uint64
+}
+
+// Stats returns the writer's counters and latency histograms so far
+func (t *Track) Stats() TrackStats {
+	return TrackStats{
+		Syncs:          atomic.LoadUint64(&t.syncs),
+		Dropped:        atomic.LoadUint64(&t.dropped),
+		CommitLatency:  t.commitLatency.load(),
+		DurableLatency: t.durableLatency.load(),
+		MessageSizes:   t.messageSizes.load(),
+
+		Compactions:       atomic.LoadUint64(&t.compactions),
+		CompactedMessages: atomic.LoadUint64(&t.compactedMessages),
+		CompactedBytes:    atomic.LoadUint64(&t.compactedBytes),
+	}
+}
@@ -0,0 +1,88 @@
+package track
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h LatencyHistogram
+	testutils.ExpectTrue(h.Quantile(0.5) == 0, "Expected an empty histogram to have no quantiles", t)
+	h.observe(0)
+	h.observe(3 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(time.Hour)
+	testutils.CheckUint64(4, h.Count(), t)
+	testutils.CheckUint64(1, h.Counts[0], t)
+	testutils.CheckUint64(1, h.Counts[2], t)
+	testutils.CheckUint64(1, h.Counts[latencyBuckets-1], t)
+	testutils.ExpectTrue(h.Quantile(0.5) == 4*time.Microsecond, "Expected the median in the 2-4µs bucket", t)
+	testutils.ExpectTrue(h.Quantile(0.75) >= time.Millisecond, "Expected the 75th percentile to cover 1ms", t)
+}
+
+func TestWriteLatencyStats(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	// Stall the writer on the first message, so everything queued behind it is slow
+	config.OnCommit = func(offset uint64, msg []byte) {
+		if offset == 0 {
+			time.Sleep(30 * time.Millisecond)
+		}
+	}
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	for i := 0; i < 5; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	testutils.CheckErr(track.Sync(), t)
+
+	stats := track.Stats()
+	testutils.CheckUint64(5, stats.CommitLatency.Count(), t)
+	testutils.ExpectTrue(stats.CommitLatency.Quantile(0.5) >= 30*time.Millisecond,
+		"Expected the stall to show up in the commit latencies", t)
+	testutils.CheckUint64(1, stats.DurableLatency.Count(), t)
+	testutils.ExpectTrue(stats.DurableLatency.Quantile(1) >= 30*time.Millisecond,
+		"Expected the stall to show up in the durable latency", t)
+	testutils.CheckUint64(1, stats.Syncs, t)
+}
+
+func TestMessageSizeStats(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.SizeBuckets = []uint64{10, 100, 1000}
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	for _, size := range []int{0, 10, 11, 100, 500, 1000, 1001, 5000} {
+		_, err = track.WriteMessageCommit(make([]byte, size))
+		testutils.CheckErr(err, t)
+	}
+	_, err = track.WriteMessages([][]byte{make([]byte, 50), make([]byte, 5)})
+	testutils.CheckErr(err, t)
+
+	sizes := track.Stats().MessageSizes
+	testutils.CheckUint64(10, sizes.Count(), t)
+	for i, want := range []uint64{3, 3, 2, 2} {
+		testutils.CheckUint64(want, sizes.Counts[i], t)
+	}
+
+	// By default the buckets double in width
+	h := newSizeHistogram(nil)
+	for _, size := range []uint64{0, 1, 2, 3, 4, 5, 1 << 31, 1<<31 + 1} {
+		h.observe(size)
+	}
+	testutils.CheckUint64(1, h.Counts[0], t)
+	testutils.CheckUint64(1, h.Counts[1], t)
+	testutils.CheckUint64(1, h.Counts[2], t)
+	testutils.CheckUint64(2, h.Counts[3], t)
+	testutils.CheckUint64(1, h.Counts[4], t)
+	testutils.CheckUint64(1, h.Counts[sizeBuckets-2], t)
+	testutils.CheckUint64(1, h.Counts[sizeBuckets-1], t)
+
+	config.SizeBuckets = []uint64{100, 10}
+	_, err = NewTrackWithConfig("", "other", config)
+	testutils.ExpectTrue(err != nil, "Buckets out of order should be refused", t)
+}
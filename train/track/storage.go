@@ -1,10 +1,18 @@
 package track
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asp2insp/go-misc/utils"
@@ -12,194 +20,1728 @@ import (
 
 // The track package is responsible for recording messages to a set of files.
 // Each file holds CHUNK_SIZE messages, except for the active file which begins empty and grows to hold
-// up to CHUNK_SIZE messages. Messages are stored in their entirety, with their wrapping.
+// up to CHUNK_SIZE messages. With CHUNK_INITIAL_CAPACITY set, the active file's header starts out smaller
+// too, and is grown as it fills. Messages are stored in their entirety, with their wrapping.
+// Chunks which were merged, or written with a different CHUNK_SIZE, may hold more or fewer messages,
+// so the offset of the first message in each chunk is found by summing the capacities before it.
+// Chunk files are numbered in order, but the numbers may have gaps if chunks were deleted, and reading
+// their offsets gives ErrOffsetTrimmed. A manifest lists the sealed chunks, so chunks deleted by hand
+// must be removed from it too, or opening the track fails with ErrManifestMismatch. Each chunk
+// records its base offset in its header, so the remaining chunks keep their offsets. Older chunks
+// without one are placed after the previous chunk, assuming that each missing chunk held CHUNK_SIZE
+// messages.
 
-// CHUNK_SIZE is chosen by experimentation. For small messages (~12 bytes) this was the best value
+// CHUNK_SIZE is chosen by experimentation. For small messages (~12 bytes) this was the best value.
+// For other message sizes, RecommendChunkSize picks one from the size chunk files should be
 var CHUNK_SIZE uint64 = 500 * 1000
 
+// CHUNK_INITIAL_BYTES is the number of bytes preallocated for each new chunk file.
+// 0 means a chunk starts out as a single page and grows with every write
+var CHUNK_INITIAL_BYTES uint64 = 0
+
+// CHUNK_INITIAL_CAPACITY is the number of messages a new chunk has room for at first. Each time it
+// fills up its capacity is doubled with Grow, until it reaches CHUNK_SIZE, so small tracks don't pay
+// for a full offset table. Growing copies the chunk, so it's cheapest with small messages.
+// 0 means chunks have room for CHUNK_SIZE messages from the start
+var CHUNK_INITIAL_CAPACITY uint64 = 0
+
+// ErrReadOnly is returned when writing to a track or storage which was opened read-only
+var ErrReadOnly = errors.New("Storage is read-only")
+
+// ErrOffsetTrimmed is returned when reading an offset whose chunk has been deleted
+var ErrOffsetTrimmed = errors.New("Offset has been trimmed from the track")
+
+// ErrCorruptIndex is returned by writes with ChecksOnWrite set if the offset table is inconsistent
+var ErrCorruptIndex = errors.New("Offset table is inconsistent with the data")
+
+// ErrFutureOffset is returned by ReaderAt for an offset past the end of a track which
+// can't be written to, so the offset will never exist
+var ErrFutureOffset = errors.New("Offset is past the end of a track which is no longer written")
+
+// ErrWouldBlock is returned by TryRead when there's no message yet, but there may be later
+var ErrWouldBlock = errors.New("No message is available yet")
+
+// ErrEmpty is returned by Last when the track has no messages
+var ErrEmpty = errors.New("Track is empty")
+
+// ErrTrackFull is returned when a track has no room for a message and isn't allowed to make any
+var ErrTrackFull = errors.New("Track is full")
+
+// ErrShortBuffer is returned by Read when the next message doesn't fit in the buffer.
+// The message isn't consumed, so use PeekSize to find how big a buffer is needed and retry
+var ErrShortBuffer = errors.New("Message does not fit into the available buffer")
+
+// A message waiting to be written. If committed is non-nil, the writer
+// sends the offset of the message on it once the message has been written,
+// or the error if it couldn't be written.
+// If sync is set, the message is flushed to disk before it is reported as committed.
+// If source is set, the message is copied from it instead of data.
+// If barrier is set, there is no message, and the request just waits for the
+// writer to get through the requests before it, flushing if sync is also set
+type writeRequest struct {
+	data      []byte
+	committed chan writeResult
+	sync      bool
+	source    io.Reader
+	size      int64
+	barrier   bool
+	truncate  bool // Asks the writer to drop the messages from offset on, see TruncateTo
+	offset    uint64
+	batch     [][]byte  // Messages written together by WriteMessages
+	reopen    bool      // Asks a failed writer to carry on
+	enqueued  time.Time // When the request was handed to the writer
+}
+
+type writeResult struct {
+	offset    uint64
+	timestamp int64 // Nanoseconds since the Unix epoch, if the track has Timestamps set
+	err       error
+}
+
 type Track struct {
 	stores    []*FileStorage
 	Id        string
 	RootPath  string
-	writeChan chan []byte
+	writeChan chan writeRequest
+	closed    chan error    // Receives the writer's first failure when it stops
+	abort     chan struct{} // Closed when Shutdown stops waiting, so the writer drops what's left
 	dataCond  *sync.Cond
 	alive     bool
+	readOnly  bool
+	config    TrackConfig
+	syncs     uint64 // Number of times the writer has flushed to disk, updated atomically
+	dropped   uint64 // Number of messages dropped by Shutdown, updated atomically
+	durable   uint64 // Offset just past the last message known to be flushed to disk
+	writerErr error  // Set while the writer is stopped by a failed write, until Reopen
+
+	commitLatency  LatencyHistogram
+	durableLatency LatencyHistogram
+	messageSizes   SizeHistogram
+	truncations    uint64 // Counts calls to TruncateTo which dropped messages, under dataCond.L
+
+	// Compaction's counters, updated atomically
+	compactions       uint64
+	compactedMessages uint64
+	compactedBytes    uint64
+
+	keys *keyIndex // Only set if the config asks for keys to be indexed
+
+	durableNotify []chan uint64 // Channels from DurableNotify, under dataCond.L
+
+	// Held while chunks are being merged
+	mergeMutex *sync.Mutex
+	// Held while the manifest is being rewritten
+	manifestMutex *sync.Mutex
+
+	// Open readers, tracked so we can report how far behind each one is
+	readers      map[*StorageReader]bool
+	readersMutex *sync.Mutex
+	nextReaderId uint64
 }
 
 func NewTrack(root, id string) *Track {
-	t := Track{
-		Id:       id,
-		RootPath: root,
-		stores:   make([]*FileStorage, 0),
-		dataCond: &sync.Cond{L: &sync.Mutex{}},
-		alive:    true,
+	t, err := NewTrackWithConfig(root, id, DefaultTrackConfig())
+	utils.Check(err)
+	return t
+}
+
+func NewTrackWithConfig(root, id string, config TrackConfig) (_ *Track, err error) {
+	defer recoverPanic(&err)
+	err = firstErr(checkChunkSize(), checkColumns(config), checkSizeBuckets(config), checkCompaction(config))
+	if err != nil {
+		return nil, err
 	}
-	t.startWriter(0)
-	return &t
+	t := newTrack(root, id)
+	t.config = config
+	t.alive = true
+	if config.IndexKeys {
+		t.keys = newKeyIndex()
+	}
+	t.startWriter()
+	t.startSweeper()
+	t.startCompactor()
+	return t, nil
 }
 
 func OpenTrack(root, id string) *Track {
-	t := Track{
-		Id:       id,
-		RootPath: root,
-		stores:   make([]*FileStorage, 0),
-		dataCond: &sync.Cond{L: &sync.Mutex{}},
-		alive:    true,
+	t, err := OpenTrackWithConfig(root, id, DefaultTrackConfig())
+	utils.Check(err)
+	return t
+}
+
+func OpenTrackWithConfig(root, id string, config TrackConfig) (_ *Track, err error) {
+	defer recoverPanic(&err)
+	err = firstErr(checkChunkSize(), checkColumns(config), checkSizeBuckets(config), checkCompaction(config))
+	if err != nil {
+		return nil, err
 	}
+	t := newTrack(root, id)
+	t.config = config
+	t.alive = true
 	// find and load all the stores
-	for i := 0; ; i++ {
-		storeId := fmt.Sprintf("%s%d", t.Id, i)
-		if !exists(fname(storeId, root)) {
+	chunks, err := discoverChunks(root, id, t.namer())
+	if err != nil {
+		return nil, err
+	}
+	chunks = t.pruneEmptyChunks(chunks, true)
+	prev := -1
+	for _, n := range chunks {
+		err = t.appendStoreAfter(Open(root, t.chunkFile(n)), n-prev-1)
+		if err != nil {
 			break
 		}
-		t.stores = append(t.stores, Open(root, storeId))
+		prev = n
 	}
-	var nextId uint64 = 0
-	if len(t.stores) > 0 {
-		nextId = uint64(len(t.stores))*CHUNK_SIZE + t.stores[len(t.stores)-1].Size
+	if err == nil {
+		err = t.dropMergedLeftovers(true)
+	}
+	if err == nil {
+		err = t.checkAppendOnly()
+	}
+	if err == nil {
+		err = t.checkManifest()
+	}
+	if err == nil && config.IndexKeys {
+		err = t.openKeyIndex()
+	}
+	if err != nil {
+		for _, store := range t.stores {
+			store.Close()
+		}
+		return nil, err
+	}
+	t.durable = t.LatestOffset() // Everything that survived being reopened is on disk
+	t.startWriter()
+	t.startSweeper()
+	t.startCompactor()
+	return t, nil
+}
+
+// OpenTrackReadOnly loads an existing track for inspection. All chunks are opened
+// read-only and no writer is started, so WriteMessage will always fail with ErrReadOnly.
+// Chunks are found by their default names, see ChunkNamer
+func OpenTrackReadOnly(root, id string) (_ *Track, err error) {
+	defer recoverPanic(&err)
+	err = checkChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	t := newTrack(root, id)
+	t.readOnly = true
+	chunks, err := discoverChunks(root, id, t.namer())
+	if err != nil {
+		return nil, err
+	}
+	chunks = t.pruneEmptyChunks(chunks, false)
+	prev := -1
+	for _, n := range chunks {
+		var store *FileStorage
+		store, err = OpenReadOnly(root, t.chunkFile(n))
+		if err != nil {
+			break
+		}
+		t.appendStoreAfter(store, n-prev-1) // Can't fail, the store is read-only
+		prev = n
+	}
+	if err == nil {
+		err = t.dropMergedLeftovers(false)
+	}
+	if err == nil {
+		err = t.checkAppendOnly()
+	}
+	if err == nil {
+		err = t.checkManifest()
+	}
+	if err != nil {
+		for _, store := range t.stores {
+			store.Close()
+		}
+		return nil, err
+	}
+	t.durable = t.LatestOffset()
+	return t, nil
+}
+
+// Drop the chunks whose messages all lie inside the sealed chunk before them. They're what
+// was left of a group of chunks when a merge was interrupted after the merged chunk had
+// taken the group's place, so they hold nothing it doesn't. They're deleted if remove is set
+func (t *Track) dropMergedLeftovers(remove bool) error {
+	kept := make([]*FileStorage, 0, len(t.stores))
+	for i, store := range t.stores {
+		if len(kept) > 0 {
+			prev := kept[len(kept)-1]
+			if prev.sealed && store.baseOffset >= prev.baseOffset && store.baseOffset+store.Size <= prev.baseOffset+prev.Size {
+				err := store.Close()
+				if remove {
+					err = firstErr(err, removeStorage(store.fileId, store.rootPath))
+				}
+				if err != nil {
+					t.stores = append(kept, t.stores[i+1:]...) // It's been closed
+					return err
+				}
+				continue
+			}
+		}
+		kept = append(kept, store)
+	}
+	t.stores = kept
+	return nil
+}
+
+// Check that the loaded chunks form a single unbroken run of messages. Only the last
+// chunk may have room left, otherwise there would be a hole in the offsets, and the
+// writer would resume somewhere other than the end of the track
+func (t *Track) checkAppendOnly() error {
+	for i := 0; i < len(t.stores)-1; i++ {
+		store, next := t.stores[i], t.stores[i+1]
+		if !store.IsFull() {
+			return fmt.Errorf("Track %s is inconsistent: chunk %s holds %d of %d messages but isn't the last chunk, and needs repair",
+				t.Id, store.fileId, store.Size, store.Capacity)
+		} else if next.baseOffset < store.baseOffset+store.Capacity {
+			return fmt.Errorf("Track %s is inconsistent: chunk %s starts at offset %d, inside chunk %s, and needs repair",
+				t.Id, next.fileId, next.baseOffset, store.fileId)
+		}
+	}
+	return nil
+}
+
+// Find the numbers of all of the chunk files belonging to the track, in ascending
+// order. There may be gaps in the numbers, for example if chunks were deleted
+func discoverChunks(root, id string, namer ChunkNamer) ([]int, error) {
+	files, err := ioutil.ReadDir(rootDir(root))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int]bool)
+	chunks := make([]int, 0)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if n, ok := namer.ParseChunkName(id, f.Name()); ok && !seen[n] {
+			seen[n] = true
+			chunks = append(chunks, n)
+		}
+	}
+	sort.Ints(chunks)
+	return chunks, nil
+}
+
+// Drop chunks from the end of the track which hold no messages, such as those left
+// by a crash just after a chunk was created. If remove is set their files are deleted,
+// so that the writer can replace them. Chunks which can't be checked are left for
+// opening to report
+func (t *Track) pruneEmptyChunks(chunks []int, remove bool) []int {
+	for len(chunks) > 0 {
+		storeId := t.chunkFile(chunks[len(chunks)-1])
+		empty, err := chunkIsEmpty(t.RootPath, storeId)
+		if err != nil || !empty {
+			break
+		}
+		if remove && removeStorage(storeId, t.RootPath) != nil {
+			break
+		}
+		chunks = chunks[:len(chunks)-1]
+	}
+	return chunks
+}
+
+// Whether the chunk file holds no messages. A crash just after creating a chunk
+// can leave a file whose header was never written, which also holds nothing
+func chunkIsEmpty(root, id string) (bool, error) {
+	f, err := os.Open(fname(id, root))
+	if err != nil {
+		return false, err
+	}
+	prefix := make([]byte, 2*_nSize)
+	n, err := f.ReadAt(prefix, 0)
+	f.Close()
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if n < 2*_nSize || (binary.LittleEndian.Uint64(prefix) == 0 && binary.LittleEndian.Uint64(prefix[_nSize:]) == 0) {
+		return true, nil // The header was never written
+	}
+	store, err := OpenReadOnly(root, id)
+	if err != nil {
+		return false, err
+	}
+	return store.Size == 0, nil
+}
+
+// Parse a chunk number from the part of a file name after the track id. Numbers
+// are written without leading zeros, so anything else belongs to another file
+func parseChunkNumber(s string) (int, bool) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// Chunk files are named by the track id, chunkSeparator and the chunk number. Older tracks
+// left out the separator, which is ambiguous for ids ending in digits: chunk 0 of log1 and
+// chunk 10 of log were both log10. Those names are still found when opening a track, but
+// new chunks always get the separator
+const chunkSeparator = ".chunk."
+
+// The file name of the track's chunk with the given number
+func chunkName(id string, n int) string {
+	return fmt.Sprintf("%s%s%d", id, chunkSeparator, n)
+}
+
+// The name the chunk with the given number had before chunk names had a separator
+func legacyChunkName(id string, n int) string {
+	return fmt.Sprintf("%s%d", id, n)
+}
+
+// The name of the existing file for the track's chunk with the given number, which is
+// the legacy name if only that exists
+func existingChunkName(root, id string, n int) string {
+	name := chunkName(id, n)
+	if !exists(fname(name, root)) && exists(fname(legacyChunkName(id, n), root)) {
+		return legacyChunkName(id, n)
+	}
+	return name
+}
+
+// Parse the chunk number out of the name of one of the track's chunk files,
+// which may be a legacy name
+func parseChunkName(id, name string) (int, bool) {
+	if !strings.HasPrefix(name, id) {
+		return 0, false
+	} else if strings.HasPrefix(name[len(id):], chunkSeparator) {
+		return parseChunkNumber(name[len(id)+len(chunkSeparator):])
+	}
+	return parseChunkNumber(name[len(id):])
+}
+
+// The file name for a new chunk with the given number
+func (t *Track) chunkId(n int) string {
+	return t.namer().ChunkName(t.Id, n)
+}
+
+// The number of the given chunk, parsed back out of its file name
+func (t *Track) chunkNumber(store *FileStorage) int {
+	n, _ := t.namer().ParseChunkName(t.Id, store.fileId)
+	return n
+}
+
+// New chunks are created with CHUNK_SIZE capacity, so it must leave room for at least one message
+func checkChunkSize() error {
+	if CHUNK_SIZE == 0 {
+		return errors.New("CHUNK_SIZE must be greater than 0")
+	}
+	return nil
+}
+
+// Create the in-memory state shared by all tracks, without any stores or writer
+func newTrack(root, id string) *Track {
+	return &Track{
+		Id:            id,
+		RootPath:      root,
+		config:        DefaultTrackConfig(),
+		stores:        make([]*FileStorage, 0),
+		dataCond:      &sync.Cond{L: &sync.Mutex{}},
+		readers:       make(map[*StorageReader]bool),
+		readersMutex:  &sync.Mutex{},
+		mergeMutex:    &sync.Mutex{},
+		manifestMutex: &sync.Mutex{},
+	}
+}
+
+// Add the store to the end of the track, starting where the previous store ends
+func (t *Track) appendStore(store *FileStorage) error {
+	return t.appendStoreAfter(store, 0)
+}
+
+// Add the store to the end of the track at the base offset recorded in its header.
+// Stores without one are placed after the given number of missing chunks, each of
+// which is assumed to have held CHUNK_SIZE messages
+func (t *Track) appendStoreAfter(store *FileStorage, missing int) error {
+	base, ok := store.recordedBaseOffset()
+	if !ok {
+		base = t.endOffset() + uint64(missing)*CHUNK_SIZE
 	}
-	t.startWriter(nextId)
-	return &t
+	t.stores = append(t.stores, store)
+	return store.setBaseOffset(base)
+}
+
+// The offset just past the last message that the existing stores have room for
+func (t *Track) endOffset() uint64 {
+	if len(t.stores) == 0 {
+		return 0
+	}
+	last := t.stores[len(t.stores)-1]
+	return last.baseOffset + last.Capacity
+}
+
+// Find the chunk holding the given offset, and the index of the message within that chunk.
+// Offsets beyond the existing chunks are placed in future chunks of CHUNK_SIZE messages.
+// Returns a chunk of -1 if the offset belongs to a chunk which is missing.
+// Must be called with dataCond.L held
+func (t *Track) locate(offset uint64) (int, uint64) {
+	i := sort.Search(len(t.stores), func(i int) bool {
+		return t.stores[i].baseOffset+t.stores[i].Capacity > offset
+	})
+	if i < len(t.stores) {
+		if offset < t.stores[i].baseOffset {
+			return -1, 0
+		}
+		return i, offset - t.stores[i].baseOffset
+	}
+	remainder := offset - t.endOffset()
+	return len(t.stores) + int(remainder/CHUNK_SIZE), remainder % CHUNK_SIZE
+}
+
+// ResolveOffset finds where the message with the given offset is stored: the position of
+// its chunk among the track's chunks, its index within the chunk, and the path of the
+// chunk's file. Offsets which have been trimmed give ErrOffsetTrimmed. Offsets past the
+// end of the track resolve as long as they'd be written to the last chunk
+func (t *Track) ResolveOffset(offset uint64) (chunkIndex int, internalIndex uint64, path string, err error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	n, i := t.locate(offset)
+	if n < 0 {
+		return 0, 0, "", ErrOffsetTrimmed
+	} else if n >= len(t.stores) {
+		return 0, 0, "", fmt.Errorf("Offset %d is past the last chunk of the track", offset)
+	}
+	store := t.stores[n]
+	return n, i, fname(store.fileId, store.rootPath), nil
 }
 
 func (t *Track) WriteMessage(data []byte) (err error) {
+	defer recoverPanic(&err)
+	return t.enqueue(writeRequest{data: data})
+}
+
+// WriteMessageCommit writes the given message and waits for the writer to store it,
+// returning its offset, or the error which stopped it being stored. Unlike WriteAllSync,
+// it doesn't wait for the message to be flushed to disk
+func (t *Track) WriteMessageCommit(data []byte) (uint64, error) {
+	return t.commit(writeRequest{data: data})
+}
+
+// AppendAndReader writes the given message, waits for it to be assigned an offset,
+// and returns that offset along with a reader positioned at the message
+func (t *Track) AppendAndReader(data []byte) (offset uint64, r *StorageReader, err error) {
+	offset, err = t.WriteMessageCommit(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	r, err = t.ReaderAt(offset)
+	return offset, r, err
+}
+
+// WriteMessageFrom streams size bytes from r into the track as a single message,
+// without holding the whole message in memory. It blocks until the message has been
+// written and returns its offset. r is read from the writer goroutine, so a slow
+// reader will hold up other writes to the track
+func (t *Track) WriteMessageFrom(r io.Reader, size int64) (uint64, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("Invalid message size %d", size)
+	}
+	return t.commit(writeRequest{source: r, size: size})
+}
+
+// WriteAllSync writes all of the given messages, and blocks until they have been
+// written and flushed to disk. Returns the offset of the first message
+func (t *Track) WriteAllSync(msgs [][]byte) (firstOffset uint64, err error) {
+	if len(msgs) == 0 {
+		return 0, errors.New("No messages to write")
+	}
+	first := make(chan writeResult, 1)
+	last := make(chan writeResult, 1)
+	for i, msg := range msgs {
+		req := writeRequest{data: msg}
+		if i == 0 {
+			req.committed = first
+		}
+		if i == len(msgs)-1 {
+			// Flushing the last message covers all the others, since
+			// the writer flushes each chunk before sealing it
+			req.committed = last
+			req.sync = true
+		}
+		err = t.enqueue(req)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(msgs) == 1 {
+		result := <-last
+		return result.offset, result.err
+	}
+	result := <-first
+	if result.err != nil {
+		return 0, result.err
+	}
+	firstOffset = result.offset
+	result = <-last
+	return firstOffset, result.err
+}
+
+// WriteMessages writes the given messages in order, and waits for the writer to store
+// them, returning the offset of the first. The messages bound for each chunk go to it in
+// a single write, which is much cheaper than a write per message when they're small.
+// If a write fails part way through, the messages in the chunks before it are kept
+func (t *Track) WriteMessages(msgs [][]byte) (firstOffset uint64, err error) {
+	defer recoverPanic(&err)
+	if len(msgs) == 0 {
+		return 0, errors.New("No messages to write")
+	}
+	return t.commit(writeRequest{batch: msgs})
+}
+
+// Enqueue the request and block until the writer reports its offset
+func (t *Track) commit(req writeRequest) (uint64, error) {
+	result := t.commitResult(req)
+	return result.offset, result.err
+}
+
+// Like commit, returning everything the writer reports
+func (t *Track) commitResult(req writeRequest) writeResult {
+	req.committed = make(chan writeResult, 1)
+	err := t.enqueue(req)
+	if err != nil {
+		return writeResult{err: err}
+	}
+	return <-req.committed
+}
+
+// Hand the request to the writer goroutine
+func (t *Track) enqueue(req writeRequest) (err error) {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	if !req.reopen {
+		t.dataCond.L.Lock()
+		err = t.writerErr
+		if err == nil && !req.barrier && t.isFull() {
+			err = ErrTrackFull
+		}
+		t.dataCond.L.Unlock()
+		if err == nil && !req.barrier {
+			err = t.checkSpace(chunkBytesNeeded(req, false))
+		}
+		if err != nil {
+			return err
+		}
+	}
 	defer func() {
 		if r := recover(); r != nil {
 			err = errors.New("Track is closed, could not write message")
 		}
 	}()
-	t.writeChan <- data
+	req.enqueued = time.Now()
+	t.writeChan <- req
 	return nil
 }
 
-func (t *Track) ReaderAt(offset uint64) (io.ReadCloser, error) {
+// ReaderAt returns a reader positioned at the given offset. If the track is closed or
+// read-only, nothing more will be written, so offsets past its end give ErrFutureOffset
+func (t *Track) ReaderAt(offset uint64) (_ *StorageReader, err error) {
+	defer recoverPanic(&err)
 	if offset < 0 {
 		return nil, fmt.Errorf("Offset out of bounds: %d", offset)
 	}
+	t.dataCond.L.Lock()
+	future := t.isFinished() && offset > t.latestOffset()
+	t.dataCond.L.Unlock()
+	if future {
+		// A reader there would only ever see EOF
+		return nil, ErrFutureOffset
+	}
 	r := &StorageReader{
 		parent: t,
 		Offset: offset,
 		mutex:  &sync.Mutex{},
 	}
-	chunkIndex := offset / CHUNK_SIZE
-	msgIndex := offset % CHUNK_SIZE
-	if chunkIndex < uint64(len(t.stores)) && uint64(msgIndex) < t.stores[chunkIndex].Size {
-		var err error
-		r.currentSub, err = t.stores[chunkIndex].ReaderAt(msgIndex)
-		utils.Check(err)
+	t.readersMutex.Lock()
+	r.Id = fmt.Sprintf("%s-reader%d", t.Id, t.nextReaderId)
+	t.nextReaderId++
+	t.readers[r] = true
+	t.readersMutex.Unlock()
+	return r, nil
+}
+
+// ReaderSnapshotAt returns a reader positioned at the given offset which only sees the
+// messages in the track when it was created. Once it reaches what was then the latest
+// offset it returns io.EOF, rather than waiting for messages written since
+func (t *Track) ReaderSnapshotAt(offset uint64) (*StorageReader, error) {
+	end := t.LatestOffset()
+	r, err := t.ReaderAt(offset)
+	if err != nil {
+		return nil, err
 	}
+	r.snapshot = true
+	r.snapshotEnd = end
 	return r, nil
 }
 
-func (t *Track) Close() {
+// Sync waits for every message written so far to be flushed to disk
+func (t *Track) Sync() error {
+	_, err := t.commit(writeRequest{barrier: true, sync: true})
+	return err
+}
+
+// Flush waits for every message written so far to reach the track's chunks, so that
+// LatestOffset counts them and readers can see them. Unlike Sync, it doesn't wait for
+// them to be flushed to disk, so they may still be lost in a crash
+func (t *Track) Flush() error {
+	_, err := t.commit(writeRequest{barrier: true})
+	return err
+}
+
+// DurableOffset returns the offset just past the last message which is known to have
+// been flushed to disk. Messages before it will survive a crash, later ones may not
+func (t *Track) DurableOffset() uint64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.durable
+}
+
+// ReaderFromLatest returns a reader positioned at the end of the track, which
+// will only see messages written after it was created
+func (t *Track) ReaderFromLatest() (*StorageReader, error) {
+	return t.ReaderAt(t.LatestOffset())
+}
+
+// ReaderFromTail returns a reader positioned n messages before the end of the track,
+// so that it reads the last n messages, and then any written after them. If the track
+// holds fewer than n messages, the reader starts at the earliest one
+func (t *Track) ReaderFromTail(n uint64) (*StorageReader, error) {
+	t.dataCond.L.Lock()
+	earliest, latest := t.earliestOffset(), t.latestOffset()
+	t.dataCond.L.Unlock()
+	if latest-earliest < n {
+		return t.ReaderAt(earliest)
+	}
+	return t.ReaderAt(latest - n)
+}
+
+// EarliestOffset returns the offset of the oldest message which hasn't been trimmed
+func (t *Track) EarliestOffset() uint64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.earliestOffset()
+}
+
+func (t *Track) earliestOffset() uint64 {
+	if len(t.stores) == 0 {
+		return 0
+	}
+	return t.stores[0].baseOffset
+}
+
+// LatestOffset returns the offset at which the next message will be written,
+// which is also the number of messages currently in the track
+func (t *Track) LatestOffset() uint64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.latestOffset()
+}
+
+// ActiveChunkFill returns how full the chunk being written to is, from 0 to 1. A chunk
+// which started out small counts against the capacity it will grow to
+func (t *Track) ActiveChunkFill() float64 {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	if len(t.stores) == 0 {
+		return 0
+	}
+	last := t.stores[len(t.stores)-1]
+	capacity := last.Capacity
+	if canGrow(last) {
+		capacity = CHUNK_SIZE
+	}
+	if capacity == 0 {
+		return 1
+	}
+	return float64(last.Size) / float64(capacity)
+}
+
+func (t *Track) latestOffset() uint64 {
+	if len(t.stores) == 0 {
+		return 0
+	}
+	last := t.stores[len(t.stores)-1]
+	return last.baseOffset + last.Size
+}
+
+// Last returns the most recent message and its offset, or ErrEmpty if there isn't one.
+// It reads the message straight from the end of the last chunk's offset table
+func (t *Track) Last() (offset uint64, msg []byte, err error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	// A new chunk is added just before its first message is written, so it may be empty
+	for i := len(t.stores) - 1; i >= 0; i-- {
+		store := t.stores[i]
+		if store.Size == 0 {
+			continue
+		}
+		size, err := store.SizeOf(store.Size - 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		msg = make([]byte, size)
+		_, err = store.ReadInto(store.Size-1, msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		return store.baseOffset + store.Size - 1, msg, nil
+	}
+	return 0, nil, ErrEmpty
+}
+
+// ReadAll returns every message from fromOffset up to the end of the track, without waiting
+// for more to be written. Every message is held in memory at once, and writes wait until it's
+// done, so it's only suitable for small tracks and tests. Like Next, it returns messages as
+// they're stored, so those written with WriteCompressed are still compressed
+func (t *Track) ReadAll(fromOffset uint64) ([][]byte, error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	msgs := make([][]byte, 0)
+	chunk, i := t.locate(fromOffset)
+	if chunk < 0 {
+		return nil, ErrOffsetTrimmed
+	}
+	for first := chunk; chunk < len(t.stores); chunk, i = chunk+1, 0 {
+		store := t.stores[chunk]
+		if chunk > first {
+			prev := t.stores[chunk-1]
+			if store.baseOffset != prev.baseOffset+prev.Capacity {
+				return nil, ErrOffsetTrimmed // The chunks in between are missing
+			}
+		}
+		for ; i < store.Size; i++ {
+			size, err := store.SizeOf(i)
+			if err != nil {
+				return nil, err
+			}
+			msg := make([]byte, size)
+			_, err = store.ReadInto(i, msg)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, nil
+}
+
+// HasOffset reports whether the message at the given offset can be read right now,
+// because it's been written, and its chunk hasn't been trimmed or gone missing
+func (t *Track) HasOffset(offset uint64) bool {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	chunk, i := t.locate(offset)
+	return chunk >= 0 && chunk < len(t.stores) && i < t.stores[chunk].Size
+}
+
+// ReaderLags reports how many messages each open reader is behind
+// the latest offset, keyed by the reader's Id
+func (t *Track) ReaderLags() map[string]uint64 {
+	latest := t.LatestOffset()
+	t.readersMutex.Lock()
+	defer t.readersMutex.Unlock()
+	lags := make(map[string]uint64, len(t.readers))
+	for r := range t.readers {
+		offset := atomic.LoadUint64(&r.Offset) // A snapshot, the reader may be advancing
+		if offset > latest {
+			lags[r.Id] = 0
+		} else {
+			lags[r.Id] = latest - offset
+		}
+	}
+	return lags
+}
+
+// Verify checks every sealed chunk against its checksum. The active chunk is
+// skipped, since the writer may be changing it
+func (t *Track) Verify() error {
+	t.dataCond.L.Lock()
+	stores := make([]*FileStorage, len(t.stores))
+	copy(stores, t.stores)
+	t.dataCond.L.Unlock()
+	for _, store := range stores {
+		if !store.readOnly {
+			continue
+		}
+		err := store.Verify()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the writer once every queued message has been written, and releases
+// the active chunk. Returns the first error the writer hit while flushing or sealing
+// chunks, since any such failure means messages may not have reached the disk
+func (t *Track) Close() error {
+	if t.readOnly {
+		return nil // No writer to stop
+	}
 	close(t.writeChan) // Writer will signal alive = false
+	return <-t.closed
+}
+
+// Reopen recovers a track whose writer stopped because a write failed with nobody waiting
+// to hear about it, for example because the disk filled up. Until then, writes fail with
+// the error that stopped it. Once the cause has been dealt with, Reopen reloads the last
+// chunk from disk, and the writer carries on from the end of the track. Open readers
+// keep working throughout. Does nothing if the writer hasn't stopped
+func (t *Track) Reopen() error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	_, err := t.commit(writeRequest{reopen: true})
+	return err
+}
+
+// Shutdown stops the track accepting writes, and waits for the writer to finish the
+// messages already queued. If ctx is done first, Shutdown returns ctx.Err() without waiting
+// any longer, and the writer drops the messages it hasn't yet started on. Callers waiting for
+// them get an error, and they're counted in Stats().Dropped. Otherwise it returns the same
+// as Close. Like Close, it must only be called once
+func (t *Track) Shutdown(ctx context.Context) error {
+	if t.readOnly {
+		return nil
+	}
+	close(t.writeChan)
+	select {
+	case err := <-t.closed:
+		return err
+	case <-ctx.Done():
+		close(t.abort)
+		return ctx.Err()
+	}
 }
 
 func (t *Track) WaitForShutdown() {
-	for t.alive {
+	for !t.finished() {
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-func (t *Track) startWriter(startId uint64) {
-	t.writeChan = make(chan []byte, CHUNK_SIZE/100) // Buffer 1% of a chunk
+// Like isFinished, for callers which don't hold dataCond.L
+func (t *Track) finished() bool {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	return t.isFinished()
+}
+
+// A track is finished when no writer is running, so no more data will arrive.
+// Must be called with dataCond.L held
+func (t *Track) isFinished() bool {
+	return t.readOnly || !t.alive
+}
+
+func (t *Track) startWriter() {
+	t.writeChan = make(chan writeRequest, CHUNK_SIZE/100) // Buffer 1% of a chunk
+	t.messageSizes = newSizeHistogram(t.config.SizeBuckets)
+	t.closed = make(chan error, 1)
+	t.abort = make(chan struct{})
 	go func() {
-		msgId := startId
+		var active *FileStorage
+		var unsynced uint64          // Messages written to the active store since it was last flushed
+		var failure error            // The first flush or seal failure, reported by Close
+		var oldestUnsynced time.Time // When the oldest unflushed message was enqueued
+		var stamps stamper
+		var columns columnWriter
+		var failed error // Set when a write fails with nobody waiting to hear about it
+		keep := func(err error) {
+			if failure == nil {
+				failure = err
+			}
+		}
+		lastSync := time.Now()
+		messageLimit := newRateLimiter(t.config.MaxWritesPerSecond)
+		byteLimit := newRateLimiter(t.config.MaxBytesPerSecond)
+		var tick <-chan time.Time
+		if t.config.Sync.interval > 0 {
+			ticker := time.NewTicker(t.config.Sync.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		// Turn the request away, telling whoever's waiting for it why
+		reject := func(req writeRequest, err error) {
+			if req.committed != nil {
+				req.committed <- writeResult{err: err}
+			} else if !req.barrier {
+				atomic.AddUint64(&t.dropped, 1)
+			}
+		}
+		fail := func(err error) {
+			failed = err
+			t.dataCond.L.Lock()
+			t.writerErr = fmt.Errorf("Writer stopped after a failed write, Reopen the track to carry on: %v", err)
+			t.dataCond.L.Unlock()
+		}
+		flush := func() error {
+			err := firstErr(t.syncDirty(), stamps.sync(), columns.sync())
+			keep(err)
+			if err == nil {
+				t.markDurable(active)
+				if unsynced > 0 {
+					t.durableLatency.observe(time.Since(oldestUnsynced))
+				}
+			}
+			unsynced = 0
+			lastSync = time.Now()
+			return err
+		}
+
+		// Make sure there's an active store with room for the next message, of the given
+		// size, moving on to a new chunk if need be. If there's nowhere to write it, the
+		// request is turned away
+		makeRoom := func(req writeRequest, size uint64) bool {
+			if active != nil && !active.IsFull() {
+				if t.fitsInChunk(active, size) {
+					return true
+				}
+				// There aren't enough bytes left in the chunk
+				if err := t.sealEarly(active); err != nil {
+					reject(req, err)
+					return false
+				} else if t.config.OnOversizedForChunk == Reject {
+					reject(req, ErrNoRoomInChunk)
+					return false
+				}
+			}
+			t.dataCond.L.Lock()
+			full := t.isFull()
+			t.dataCond.L.Unlock()
+			if full {
+				// There's no room for another chunk
+				reject(req, ErrTrackFull)
+				return false
+			}
+			var err error
+			active, err = t.nextActiveStore()
+			if active == nil {
+				// There's nowhere to write the message
+				fail(err)
+				reject(req, err)
+				return false
+			}
+			keep(err)
+			active.checkWrites = t.config.ChecksOnWrite
+			if t.config.Timestamps {
+				keep(stamps.switchTo(t, active))
+			}
+			if t.config.Splitter != nil {
+				keep(columns.switchTo(active, t.config.Columns))
+			}
+			keep(t.writeManifest()) // The previous chunk may have been sealed
+			if err == nil && unsynced > 0 {
+				t.durableLatency.observe(time.Since(oldestUnsynced))
+			}
+			unsynced = 0 // The previous store was flushed when it was sealed
+			return true
+		}
+		// Write the messages in a batch request, a chunk at a time
+		writeBatch := func(req writeRequest) {
+			var first uint64
+			for written := 0; written < len(req.batch); {
+				if !makeRoom(req, uint64(len(req.batch[written]))) {
+					return
+				}
+				index := int(active.Size)
+				n := len(req.batch) - written
+				if room := int(active.Capacity - active.Size); n > room {
+					n = room
+				}
+				n = t.messagesFitting(active, req.batch[written:written+n])
+				msgs := req.batch[written : written+n]
+				if written == 0 {
+					first = active.baseOffset + active.Size
+				}
+				err := t.writeBatch(&stamps, &columns, active, index, msgs)
+				if err != nil {
+					req.committed <- writeResult{err: err}
+					return
+				}
+				for i, msg := range msgs {
+					if unsynced == 0 {
+						oldestUnsynced = req.enqueued
+					}
+					unsynced++
+					if t.keys != nil {
+						t.indexKey(active, uint64(index+i), msg)
+					}
+					t.notifyCommit(active.baseOffset+uint64(index+i), msg)
+					t.commitLatency.observe(time.Since(req.enqueued))
+					t.messageSizes.observe(uint64(len(msg)))
+				}
+				if t.config.Sync.due(unsynced, time.Since(lastSync)) {
+					flush()
+				}
+				written += n
+			}
+			req.committed <- writeResult{offset: first}
+		}
+
 		for {
-			msg, more := <-t.writeChan
+			var req writeRequest
+			var more bool
+			select {
+			case req, more = <-t.writeChan:
+			case <-tick:
+				// Catch messages which were written before the writer went idle
+				if t.config.Sync.due(unsynced, time.Since(lastSync)) {
+					flush()
+				}
+				continue
+			}
 			if !more {
+				if t.config.Sync != SyncNever && unsynced > 0 {
+					flush()
+				}
+				keep(failed)
+				// Wake any readers blocked at the tail so they can see EOF
+				t.dataCond.L.Lock()
+				for _, store := range t.stores {
+					// Readers only need the index, so the last chunk, and any whose
+					// seal failed, can be released
+					keep(store.switchToReadOnly())
+				}
 				t.alive = false
+				t.closeDurableNotify()
+				indexName := keyIndexName(t.RootPath, t.Id)
+				t.dataCond.L.Unlock()
+				keep(stamps.close())
+				keep(columns.close())
+				if t.keys != nil {
+					keep(t.keys.save(indexName))
+				}
+				t.dataCond.Broadcast()
+				t.closed <- failure
 				return
 			}
-			chunkId := msgId / CHUNK_SIZE
-			if chunkId == uint64(len(t.stores)) {
-				if chunkId > 0 {
-					t.stores[chunkId-1].switchToReadOnly() // Migrate the old chunk to readonly
+			select {
+			case <-t.abort:
+				// Shutdown has given up waiting, so drop everything still queued
+				reject(req, errors.New("Track was shut down before the message was written"))
+				continue
+			default:
+			}
+			if req.reopen {
+				var err error
+				if failed != nil {
+					active, err = t.reloadActive()
 				}
-				storeId := fmt.Sprintf("%s%d", t.Id, chunkId)
-				t.stores = append(t.stores, NewFileStorage(t.RootPath, storeId, CHUNK_SIZE))
+				if err == nil && active != nil && t.config.Splitter != nil {
+					err = columns.switchTo(active, t.config.Columns)
+				}
+				if err == nil {
+					failed = nil
+					t.dataCond.L.Lock()
+					t.writerErr = nil
+					t.dataCond.L.Unlock()
+				}
+				req.committed <- writeResult{offset: t.LatestOffset(), err: err}
+				continue
+			} else if failed != nil {
+				t.dataCond.L.Lock()
+				err := t.writerErr
+				t.dataCond.L.Unlock()
+				reject(req, err)
+				continue
+			}
+			if req.truncate {
+				next, err := t.truncateTo(active, req.offset)
+				if next == nil {
+					// The track may be left part way through, so stop writing until it's reloaded
+					fail(err)
+				} else if next != active {
+					if t.config.Timestamps {
+						keep(stamps.switchTo(t, next))
+					}
+					if t.config.Splitter != nil {
+						keep(columns.switchTo(next, t.config.Columns))
+					}
+				}
+				active = next
+				req.committed <- writeResult{offset: t.LatestOffset(), err: err}
+				continue
+			}
+			if req.barrier {
+				var err error
+				if req.sync && active != nil {
+					err = flush()
+				}
+				req.committed <- writeResult{offset: t.LatestOffset(), err: err}
+				continue
+			}
+			if err := t.checkMessageSizes(req); err != nil {
+				reject(req, err)
+				continue
+			}
+			// Waiting here leaves requests queued in writeChan, which
+			// blocks writers once it fills up
+			if req.batch != nil {
+				messageLimit.take(uint64(len(req.batch)))
+			} else {
+				messageLimit.take(1)
+			}
+			byteLimit.take(chunkBytesNeeded(req, false))
+			if err := t.checkSpace(chunkBytesNeeded(req, t.startsChunk(active))); err != nil {
+				reject(req, err)
+				continue
+			}
+			if req.batch != nil {
+				writeBatch(req)
+				continue
+			}
+			if !makeRoom(req, chunkBytesNeeded(req, false)) {
+				continue
+			}
+			internalMsgId := int(active.Size)
+			msgId := active.baseOffset + active.Size
+			var pending pendingMessage
+			var err error
+			if req.source != nil {
+				pending, err = active.prepareMessageFrom(internalMsgId, req.source, req.size)
+			} else {
+				pending, err = active.prepareMessage(internalMsgId, req.data)
+			}
+			var timestamp int64
+			if err == nil && t.config.Timestamps {
+				// Stamped before it's visible, so readers never find it without one
+				timestamp, err = stamps.stamp(uint64(internalMsgId))
+				if err != nil {
+					err = active.abortWrite(internalMsgId, err)
+				}
+			}
+			if err == nil && t.config.Splitter != nil {
+				// Committed first, so a row is never visible without its fields
+				err = t.writeColumns(&columns, active, internalMsgId, req)
+				if err != nil {
+					err = active.abortWrite(internalMsgId, err)
+				}
+			}
+			if err == nil {
+				err = t.publish(active, pending)
+			}
+			if err != nil && req.committed != nil {
+				// Someone is waiting to hear about this message, so let them handle it
+				req.committed <- writeResult{err: err}
+				continue
+			} else if err != nil {
+				// Nobody else will find out, so stop writing until the track is reopened
+				fail(err)
+				atomic.AddUint64(&t.dropped, 1)
+				continue
+			}
+			if unsynced == 0 {
+				oldestUnsynced = req.enqueued
 			}
-			internalMsgId := int(msgId % CHUNK_SIZE)
-			err := t.stores[chunkId].WriteMessage(internalMsgId, msg)
-			utils.Check(err)
-			msgId++
+			unsynced++
+			if req.sync || t.config.Sync.due(unsynced, time.Since(lastSync)) {
+				flush()
+			}
+			if t.keys != nil {
+				t.indexKey(active, uint64(internalMsgId), req.data)
+			}
+			t.notifyCommit(msgId, req.data)
+			t.commitLatency.observe(time.Since(req.enqueued))
+			t.messageSizes.observe(chunkBytesNeeded(req, false))
+			if req.committed != nil {
+				req.committed <- writeResult{offset: msgId, timestamp: timestamp}
+			}
+		}
+	}()
+}
+
+// Split the message in the request into its fields, and write them to the columns of
+// the active chunk. Like any other error, a panic in the Splitter fails the write
+func (t *Track) writeColumns(columns *columnWriter, active *FileStorage, index int, req writeRequest) (err error) {
+	defer recoverPanic(&err)
+	if req.source != nil {
+		return errors.New("Messages written from a reader can't be split into columns")
+	}
+	fields, err := t.config.Splitter(req.data)
+	if err != nil {
+		return err
+	}
+	pending, err := columns.prepare(active, index, fields)
+	if err != nil {
+		return err
+	}
+	return columns.commit(pending)
+}
 
-			// Tell any waiting routines that there's new data
-			t.dataCond.Broadcast()
+// Write messages to the active chunk from the given index on, with a single write of their
+// data. They're stamped and split into columns as they would be one at a time, and all
+// made visible together
+func (t *Track) writeBatch(stamps *stamper, columns *columnWriter, active *FileStorage, index int, msgs [][]byte) error {
+	pending, err := active.prepareMessages(index, msgs)
+	if err != nil {
+		return err
+	}
+	for i, msg := range msgs {
+		if t.config.Timestamps {
+			_, err = stamps.stamp(uint64(index + i))
+		}
+		if err == nil && t.config.Splitter != nil {
+			err = t.writeColumns(columns, active, index+i, writeRequest{data: msg})
+		}
+		if err != nil {
+			return active.abortWrite(index, err)
 		}
+	}
+	return t.publish(active, pending...)
+}
+
+// Run the OnCommit hook, if there is one, without letting it take down the writer
+func (t *Track) notifyCommit(offset uint64, msg []byte) {
+	if t.config.OnCommit == nil {
+		return
+	}
+	defer func() {
+		recover()
 	}()
+	t.config.OnCommit(offset, msg)
+}
+
+// Make written messages visible to readers, and wake any that are waiting for them.
+// Readers only look at a store's Size and index while holding the lock, so committing
+// under it means they never see a half-updated index, and can't check for data, miss
+// this broadcast, and then wait forever
+func (t *Track) publish(store *FileStorage, pending ...pendingMessage) error {
+	var err error
+	t.dataCond.L.Lock()
+	for _, p := range pending {
+		if err == nil {
+			err = store.commitMessage(p)
+		}
+	}
+	t.dataCond.L.Unlock()
+	t.dataCond.Broadcast()
+	return err
+}
+
+// Record that every message in the store has been flushed, and wake any
+// readers waiting for them to become durable
+func (t *Track) markDurable(store *FileStorage) {
+	t.dataCond.L.Lock()
+	if end := store.baseOffset + store.Size; end > t.durable {
+		t.setDurable(end)
+	}
+	t.dataCond.L.Unlock()
+	t.dataCond.Broadcast()
+}
+
+// Flush the store to disk. All of the writer's flushes go through here
+func (t *Track) syncStore(store *FileStorage) error {
+	atomic.AddUint64(&t.syncs, 1)
+	return store.Flush()
+}
+
+// Flush every writable store which has changed since it was last flushed, each exactly
+// once. Usually that's just the active store, but a chunk whose seal failed to flush is
+// left writable and retried here too, so its final header update isn't lost on a crash.
+// Once it's flushed, it's switched to read-only as it would have been when it was sealed
+func (t *Track) syncDirty() error {
+	t.dataCond.L.Lock()
+	var dirty []*FileStorage
+	for _, store := range t.stores {
+		if store.dirty && !store.readOnly {
+			dirty = append(dirty, store)
+		}
+	}
+	t.dataCond.L.Unlock()
+	var err error
+	for _, store := range dirty {
+		flushErr := t.syncStore(store)
+		if flushErr == nil && store.sealed {
+			t.dataCond.L.Lock()
+			flushErr = store.switchToReadOnly()
+			t.dataCond.L.Unlock()
+		}
+		err = firstErr(err, flushErr)
+	}
+	return err
+}
+
+// Whether the next message starts a new chunk, given the writer's active store
+func (t *Track) startsChunk(active *FileStorage) bool {
+	if active != nil {
+		return active.IsFull()
+	}
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	n := len(t.stores)
+	return n == 0 || t.stores[n-1].IsFull() || t.stores[n-1].sealed
+}
+
+// Whether the track already has MaxChunks chunks, and the last of them is full.
+// Must be called with dataCond.L held
+func (t *Track) isFull() bool {
+	if t.config.MaxChunks <= 0 || len(t.stores) < t.config.MaxChunks {
+		return false
+	}
+	last := t.stores[len(t.stores)-1]
+	return (last.IsFull() && !canGrow(last)) || last.sealed
+}
+
+// The capacity of a new chunk
+func initialCapacity() uint64 {
+	if CHUNK_INITIAL_CAPACITY == 0 || CHUNK_INITIAL_CAPACITY > CHUNK_SIZE {
+		return CHUNK_SIZE
+	}
+	return CHUNK_INITIAL_CAPACITY
+}
+
+// The capacity a chunk started with CHUNK_INITIAL_CAPACITY grows to next
+func nextCapacity(capacity uint64) uint64 {
+	if capacity == 0 || 2*capacity > CHUNK_SIZE {
+		return CHUNK_SIZE
+	}
+	return 2 * capacity
+}
+
+// Whether the active chunk should be grown rather than sealed when it fills up
+func canGrow(store *FileStorage) bool {
+	return CHUNK_INITIAL_CAPACITY > 0 && !store.sealed && !store.readOnly && store.Capacity < CHUNK_SIZE
+}
+
+// Return the store that new messages should be written to. If the last store is
+// full, it's grown if it started out small, or else sealed and a new one is added
+// to the end of the track. The returned error reports a failure to grow or seal
+// the old store, which doesn't stop writes
+func (t *Track) nextActiveStore() (*FileStorage, error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	var err error
+	if len(t.stores) > 0 {
+		last := t.stores[len(t.stores)-1]
+		if !last.IsFull() && !last.sealed {
+			return last, nil
+		}
+		if canGrow(last) {
+			// Readers hold dataCond.L to look at the header, so they never see it half grown
+			err = last.Grow(nextCapacity(last.Capacity))
+			if err == nil {
+				t.setDurable(last.baseOffset + last.Size) // Growing flushed it
+				return last, nil
+			}
+		}
+		// Migrate the old chunk to readonly. Sealing flushes it
+		atomic.AddUint64(&t.syncs, 1)
+		sealErr := last.seal()
+		if sealErr == nil {
+			t.setDurable(last.baseOffset + last.Size)
+		}
+		err = firstErr(err, sealErr)
+	}
+	storeId := t.chunkId(0)
+	if len(t.stores) > 0 {
+		storeId = t.chunkId(t.chunkNumber(t.stores[len(t.stores)-1]) + 1)
+	}
+	store, createErr := CreateFileStorage(t.RootPath, storeId, initialCapacity(), CHUNK_INITIAL_BYTES)
+	if createErr != nil {
+		return nil, createErr
+	}
+	return store, firstErr(err, t.appendStore(store))
+}
+
+// Reload the active chunk from its files, dropping whatever a failed write left behind
+// in memory, and return it. Returns nil if the last chunk is sealed, so a new one is
+// started. Must only be called by the writer
+func (t *Track) reloadActive() (*FileStorage, error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	n := len(t.stores)
+	if n == 0 || t.stores[n-1].readOnly {
+		return nil, nil
+	}
+	old := t.stores[n-1]
+	store, err := OpenFileStorage(old.rootPath, old.fileId)
+	if err != nil {
+		return nil, err
+	}
+	store.baseOffset = old.baseOffset
+	store.checkWrites = old.checkWrites
+	t.stores[n-1] = store
+	// Readers find stores through t.stores, so none are left using the old one
+	old.Close()
+	return store, nil
 }
 
 // STORAGE READER -- Combines readers from multiple chunked files into a single interface
 type StorageReader struct {
-	parent     *Track
-	Offset     uint64
-	currentSub io.ReadCloser
-	mutex      *sync.Mutex
+	Id     string
+	parent *Track
+	Offset uint64
+	// When set, Read fills the buffer with as much of a large message as fits, and
+	// carries on with the rest of it on the next call rather than returning ErrShortBuffer.
+	// This makes the reader usable with io.Copy and friends, whatever their buffer size
+	PartialReads bool
+	// When set, the reader only returns messages once they've been flushed to disk,
+	// waiting for DurableOffset to pass them. Messages which were never flushed
+	// before the track was closed are never returned
+	OnlyDurable bool
+	snapshot    bool   // Whether the reader stops at snapshotEnd
+	snapshotEnd uint64 // The latest offset when a snapshot reader was created
+	partial     uint64 // Bytes of the message at Offset which have already been read
+	currentSub  io.ReadCloser
+	subEnd      uint64       // The offset just past the end of the chunk currentSub is reading
+	subStore    *FileStorage // The chunk currentSub is reading
+	tee         io.Writer    // If set, consumed messages are copied here
+	truncated   bool         // Set when the track is truncated to cut, at or before the reader's offset, under dataCond.L
+	cut         uint64
+	readAhead   int          // The number of messages to read ahead, see readahead.go
+	ahead       *readAhead   // Set while messages are being read ahead
+	stopped     bool         // Set to stop a reader reading ahead for another, under dataCond.L
+	verify      *offsetCheck // Set if the reader checks its offsets, see VerifyOffsets
+	mutex       *sync.Mutex
 }
 
 // Read is thread-safe
 func (sr *StorageReader) Read(p []byte) (n int, err error) {
+	return sr.read(p, true)
+}
+
+// TryRead is like Read, but never blocks. At the end of a track which is still being
+// written it returns ErrWouldBlock, so the caller can try again later, whereas once the
+// track is closed or read-only, or a snapshot has been read to the end, it returns io.EOF.
+// TryRead is thread-safe
+func (sr *StorageReader) TryRead(p []byte) (n int, err error) {
+	return sr.read(p, false)
+}
+
+func (sr *StorageReader) read(p []byte, block bool) (n int, err error) {
+	defer recoverPanic(&err)
 	sr.mutex.Lock()
 	defer sr.mutex.Unlock()
 
-	if !sr.parent.alive {
-		return -1, errors.New("EOF")
+	nextMsgSize, err := sr.findNext(block)
+	if err != nil {
+		return 0, err
 	}
-
-	chunkId := sr.Offset / CHUNK_SIZE
-	internalMsgId := uint64(sr.Offset % CHUNK_SIZE)
-
-	sr.parent.dataCond.L.Lock()
-	for sr.currentSub == nil ||
-		chunkId >= uint64(len(sr.parent.stores)) ||
-		internalMsgId >= sr.parent.stores[chunkId].Size {
-		// Block for new data
-		sr.parent.dataCond.Wait()
-		sr.handleRollover()
+	remaining := nextMsgSize - sr.partial
+	if remaining > uint64(len(p)) {
+		if !sr.PartialReads {
+			return 0, ErrShortBuffer
+		}
+		remaining = uint64(len(p))
 	}
-	sr.parent.dataCond.L.Unlock()
-	// We have a valid reader, and can read from it
-	nextMsgSize, err := sr.parent.stores[chunkId].SizeOf(internalMsgId)
+	err = sr.readNext(p[0:remaining])
 	if err != nil {
 		return 0, err
 	}
-	if nextMsgSize > uint64(len(p)) {
-		return 0, fmt.Errorf("Message, of size %d, does not fit into available buffer", nextMsgSize)
+	return int(remaining), sr.takeNext(p[0:remaining], nextMsgSize)
+}
+
+// PeekSize returns the size of the next message without consuming it. Like Read,
+// it blocks until a message is available. PeekSize is thread-safe
+func (sr *StorageReader) PeekSize() (size uint64, err error) {
+	defer recoverPanic(&err)
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	return sr.waitForNext()
+}
+
+// Available returns the number of messages after the reader's offset which could be read
+// now without blocking, counting one which has been partially read. Like the reader, it
+// only counts durable messages with OnlyDurable, and stops at the end of a snapshot.
+// Available is thread-safe
+func (sr *StorageReader) Available() uint64 {
+	t := sr.parent
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	end := t.latestOffset()
+	if sr.OnlyDurable && t.durable < end {
+		end = t.durable
+	}
+	if sr.snapshot && sr.snapshotEnd < end {
+		end = sr.snapshotEnd
 	}
-	target := p[0:nextMsgSize]
-	_, err = sr.currentSub.Read(target)
-	utils.Check(err)
-	sr.Offset++
-	sr.handleRollover()
-	return int(nextMsgSize), nil
+	offset := atomic.LoadUint64(&sr.Offset)
+	if offset >= end {
+		return 0
+	}
+	return end - offset
 }
 
-func (sr *StorageReader) Close() error {
-	if sr.currentSub != nil {
-		return sr.currentSub.Close()
+// Next returns the next message in a newly allocated buffer of exactly the right size.
+// If the message has been partially read, only the rest of it is returned.
+// Like Read, it blocks until a message is available. Next is thread-safe
+func (sr *StorageReader) Next() (data []byte, err error) {
+	defer recoverPanic(&err)
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	nextMsgSize, err := sr.waitForNext()
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	data = make([]byte, nextMsgSize-sr.partial)
+	err = sr.readNext(data)
+	if err != nil {
+		return nil, err
+	}
+	return data, sr.takeNext(data, nextMsgSize)
 }
 
-func (sr *StorageReader) handleRollover() {
-	didRollOver := sr.Offset%CHUNK_SIZE == 0
-	if didRollOver {
-		// We need to reset the sub reader
-		if sr.Offset/CHUNK_SIZE < uint64(len(sr.parent.stores)) {
-			// move to the next one
-			var err error
-			sr.currentSub, err = sr.parent.stores[sr.Offset/CHUNK_SIZE].ReaderAt(0)
+// Block until the message at the current offset has been written, and return its size.
+// Returns io.EOF if the track is finished and there is no more data
+func (sr *StorageReader) waitForNext() (uint64, error) {
+	return sr.findNext(true)
+}
+
+// Like waitForNext, but if block isn't set returns ErrWouldBlock rather than waiting
+func (sr *StorageReader) findNext(block bool) (uint64, error) {
+	t := sr.parent
+	if sr.readAhead > 0 {
+		t.dataCond.L.Lock()
+		err := sr.checkTruncated()
+		t.dataCond.L.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return sr.nextPrefetched(block)
+	}
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	for {
+		if sr.stopped {
+			return 0, errReadAheadStopped
+		} else if err := sr.checkTruncated(); err != nil {
+			return 0, err
+		} else if sr.snapshot && sr.Offset >= sr.snapshotEnd {
+			return 0, io.EOF
+		}
+		chunkId, internalMsgId := t.locate(sr.Offset)
+		if chunkId < 0 {
+			if sr.currentSub != nil {
+				// The chunk we were reading has been deleted underneath us
+				sr.currentSub.Close()
+				sr.currentSub = nil
+				sr.partial = 0
+			}
+			return 0, ErrOffsetTrimmed
+		}
+		durable := !sr.OnlyDurable || sr.Offset < t.durable
+		if chunkId < len(t.stores) && internalMsgId < t.stores[chunkId].Size && durable {
+			if sr.currentSub != nil && sr.subStore != nil && sr.subStore.baseOffset != t.stores[chunkId].baseOffset {
+				// The chunk being read was sealed early, short of the capacity it had
+				// when it was opened, so the reader has moved on past its end
+				sr.currentSub.Close()
+				sr.currentSub = nil
+			}
+			store := sr.sizesFrom(t.stores[chunkId])
+			size, err := store.SizeOf(internalMsgId)
 			if err != nil {
-				if sr.currentSub != nil {
-					sr.currentSub.Close()
+				return 0, err
+			}
+			if sr.currentSub == nil {
+				sub, err := openChunk(store, internalMsgId)
+				if err == nil && sr.partial > 0 {
+					// Resuming from a cursor part way through the message
+					err = skipPartial(sub, sr.partial, size)
 				}
-				sr.currentSub = nil
+				if err != nil {
+					return 0, err
+				}
+				// Messages are written straight to the file, never through a buffer or a
+				// mapping, so the sub sees those written after it was opened. Growing the
+				// chunk replaces its file, so the sub only reads as far as the capacity it
+				// had when it was opened, which the old file holds every message up to
+				sr.currentSub = sub
+				sr.subEnd = store.baseOffset + store.Capacity
+				sr.subStore = store
 			}
-		} else {
-			// Otherwise clear it
-			sr.currentSub.Close()
-			sr.currentSub = nil
+			if sr.verify != nil {
+				err = sr.verify.check(store, internalMsgId)
+			}
+			return size, err
 		}
+		if t.isFinished() {
+			// Nothing more will ever be written, so we're at the end
+			return 0, io.EOF
+		} else if !block {
+			return 0, ErrWouldBlock
+		}
+		// Block for new data
+		t.dataCond.Wait()
+	}
+}
+
+// Read the next len(target) bytes of the message at the current offset, without moving
+// past them. Call takeNext once they've been read
+func (sr *StorageReader) readNext(target []byte) error {
+	_, err := io.ReadFull(sr.currentSub, target)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // The chunk said the message was there
+	}
+	if err != nil {
+		// The chunk may have been read part way, so drop it and skip to the right place
+		// when it's reopened by the next read
+		sr.dropSub()
+	}
+	return err
+}
+
+// Move past the bytes of the message at the current offset, which has the given size, just
+// read by readNext, advancing to the next message once all of it has been read. Returns any
+// error copying the bytes to the tee, though they're consumed regardless
+func (sr *StorageReader) takeNext(target []byte, size uint64) error {
+	var err error
+	if sr.tee != nil {
+		err = sr.teeMessage(target, size)
+	}
+	sr.consumed(uint64(len(target)), size)
+	return err
+}
+
+// Record that n more bytes of the message at the current offset, which has the given
+// size, have been read, and advance to the next message once all of it has been
+func (sr *StorageReader) consumed(n, size uint64) {
+	sr.partial += n
+	if sr.partial < size {
+		return // There's more of this message to come
 	}
+	sr.partial = 0
+	atomic.AddUint64(&sr.Offset, 1)
+	if sr.verify != nil {
+		sr.verify.expected++
+	}
+	if sr.Offset == sr.subEnd {
+		// We've rolled over, the next read will open the next chunk
+		sr.currentSub.Close()
+		sr.currentSub = nil
+	}
+}
+
+// SeekToLatest skips to the end of the track, so that the next read returns the
+// next message to be written
+func (sr *StorageReader) SeekToLatest() error {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	err := sr.dropSub()
+	sr.partial = 0
+	t := sr.parent
+	t.dataCond.L.Lock()
+	sr.truncated = false
+	atomic.StoreUint64(&sr.Offset, t.latestOffset())
+	t.dataCond.L.Unlock()
+	sr.restartOffsetCheck()
+	return err
+}
+
+func (sr *StorageReader) Close() error {
+	sr.parent.readersMutex.Lock()
+	delete(sr.parent.readers, sr)
+	sr.parent.readersMutex.Unlock()
+	return sr.dropSub()
 }
@@ -1,8 +1,13 @@
 package track
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -21,6 +26,19 @@ func TestInitTrack(t *testing.T) {
 	testutils.ExpectTrue(track.alive, "Expected track to be alive", t)
 }
 
+func TestZeroChunkSize(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 0
+
+	_, err := NewTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.ExpectTrue(err != nil, "Expected zero CHUNK_SIZE to be rejected", t)
+	_, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.ExpectTrue(err != nil, "Expected zero CHUNK_SIZE to be rejected", t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.ExpectTrue(err != nil, "Expected zero CHUNK_SIZE to be rejected", t)
+}
+
 func TestGetReader(t *testing.T) {
 	cleanupTrack()
 	track := NewTrack("", "id")
@@ -122,6 +140,31 @@ func TestFillUpMultipleFiles(t *testing.T) {
 	}
 }
 
+func TestReopenPartlyFilledTrack(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	track := NewTrack("", "id")
+	for i := 0; i < 7; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprintf("%d", i))), t)
+	}
+	track.Close()
+	track.WaitForShutdown()
+
+	// The writer carries on from the end of the last chunk
+	track = OpenTrack("", "id")
+	defer track.Close()
+	testutils.CheckErr(track.WriteMessage([]byte("7")), t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	temp := make([]byte, 100)
+	for i := 0; i < 8; i++ {
+		n, err := r.Read(temp)
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i)), temp[:n], t)
+	}
+}
+
 func TestConcurrentReadWrites(t *testing.T) {
 	cleanupTrack()
 	track := NewTrack("", "id")
@@ -154,48 +197,1255 @@ func TestConcurrentReadWrites(t *testing.T) {
 	wg.Wait()
 }
 
-func BenchmarkThroughput(b *testing.B) {
+func TestReadOnlyTrack(t *testing.T) {
 	cleanupTrack()
-	b.ResetTimer()
 	track := NewTrack("", "id")
+	var err error
+	for i := 0; i < 10; i++ {
+		err = track.WriteMessage([]byte(fmt.Sprintf("%d", i)))
+		testutils.CheckErr(err, t)
+	}
+	track.Close()
+	track.WaitForShutdown()
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	testutils.ExpectTrue(!track.alive, "Expected no writer for read-only track", t)
+	testutils.ExpectTrue(track.WriteMessage(testData) == ErrReadOnly, "Expected write to fail", t)
 
-	go func() {
-		var i uint64
-		n := uint64(b.N)
-		for i = 0; i < n; i++ {
-			track.WriteMessage([]byte(fmt.Sprintf("%d%d", i)))
-			// track.WriteMessage([]byte("Hello World"))
-		}
-		wg.Done()
-	}()
+	temp := make([]byte, 100)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	for i := 0; i < 10; i++ {
+		n1, err := r.Read(temp)
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i)), temp[0:n1], t)
+	}
+	_, err = r.Read(temp)
+	testutils.ExpectTrue(err == io.EOF, "Expected EOF at the tail of a read-only track", t)
+}
 
+func TestEOFAfterClose(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+
+	done := make(chan error)
 	go func() {
+		// Blocks at the tail until the track is closed
 		temp := make([]byte, 100)
-		r, _ := track.ReaderAt(0)
-		n := uint64(b.N)
-		var i uint64
-		for i = 0; i < n; i++ {
-			_, err := r.Read(temp)
-			if err != nil {
-				fmt.Printf("\nErr %v, on message %d/%d\n", err, i, n)
+		_, err := r.Read(temp)
+		done <- err
+	}()
+	track.Close()
+	track.WaitForShutdown()
+	testutils.ExpectTrue(<-done == io.EOF, "Expected blocked reader to see EOF after close", t)
+}
+
+func TestCopyReadOnlyTrack(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	var expected bytes.Buffer
+	for i := 0; i < 100; i++ {
+		msg := []byte(fmt.Sprintf("%d", i))
+		// io.Copy goes through WriteTo, which frames each message
+		writeFrame(&expected, uint64(len(msg)))
+		expected.Write(msg)
+		testutils.CheckErr(track.WriteMessage(msg), t)
+	}
+	track.Close()
+	track.WaitForShutdown()
+
+	track, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	var actual bytes.Buffer
+	_, err = io.Copy(&actual, r)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(expected.Bytes(), actual.Bytes(), t)
+}
+
+func TestAppendAndReader(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	testutils.CheckErr(track.WriteMessage([]byte("first")), t)
+
+	offset, r, err := track.AppendAndReader(testData)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(1, offset, t)
+	testutils.CheckUint64(1, r.Offset, t)
+
+	temp := make([]byte, 100)
+	n1, err := r.Read(temp)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, temp[0:n1], t)
+}
+
+func TestWriteAllSync(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	testutils.CheckErr(track.WriteMessage([]byte("first")), t)
+
+	msgs := make([][]byte, 1000)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	offset, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(1, offset, t)
+	testutils.CheckUint64(1001, track.stores[0].Size, t)
+	track.Close()
+	track.WaitForShutdown()
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(offset)
+	testutils.CheckErr(err, t)
+	for i := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected EOF after the last message", t)
+}
+
+func TestReaderLags(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(10, track.LatestOffset(), t)
+
+	slow, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	fast, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	for i := 0; i < 3; i++ {
+		_, err = slow.Next()
+		testutils.CheckErr(err, t)
+	}
+	for i := 0; i < 7; i++ {
+		_, err = fast.Next()
+		testutils.CheckErr(err, t)
+	}
+
+	lags := track.ReaderLags()
+	testutils.CheckInt(2, len(lags), t)
+	testutils.CheckUint64(7, lags[slow.Id], t)
+	testutils.CheckUint64(3, lags[fast.Id], t)
+
+	fast.Close()
+	lags = track.ReaderLags()
+	testutils.CheckInt(1, len(lags), t)
+	testutils.CheckUint64(7, lags[slow.Id], t)
+}
+
+func TestWriteMessageFrom(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	testutils.CheckErr(track.WriteMessage([]byte("first")), t)
+
+	big := bytes.Repeat(testData, 64*1024)
+	size := int64(len(big) - 5)
+	offset, err := track.WriteMessageFrom(io.LimitReader(bytes.NewReader(big), size), size)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(1, offset, t)
+
+	// A reader which runs out early doesn't produce a message
+	_, err = track.WriteMessageFrom(bytes.NewReader(testData), int64(len(testData)+1))
+	testutils.ExpectTrue(err != nil, "Expected short source to fail", t)
+	testutils.CheckErr(track.WriteMessage(testData), t)
+
+	r, err := track.ReaderAt(offset)
+	testutils.CheckErr(err, t)
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(big[:size], msg, t)
+	msg, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, msg, t)
+}
+
+func TestVerifyTrack(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	track.Close()
+	track.WaitForShutdown()
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Verify(), t)
+
+	f, err := os.OpenFile(fname(chunkName("id", 1), ""), os.O_RDWR, 0666)
+	testutils.CheckErr(err, t)
+	_, err = f.WriteAt([]byte{'X'}, int64(track.stores[1].index[0]))
+	testutils.CheckErr(err, t)
+	f.Close()
+	testutils.ExpectTrue(track.Verify() != nil, "Expected corrupt chunk to fail verification", t)
+}
+
+func TestThrottledWriterWakesReaders(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+
+	const nReaders = 20
+	const nMessages = 200
+	var wg sync.WaitGroup
+	wg.Add(nReaders)
+	for g := 0; g < nReaders; g++ {
+		r, err := track.ReaderAt(0)
+		testutils.CheckErr(err, t)
+		go func() {
+			for i := 0; i < nMessages; i++ {
+				msg, err := r.Next()
+				testutils.CheckErr(err, t)
+				testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i)), msg, t)
 			}
-			utils.Check(err)
+			wg.Done()
+		}()
+	}
+
+	// Trickle messages in so readers are repeatedly caught up and waiting
+	for i := 0; i < nMessages; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprintf("%d", i))), t)
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
 		}
-		wg.Done()
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Readers hung after all data was available")
+	}
+}
 
-	wg.Wait()
+// Run with -race to check that readers at the tail are synchronized with the writer
+func TestReadAtTail(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+
+	const nMessages = 1000
+	done := make(chan bool)
+	for g := 0; g < 4; g++ {
+		r, err := track.ReaderAt(0)
+		testutils.CheckErr(err, t)
+		go func() {
+			for i := 0; i < nMessages; i++ {
+				msg, err := r.Next()
+				testutils.CheckErr(err, t)
+				testutils.CheckByteSlice([]byte(fmt.Sprintf("%d", i)), msg, t)
+				track.ReaderLags()
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < nMessages; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprintf("%d", i))), t)
+		track.LatestOffset()
+	}
+	for g := 0; g < 4; g++ {
+		<-done
+	}
 }
 
-func cleanupTrack() {
-	for i := 0; ; i++ {
-		storeId := fmt.Sprintf("id%d", i)
-		if !exists(fname(storeId, "")) {
-			break
-		}
-		os.Remove(fname(storeId, ""))
+func TestOpenInconsistentTrack(t *testing.T) {
+	cleanupTrack()
+	// The first chunk isn't full, but there's a chunk after it
+	store := NewFileStorage("", "id0", 5)
+	for i := 0; i < 3; i++ {
+		testutils.CheckErr(store.WriteMessage(i, testData), t)
+	}
+	store.Close()
+	store = NewFileStorage("", "id1", 5)
+	testutils.CheckErr(store.WriteMessage(0, testData), t)
+	store.Close()
+
+	_, err := OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.ExpectTrue(err != nil, "Expected inconsistent chunks to be rejected", t)
+	_, err = OpenTrackReadOnly("", "id")
+	testutils.ExpectTrue(err != nil, "Expected inconsistent chunks to be rejected", t)
+}
+
+func TestCloseReportsSyncFailure(t *testing.T) {
+	cleanupTrack()
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncEvery(100)})
+	testutils.CheckErr(err, t)
+	_, _, err = track.AppendAndReader(testData)
+	testutils.CheckErr(err, t)
+
+	// Pull the file out from under the active chunk so the final sync fails
+	track.dataCond.L.Lock()
+	track.stores[0].file.Close()
+	track.dataCond.L.Unlock()
+	testutils.ExpectTrue(track.Close() != nil, "Expected the failed sync to be reported", t)
+	testutils.ExpectTrue(track.finished(), "Expected the writer to have stopped", t)
+}
+
+func TestCloseReleasesActiveChunk(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	_, r, err := track.AppendAndReader(testData)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.CheckErr(track.Close(), t)
+	testutils.ExpectTrue(track.stores[0].readOnly, "Expected the active chunk to be released", t)
+
+	// The message can still be read after the chunk is released
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, msg, t)
+}
+
+func TestOpenWithMissingChunks(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 10
+	cleanupTrack()
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 25)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+	testutils.CheckErr(os.Remove(fname(chunkName("id", 0), "")), t)
+	// Chunks deleted by hand must be dropped from the manifest too, or opening refuses the gap
+	testutils.CheckErr(os.Remove(manifestName("", "id")), t)
+
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(2, len(track.stores), t)
+	testutils.CheckUint64(25, track.LatestOffset(), t)
+
+	// The deleted chunk's offsets are gone, but the rest keep their offsets
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	_, err = r.Next()
+	testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the first chunk to be trimmed", t)
+	r.Close()
+	r, err = track.ReaderAt(10)
+	testutils.CheckErr(err, t)
+	for i := 10; i < 25; i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+
+	// Writing continues after the last chunk
+	_, err = track.WriteAllSync(msgs[:10])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 3), "")), "Expected a new chunk after the last one", t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 0), "")), "Expected the missing chunk to stay missing", t)
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+	r.Close()
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestOpenPrunesEmptyChunks(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 5)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Leave behind what a crash during chunk creation might: an empty
+	// chunk, and a chunk whose header was never written
+	testutils.CheckErr(NewFileStorage("", chunkName("id", 1), CHUNK_SIZE).Close(), t)
+	f, err := os.Create(fname(chunkName("id", 2), ""))
+	testutils.CheckErr(err, t)
+	f.Close()
+
+	readOnly, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(1, len(readOnly.stores), t)
+	testutils.ExpectTrue(exists(fname(chunkName("id", 2), "")), "Expected read-only open to leave files alone", t)
+
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(1, len(track.stores), t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 2), "")), "Expected the empty chunk to be removed", t)
+	testutils.CheckUint64(5, track.LatestOffset(), t)
+
+	offset, err := track.WriteAllSync(msgs[:3])
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(5, offset, t)
+	testutils.CheckUint64(5, track.stores[1].baseOffset, t)
+	testutils.CheckString(chunkName("id", 1), track.stores[1].fileId, t)
+	r, err := track.ReaderAt(4)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for _, expected := range [][]byte{msgs[4], msgs[0], msgs[1], msgs[2]} {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(expected, msg, t)
 	}
+	testutils.CheckErr(track.Close(), t)
+	cleanupTrack()
+}
+
+func TestSeekToLatest(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+
+	// An empty track starts at the beginning
+	r, err := track.ReaderFromLatest()
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, r.Offset, t)
+	r.Close()
+
+	_, err = track.WriteAllSync([][]byte{[]byte("old1"), []byte("old2"), []byte("old3")})
+	testutils.CheckErr(err, t)
+	r, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("old1"), msg, t)
+
+	testutils.CheckErr(r.SeekToLatest(), t)
+	testutils.CheckUint64(3, r.Offset, t)
+	_, err = track.WriteAllSync([][]byte{[]byte("new")})
+	testutils.CheckErr(err, t)
+	msg, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("new"), msg, t)
+}
+
+func TestWriteMessageCommit(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	offset, err := track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, offset, t)
+
+	// Break the active chunk, so the next write fails part way through
+	store := track.stores[0]
+	store.out = &failingWriter{store.file}
+	_, err = track.WriteMessageCommit([]byte("lost"))
+	testutils.ExpectTrue(err != nil, "Expected the store's error to be returned", t)
+	testutils.CheckUint64(1, track.LatestOffset(), t)
+
+	store.out = store.file
+	offset, err = track.WriteMessageCommit([]byte("kept"))
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(1, offset, t)
+	r, err := track.ReaderAt(1)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("kept"), msg, t)
+}
+
+func TestShutdown(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync([][]byte{testData, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Shutdown(context.Background()), t)
+	testutils.CheckUint64(2, track.LatestOffset(), t)
+	testutils.CheckUint64(0, track.Stats().Dropped, t)
+	cleanupTrack()
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	// Pause the writer part way through the first message
+	paused := make(chan bool)
+	config.OnCommit = func(offset uint64, msg []byte) {
+		<-paused
+	}
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	for i := 0; i < 10; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = track.Shutdown(ctx)
+	testutils.ExpectTrue(err == context.DeadlineExceeded, "Expected Shutdown to time out", t)
+
+	// Once unstuck, the writer drops the rest of the queue
+	close(paused)
+	track.WaitForShutdown()
+	testutils.CheckUint64(1, track.LatestOffset(), t)
+	testutils.CheckUint64(9, track.Stats().Dropped, t)
+	cleanupTrack()
+}
+
+func TestReaderFromTail(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 10)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("%d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	r, err := track.ReaderFromTail(3)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.CheckUint64(7, r.Offset, t)
+	for i := 7; i < len(msgs); i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+
+	// Asking for more than there is starts at the beginning
+	r2, err := track.ReaderFromTail(100)
+	testutils.CheckErr(err, t)
+	defer r2.Close()
+	testutils.CheckUint64(0, r2.Offset, t)
+	msg, err := r2.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+}
+
+func TestSnapshotReader(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, err := track.WriteAllSync([][]byte{[]byte("old1"), []byte("old2")})
+	testutils.CheckErr(err, t)
+
+	r, err := track.ReaderSnapshotAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	_, err = track.WriteAllSync([][]byte{[]byte("new")})
+	testutils.CheckErr(err, t)
+
+	for _, expected := range []string{"old1", "old2"} {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(expected, string(msg), t)
+	}
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.EOF, "Expected the snapshot to end at the original tail", t)
+	testutils.CheckUint64(2, r.Offset, t)
+}
+
+func TestReadIntoShortBuffer(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	large := bytes.Repeat(testData, 8)
+	_, err := track.WriteAllSync([][]byte{large, testData})
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+
+	// The message is left in place however many times we fail to read it
+	buf := make([]byte, len(testData))
+	for i := 0; i < 2; i++ {
+		n, err := r.Read(buf)
+		testutils.CheckInt(0, n, t)
+		testutils.ExpectTrue(err == ErrShortBuffer, "Expected the buffer to be too small", t)
+	}
+	size, err := r.PeekSize()
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(uint64(len(large)), size, t)
+
+	buf = make([]byte, size)
+	n, err := r.Read(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(large, buf[:n], t)
+	n, err = r.Read(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, buf[:n], t)
+}
+
+func TestPartialReads(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	large := make([]byte, 1000)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	_, err := track.WriteAllSync([][]byte{large, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	r.PartialReads = true
+	var out bytes.Buffer
+	_, err = io.CopyBuffer(&out, r, make([]byte, 16))
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(append(large, testData...), out.Bytes(), t)
+	testutils.CheckUint64(2, r.Offset, t)
+
+	// The offset only moves on once the whole message has been read
+	r, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	r.PartialReads = true
+	n, err := r.Read(make([]byte, 600))
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(600, n, t)
+	testutils.CheckUint64(0, r.Offset, t)
+	rest, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(large[600:], rest, t)
+	testutils.CheckUint64(1, r.Offset, t)
+}
+
+func TestOnlyDurableReader(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id") // Never syncs by itself
+	defer track.Close()
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	r.OnlyDurable = true
+
+	_, _, err = track.AppendAndReader(testData)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, track.DurableOffset(), t)
+	read := make(chan []byte, 1)
+	go func() {
+		msg, _ := r.Next()
+		read <- msg
+	}()
+	select {
+	case <-read:
+		t.Errorf("Expected the reader to wait for the message to be flushed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	testutils.CheckErr(track.Sync(), t)
+	testutils.CheckUint64(1, track.DurableOffset(), t)
+	testutils.CheckByteSlice(testData, <-read, t)
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	cleanupTrack()
+	b.ResetTimer()
+	track := NewTrack("", "id")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		var i uint64
+		n := uint64(b.N)
+		for i = 0; i < n; i++ {
+			track.WriteMessage([]byte(fmt.Sprintf("%d%d", i)))
+			// track.WriteMessage([]byte("Hello World"))
+		}
+		wg.Done()
+	}()
+
+	go func() {
+		temp := make([]byte, 100)
+		r, _ := track.ReaderAt(0)
+		n := uint64(b.N)
+		var i uint64
+		for i = 0; i < n; i++ {
+			_, err := r.Read(temp)
+			if err != nil {
+				fmt.Printf("\nErr %v, on message %d/%d\n", err, i, n)
+			}
+			utils.Check(err)
+		}
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
+
+func cleanupTrack() {
+	cleanupTrackId("id")
+}
+
+func cleanupTrackId(id string) {
+	chunks, _ := discoverChunks("", id, DefaultChunkNamer{})
+	for _, i := range chunks {
+		removeStorage(existingChunkName("", id, i), "")
+	}
+	os.Remove(manifestName("", id))
+	os.Remove(keyIndexName("", id))
+}
+
+func TestLast(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, _, err := track.Last()
+	testutils.ExpectTrue(err == ErrEmpty, fmt.Sprintf("Expected ErrEmpty, got %v", err), t)
+	for i := 0; i < 7; i++ {
+		msg := []byte(fmt.Sprintf("message %d", i))
+		_, err = track.WriteMessageCommit(msg)
+		testutils.CheckErr(err, t)
+		offset, last, err := track.Last()
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(uint64(i), offset, t)
+		testutils.CheckByteSlice(msg, last, t)
+	}
+	testutils.CheckInt(2, len(track.stores), t)
+}
+
+// A header whose offset table updates fail until it's told otherwise
+type failingSetHeader struct {
+	headerIO
+	fail bool
+}
+
+func (h *failingSetHeader) set(slot int, value uint64) error {
+	if h.fail {
+		return errors.New("Injected failure")
+	}
+	return h.headerIO.set(slot, value)
+}
+
+func TestReopenAfterWriterFailure(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, err := track.WriteAllSync([][]byte{[]byte("first"), []byte("second")})
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(2)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	received := make(chan []byte)
+	go func() {
+		msg, _ := r.Next()
+		received <- msg
+	}()
+
+	track.dataCond.L.Lock()
+	header := &failingSetHeader{track.stores[0].header, true}
+	track.stores[0].header = header
+	track.dataCond.L.Unlock()
+	testutils.CheckErr(track.WriteMessage([]byte("lost")), t)
+	err = track.Sync()
+	testutils.ExpectTrue(err != nil, "Expected the writer to have stopped", t)
+	_, err = track.WriteMessageCommit([]byte("rejected"))
+	testutils.ExpectTrue(err != nil, "Expected writes to fail until the track is reopened", t)
+	testutils.CheckUint64(2, track.LatestOffset(), t)
+
+	header.fail = false
+	testutils.CheckErr(track.Reopen(), t)
+	offset, err := track.WriteMessageCommit([]byte("third"))
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(2, offset, t)
+	testutils.CheckByteSlice([]byte("third"), <-received, t)
+	testutils.CheckUint64(1, track.Stats().Dropped, t)
+	testutils.CheckErr(track.Reopen(), t)
+}
+
+func TestTryRead(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	buf := make([]byte, 64)
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == ErrWouldBlock, fmt.Sprintf("Expected ErrWouldBlock from an empty track, got %v", err), t)
+
+	_, err = track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	n, err := r.TryRead(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(testData, buf[:n], t)
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == ErrWouldBlock, fmt.Sprintf("Expected ErrWouldBlock at the tail of a live track, got %v", err), t)
+
+	// Once the track is closed, the tail is the end
+	testutils.CheckErr(track.Close(), t)
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == io.EOF, fmt.Sprintf("Expected io.EOF at the tail of a closed track, got %v", err), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err = track.ReaderAt(1)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	_, err = r.TryRead(buf)
+	testutils.ExpectTrue(err == io.EOF, fmt.Sprintf("Expected io.EOF at the tail of a read-only track, got %v", err), t)
+}
+
+func TestReadDamagedChunk(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := [][]byte{[]byte("zero"), []byte("one"), testData}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	// Cut the data file off part way through the second message
+	testutils.CheckErr(os.Truncate(fname(chunkName("id", 0), ""), int64(track.stores[0].index[1]+2)), t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+	_, err = r.Next()
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF from Next, got %v", err), t)
+	testutils.CheckUint64(1, r.Offset, t)
+	testutils.ExpectTrue(r.currentSub == nil, "Expected the reader to drop the damaged chunk", t)
+	_, err = r.Read(make([]byte, 64))
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF from Read, got %v", err), t)
+	var buf bytes.Buffer
+	_, err = r.WriteTo(&buf)
+	testutils.ExpectTrue(err == io.ErrUnexpectedEOF, fmt.Sprintf("Expected io.ErrUnexpectedEOF from WriteTo, got %v", err), t)
+
+	// The reader still works from where it was
+	testutils.CheckErr(r.SeekTo(0), t)
+	msg, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+}
+
+func TestAvailable(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.CheckUint64(0, r.Available(), t)
+	for i := 0; i < 7; i++ {
+		_, err = track.WriteMessageCommit(testData)
+		testutils.CheckErr(err, t)
+	}
+	for i := 0; i < 2; i++ {
+		_, err = r.Next()
+		testutils.CheckErr(err, t)
+	}
+	testutils.CheckUint64(5, r.Available(), t)
+
+	testutils.CheckErr(r.SeekToLatest(), t)
+	testutils.CheckUint64(0, r.Available(), t)
+	testutils.CheckErr(r.SeekTo(100), t)
+	testutils.CheckUint64(0, r.Available(), t)
+}
+
+func TestFlush(t *testing.T) {
+	cleanupTrack()
+	track, err := NewTrackWithConfig("", "id", TrackConfig{Sync: SyncNever})
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	for i := 0; i < 500; i++ {
+		testutils.CheckErr(track.WriteMessage(testData), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	testutils.CheckUint64(500, track.LatestOffset(), t)
+	// Nothing was flushed to disk
+	testutils.CheckUint64(0, track.Stats().Syncs, t)
+	testutils.CheckUint64(0, track.DurableOffset(), t)
+}
+
+func TestChunksStartSmall(t *testing.T) {
+	defer func(size, initial uint64) { CHUNK_SIZE, CHUNK_INITIAL_CAPACITY = size, initial }(CHUNK_SIZE, CHUNK_INITIAL_CAPACITY)
+	CHUNK_SIZE = 64
+	CHUNK_INITIAL_CAPACITY = 4
+	cleanupTrack()
+
+	track, err := NewTrackWithConfig("", "id", TrackConfig{ChecksOnWrite: true})
+	testutils.CheckErr(err, t)
+	_, err = track.WriteMessageCommit([]byte("message 0"))
+	testutils.CheckErr(err, t)
+	store := track.stores[0]
+	testutils.CheckUint64(4, store.Capacity, t)
+	testutils.CheckInt(int(4+2+_nExtra), len(store.header.slots()), t)
+
+	// A reader that's already reading the small chunk carries on once it's grown
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	buf := make([]byte, 64)
+	n, err := r.Read(buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckString("message 0", string(buf[:n]), t)
+
+	msgs := make([][]byte, 99)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i+1))
+	}
+	_, err = track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	// The first chunk grew to CHUNK_SIZE, the second only as far as it needed to
+	testutils.CheckInt(2, len(track.stores), t)
+	testutils.CheckUint64(CHUNK_SIZE, track.stores[0].Capacity, t)
+	testutils.CheckUint64(64, track.stores[1].Capacity, t)
+	for i := 1; i < 100; i++ {
+		n, err = r.Read(buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprintf("message %d", i), string(buf[:n]), t)
+	}
+	testutils.CheckErr(track.Close(), t)
+
+	// Reopening carries on growing the last chunk
+	track = OpenTrack("", "id")
+	defer track.Close()
+	testutils.CheckUint64(100, track.LatestOffset(), t)
+	for i := 100; i < 130; i++ {
+		_, err = track.WriteMessageCommit([]byte(fmt.Sprintf("message %d", i)))
+		testutils.CheckErr(err, t)
+	}
+	testutils.CheckInt(3, len(track.stores), t)
+	testutils.CheckUint64(4, track.stores[2].Capacity, t)
+	for _, offset := range []uint64{0, 63, 64, 127, 129} {
+		r, err := track.ReaderAt(offset)
+		testutils.CheckErr(err, t)
+		n, err = r.Read(buf)
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprintf("message %d", offset), string(buf[:n]), t)
+		r.Close()
+	}
+}
+
+func TestReadAll(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs, err := track.ReadAll(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, len(msgs), t)
+
+	written := make([][]byte, 12)
+	for i := range written {
+		written[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err = track.WriteAllSync(written)
+	testutils.CheckErr(err, t)
+	msgs, err = track.ReadAll(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(written), len(msgs), t)
+	for i := range written {
+		testutils.CheckByteSlice(written[i], msgs[i], t)
+	}
+	msgs, err = track.ReadAll(7)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(5, len(msgs), t)
+	testutils.CheckByteSlice(written[7], msgs[0], t)
+	// The tail has nothing yet, so it doesn't wait
+	msgs, err = track.ReadAll(12)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(0, len(msgs), t)
+
+	testutils.CheckErr(track.Trim(7), t)
+	_, err = track.ReadAll(0)
+	testutils.ExpectTrue(err == ErrOffsetTrimmed, fmt.Sprintf("Expected ErrOffsetTrimmed, got %v", err), t)
+}
+
+func TestDigitSuffixedIds(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 1
+	cleanupTrackId("log")
+	cleanupTrackId("log1")
+	defer cleanupTrackId("log")
+	defer cleanupTrackId("log1")
+
+	// Chunk 10 of log and chunk 0 of log1 used to share a file name
+	counts := map[string]int{"log": 12, "log1": 2}
+	for id, n := range counts {
+		track := NewTrack("", id)
+		for i := 0; i < n; i++ {
+			_, err := track.WriteMessageCommit([]byte(fmt.Sprintf("%s %d", id, i)))
+			testutils.CheckErr(err, t)
+		}
+		testutils.CheckErr(track.Close(), t)
+	}
+	for id, n := range counts {
+		track, err := OpenTrackReadOnly("", id)
+		testutils.CheckErr(err, t)
+		msgs, err := track.ReadAll(0)
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(n, len(msgs), t)
+		for i, msg := range msgs {
+			testutils.CheckString(fmt.Sprintf("%s %d", id, i), string(msg), t)
+		}
+	}
+}
+
+func TestOpenLegacyChunkNames(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 11)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs[:6])
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+	for n := 0; n < 2; n++ {
+		testutils.CheckErr(renameStorage(chunkName("id", n), "", legacyChunkName("id", n), ""), t)
+	}
+
+	// Old chunks keep their names, new ones get the separator
+	track = OpenTrack("", "id")
+	defer track.Close()
+	testutils.CheckUint64(6, track.LatestOffset(), t)
+	_, err = track.WriteAllSync(msgs[6:])
+	testutils.CheckErr(err, t)
+	testutils.CheckString(legacyChunkName("id", 1), track.stores[1].fileId, t)
+	testutils.CheckString(chunkName("id", 2), track.stores[2].fileId, t)
+	all, err := track.ReadAll(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(msgs), len(all), t)
+	for i, msg := range all {
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+}
+
+func TestWriteMessagesAcrossChunks(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 10
+	cleanupTrack()
+
+	track, err := NewTrackWithConfig("", "id", TrackConfig{ChecksOnWrite: true, Timestamps: true})
+	testutils.CheckErr(err, t)
+	msgs := make([][]byte, 25)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	for _, msg := range msgs[:3] {
+		_, err = track.WriteMessageCommit(msg)
+		testutils.CheckErr(err, t)
+	}
+	// The batch fills the first chunk, all of the second, and starts a third
+	first, err := track.WriteMessages(msgs[3:])
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(3, first, t)
+	testutils.CheckUint64(25, track.LatestOffset(), t)
+	testutils.CheckInt(3, len(track.stores), t)
+	_, err = track.WriteMessages(nil)
+	testutils.ExpectTrue(err != nil, "An empty batch should be refused", t)
+
+	all, err := track.ReadAll(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(len(msgs), len(all), t)
+	for i, msg := range all {
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	_, err = track.Timestamp(24)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	track = OpenTrack("", "id")
+	defer track.Close()
+	testutils.CheckUint64(25, track.LatestOffset(), t)
+	for _, store := range track.stores {
+		testutils.CheckErr(store.Verify(), t)
+	}
+}
+
+func TestActiveChunkFill(t *testing.T) {
+	defer func(size, initial uint64) { CHUNK_SIZE, CHUNK_INITIAL_CAPACITY = size, initial }(CHUNK_SIZE, CHUNK_INITIAL_CAPACITY)
+	CHUNK_SIZE = 8
+	CHUNK_INITIAL_CAPACITY = 2
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	testutils.ExpectTrue(track.ActiveChunkFill() == 0, "An empty track should have nothing in its chunk", t)
+	msgs := make([][]byte, 8)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	// The chunk's still small, but counts against the size it'll grow to
+	_, err := track.WriteMessages(msgs[:2])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(track.ActiveChunkFill() == 0.25, fmt.Sprintf("Expected 0.25 but got %v", track.ActiveChunkFill()), t)
+	_, err = track.WriteMessages(msgs[2:])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(track.ActiveChunkFill() == 1, fmt.Sprintf("Expected 1 but got %v", track.ActiveChunkFill()), t)
+	_, err = track.WriteMessageCommit(msgs[0])
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(track.ActiveChunkFill() == 0.125, fmt.Sprintf("Expected 0.125 but got %v", track.ActiveChunkFill()), t)
+}
+
+func TestReaderAtFutureOffset(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	_, err := track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	// A live track may still get there
+	r, err := track.ReaderAt(1000)
+	testutils.CheckErr(err, t)
+	r.Close()
+	testutils.CheckErr(track.Close(), t)
+
+	_, err = track.ReaderAt(1000)
+	testutils.ExpectTrue(err == ErrFutureOffset, fmt.Sprintf("Expected ErrFutureOffset from a closed track, got %v", err), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	_, err = track.ReaderAt(2)
+	testutils.ExpectTrue(err == ErrFutureOffset, fmt.Sprintf("Expected ErrFutureOffset from a read-only track, got %v", err), t)
+	// The tail itself is still fine, and reads as the end
+	r, err = track.ReaderAt(1)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	_, err = r.Read(make([]byte, 64))
+	testutils.ExpectTrue(err == io.EOF, fmt.Sprintf("Expected io.EOF at the tail of a read-only track, got %v", err), t)
+}
+
+func TestResolveOffset(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 17)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteMessages(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Trim(10), t)
+
+	for _, offset := range []uint64{0, 4, 9} {
+		_, _, _, err = track.ResolveOffset(offset)
+		testutils.ExpectTrue(err == ErrOffsetTrimmed, fmt.Sprintf("Expected offset %d to be trimmed, got %v", offset, err), t)
+	}
+	for _, c := range []struct {
+		offset uint64
+		chunk  int
+		index  uint64
+	}{{10, 0, 0}, {14, 0, 4}, {15, 1, 0}, {16, 1, 1}, {19, 1, 4}} {
+		chunk, index, path, err := track.ResolveOffset(c.offset)
+		testutils.CheckErr(err, t)
+		testutils.CheckInt(c.chunk, chunk, t)
+		testutils.CheckUint64(c.index, index, t)
+		testutils.CheckString(fname(chunkName("id", c.chunk+2), ""), path, t)
+	}
+	_, _, _, err = track.ResolveOffset(20)
+	testutils.ExpectTrue(err != nil, "Expected an offset past the last chunk not to resolve", t)
+
+	// The resolved message is the one at the offset
+	_, index, path, err := track.ResolveOffset(12)
+	testutils.CheckErr(err, t)
+	store, err := OpenReadOnly(filepath.Dir(path), filepath.Base(path))
+	testutils.CheckErr(err, t)
+	defer store.Close()
+	buf := make([]byte, 64)
+	n, err := store.ReadInto(index, buf)
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[12], buf[:n], t)
+}
+
+func TestReaderSeesActiveChunkGrow(t *testing.T) {
+	defer func(size, initial uint64) { CHUNK_SIZE, CHUNK_INITIAL_CAPACITY = size, initial }(CHUNK_SIZE, CHUNK_INITIAL_CAPACITY)
+	defer func(backend HeaderBackend) { HEADER_BACKEND = backend }(HEADER_BACKEND)
+	defer func(sidecar bool) { INDEX_SIDECAR = sidecar }(INDEX_SIDECAR)
+	CHUNK_SIZE = 8
+	CHUNK_INITIAL_CAPACITY = 2
+	for _, backend := range []HeaderBackend{HEADER_MMAP, HEADER_PREAD} {
+		for _, sidecar := range []bool{false, true} {
+			HEADER_BACKEND, INDEX_SIDECAR = backend, sidecar
+			cleanupTrack()
+			track := NewTrack("", "id")
+			testutils.CheckErr(track.WriteMessage([]byte("0")), t)
+			testutils.CheckErr(track.Flush(), t)
+
+			// Part way through the active chunk, and waiting at its end, while the
+			// chunk is written to, grown and then sealed
+			r, err := track.ReaderAt(0)
+			testutils.CheckErr(err, t)
+			msg, err := r.Next()
+			testutils.CheckErr(err, t)
+			testutils.CheckString("0", string(msg), t)
+			waiting, err := track.ReaderAt(1)
+			testutils.CheckErr(err, t)
+			done := make(chan []string)
+			go func() {
+				seen := make([]string, 0)
+				for i := 1; i < 12; i++ {
+					msg, err := waiting.Next()
+					if err != nil {
+						break
+					}
+					seen = append(seen, string(msg))
+				}
+				done <- seen
+			}()
+			for i := 1; i < 12; i++ {
+				testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprint(i))), t)
+				if i%3 == 0 {
+					testutils.CheckErr(track.Flush(), t)
+					// Read with the chunk's own file, rather than one opened to read
+					_, last, err := track.Last()
+					testutils.CheckErr(err, t)
+					testutils.CheckString(fmt.Sprint(i), string(last), t)
+					msg, err = r.Next()
+					testutils.CheckErr(err, t)
+					testutils.CheckString(fmt.Sprint(r.Offset-1), string(msg), t)
+				}
+			}
+			testutils.CheckErr(track.Flush(), t)
+			for r.Offset < 12 {
+				msg, err = r.Next()
+				testutils.CheckErr(err, t)
+				testutils.CheckString(fmt.Sprint(r.Offset-1), string(msg), t)
+			}
+			seen := <-done
+			testutils.CheckInt(11, len(seen), t)
+			for i, msg := range seen {
+				testutils.CheckString(fmt.Sprint(i+1), msg, t)
+			}
+			r.Close()
+			waiting.Close()
+			testutils.CheckErr(track.Close(), t)
+		}
+	}
+	cleanupTrack()
 }
@@ -0,0 +1,105 @@
+package track
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Tee makes the reader copy every message it consumes to w, framed by its length as a
+// uvarint, so that w receives a stream which can be split back into messages. Messages
+// read in pieces with PartialReads are copied piece by piece as they're read. Like
+// io.TeeReader, errors writing to w are returned by the read, which still consumes the
+// message. Passing nil stops copying. Returns the reader, for chaining
+func (sr *StorageReader) Tee(w io.Writer) *StorageReader {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.tee = w
+	return sr
+}
+
+// Copy part of the message at the current offset, which has the given size, to the
+// tee, starting with its length if this is the first part
+func (sr *StorageReader) teeMessage(p []byte, size uint64) error {
+	if sr.partial == 0 {
+		_, err := writeFrame(sr.tee, size)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := sr.tee.Write(p)
+	return err
+}
+
+// Write the length of a message as a uvarint
+func writeFrame(w io.Writer, size uint64) (int, error) {
+	var frame [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(frame[:], size)
+	return w.Write(frame[:n])
+}
+
+// WriteTo implements io.WriterTo, so io.Copy streams the reader's messages to w framed
+// by their lengths as uvarints, in the same format as Tee. Each message is copied straight
+// from its chunk with io.CopyN, without going through a buffer the size of the message.
+// If a message has been partially read, only the rest of it is copied, framed by the
+// length of the rest. With PartialReads set, the messages are copied unframed instead,
+// just as io.Copy would get them from Read. Like Read, WriteTo waits for new messages at
+// the end of a track which is still being written, so it only returns once the reader
+// reaches the end of a snapshot, or of a read-only or closed track. Use ReaderSnapshotAt
+// to copy just the messages written so far. Reaching the end isn't an error, so returns
+// nil then. Messages are copied to the tee too if there is one, and errors writing to it
+// stop the copy
+func (sr *StorageReader) WriteTo(w io.Writer) (written int64, err error) {
+	defer recoverPanic(&err)
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	for {
+		size, err := sr.waitForNext()
+		if err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		n, err := sr.copyNext(w, size)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Copy the rest of the message at the current offset, which has the given size, to w
+// with its frame, and advance to the next message
+func (sr *StorageReader) copyNext(w io.Writer, size uint64) (int64, error) {
+	rest := size - sr.partial
+	var n int
+	var err error
+	if !sr.PartialReads {
+		n, err = writeFrame(w, rest)
+		if err != nil {
+			return int64(n), err
+		}
+	}
+	if sr.tee != nil {
+		if sr.partial == 0 {
+			_, err = writeFrame(sr.tee, size)
+			if err != nil {
+				return int64(n), err
+			}
+		}
+		w = io.MultiWriter(w, sr.tee)
+	}
+	copied, err := io.CopyN(w, sr.currentSub, int64(rest))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // The chunk said the message was there
+	}
+	if err != nil {
+		// The chunk may have been read further than was copied, so drop it and skip
+		// to the right place when it's reopened by the next read
+		sr.partial += uint64(copied)
+		sr.dropSub()
+		return int64(n) + copied, err
+	}
+	sr.consumed(rest, size)
+	return int64(n) + copied, nil
+}
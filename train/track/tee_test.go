@@ -0,0 +1,179 @@
+package track
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestTee(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := [][]byte{[]byte("first"), bytes.Repeat(testData, 4), []byte("third")}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	var copied bytes.Buffer
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	r.Tee(&copied)
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+	// Messages read in pieces are copied in pieces, but framed once
+	r.PartialReads = true
+	buf := make([]byte, len(testData))
+	for i := 0; i < 4; i++ {
+		_, err = r.Read(buf)
+		testutils.CheckErr(err, t)
+	}
+	_, err = r.Next()
+	testutils.CheckErr(err, t)
+
+	framed := bufio.NewReader(&copied)
+	for _, expected := range msgs {
+		size, err := binary.ReadUvarint(framed)
+		testutils.CheckErr(err, t)
+		msg := make([]byte, size)
+		_, err = io.ReadFull(framed, msg)
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(expected, msg, t)
+	}
+	testutils.CheckInt(0, framed.Buffered(), t)
+}
+
+func TestTeeWriteFailure(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, err := track.WriteAllSync([][]byte{[]byte("first"), []byte("second")})
+	testutils.CheckErr(err, t)
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Tee(&failingWriter{ioutil.Discard}).Next()
+	testutils.ExpectTrue(err != nil, "Expected the tee's failure to be reported", t)
+	testutils.CheckByteSlice([]byte("first"), msg, t)
+
+	// The message was still consumed
+	msg, err = r.Tee(nil).Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice([]byte("second"), msg, t)
+}
+
+// Split a stream of framed messages back into messages
+func unframe(data []byte, t *testing.T) [][]byte {
+	framed := bytes.NewReader(data)
+	var msgs [][]byte
+	for framed.Len() > 0 {
+		size, err := binary.ReadUvarint(framed)
+		testutils.CheckErr(err, t)
+		msg := make([]byte, size)
+		_, err = io.ReadFull(framed, msg)
+		testutils.CheckErr(err, t)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestWriteTo(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = bytes.Repeat(testData, i)
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	// A snapshot stops at the end of what's been written
+	r, err := track.ReaderSnapshotAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	var teed bytes.Buffer
+	r.Tee(&teed)
+	r.PartialReads = true
+	buf := make([]byte, 10)
+	for i := 0; i < 2; i++ {
+		_, err = r.Read(buf)
+		testutils.CheckErr(err, t)
+	}
+	r.PartialReads = false
+
+	var copied bytes.Buffer
+	n, err := io.Copy(&copied, r)
+	testutils.CheckErr(err, t)
+	testutils.CheckInt(copied.Len(), int(n), t)
+	testutils.CheckUint64(12, r.Offset, t)
+	// Only the rest of the partially read message is copied
+	written := unframe(copied.Bytes(), t)
+	testutils.CheckInt(11, len(written), t)
+	testutils.CheckByteSlice(msgs[1][10:], written[0], t)
+	for i := 1; i < len(written); i++ {
+		testutils.CheckByteSlice(msgs[i+1], written[i], t)
+	}
+	// but the tee gets all of it
+	teedMsgs := unframe(teed.Bytes(), t)
+	testutils.CheckInt(len(msgs), len(teedMsgs), t)
+	for i := range msgs {
+		testutils.CheckByteSlice(msgs[i], teedMsgs[i], t)
+	}
+}
+
+// Accepts n bytes, then fails
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > l.n {
+		n, _ := l.w.Write(p[:l.n])
+		l.n = 0
+		return n, errors.New("Injected failure")
+	}
+	l.n -= len(p)
+	return l.w.Write(p)
+}
+
+func TestWriteToFailure(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	msgs := [][]byte{[]byte("first"), bytes.Repeat(testData, 4)}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	defer track.Close()
+
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	var copied bytes.Buffer
+	n, err := r.WriteTo(&limitedWriter{&copied, 10})
+	testutils.ExpectTrue(err != nil, "Expected the write to fail", t)
+	testutils.CheckInt(10, int(n), t)
+	testutils.CheckUint64(1, r.Offset, t)
+
+	// The reader carries on from whatever made it out
+	copied.Reset()
+	_, err = r.WriteTo(&copied)
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(2, r.Offset, t)
+	written := unframe(copied.Bytes(), t)
+	testutils.CheckInt(1, len(written), t)
+	testutils.CheckByteSlice(msgs[1][3:], written[0], t)
+}
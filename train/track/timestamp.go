@@ -0,0 +1,191 @@
+package track
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// ErrNoTimestamp is returned for messages which were written without Timestamps set, or
+// whose timestamp was lost because the track crashed before it was flushed
+var ErrNoTimestamp = errors.New("Message has no timestamp")
+
+// With Timestamps set, each chunk has a file beside it holding a little endian uint64 per
+// message: the nanoseconds since the Unix epoch at which the writer wrote it. Zero means
+// the message has no timestamp
+func timestampsName(id, root string) string {
+	return fname(id+".ts", root)
+}
+
+// The writer's state for timestamping messages
+type stamper struct {
+	file *os.File // The timestamps of the active chunk
+	last int64    // The last timestamp given out
+}
+
+// Start writing timestamps for the given store, which has just become the active chunk.
+// Timestamps carry on from the track's latest one, in case the clock has gone backwards
+func (s *stamper) switchTo(t *Track, store *FileStorage) error {
+	closeErr := s.close()
+	file, err := os.OpenFile(timestampsName(store.fileId, store.rootPath), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return firstErr(closeErr, err)
+	}
+	s.file = file
+	if latest := t.LatestOffset(); latest > 0 {
+		if ts, err := t.Timestamp(latest - 1); err == nil && ts.UnixNano() > s.last {
+			s.last = ts.UnixNano()
+		}
+	}
+	return closeErr
+}
+
+// Give the message with the given index in the active chunk a timestamp. Timestamps
+// strictly increase, even if the clock doesn't tick between messages
+func (s *stamper) stamp(index uint64) (int64, error) {
+	ts := time.Now().UnixNano()
+	if ts <= s.last {
+		ts = s.last + 1
+	}
+	s.last = ts
+	if s.file == nil {
+		return ts, errors.New("Timestamps file isn't open")
+	}
+	var buf [_nSize]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(ts))
+	_, err := s.file.WriteAt(buf[:], int64(index*_nSize))
+	return ts, err
+}
+
+func (s *stamper) sync() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+func (s *stamper) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := firstErr(s.file.Sync(), s.file.Close())
+	s.file = nil
+	return err
+}
+
+// WriteMessageStamped is like WriteMessageCommit, but also returns the timestamp the
+// message was given. Only works for tracks with Timestamps set
+func (t *Track) WriteMessageStamped(data []byte) (uint64, time.Time, error) {
+	if !t.config.Timestamps {
+		return 0, time.Time{}, errors.New("Track isn't timestamping messages, set Timestamps in its config")
+	}
+	result := t.commitResult(writeRequest{data: data})
+	return result.offset, time.Unix(0, result.timestamp), result.err
+}
+
+// Timestamp returns the time at which the message at the given offset was written
+func (t *Track) Timestamp(offset uint64) (time.Time, error) {
+	t.dataCond.L.Lock()
+	chunk, i := t.locate(offset)
+	if chunk < 0 {
+		t.dataCond.L.Unlock()
+		return time.Time{}, ErrOffsetTrimmed
+	} else if chunk >= len(t.stores) || i >= t.stores[chunk].Size {
+		t.dataCond.L.Unlock()
+		return time.Time{}, fmt.Errorf("Offset %d hasn't been written", offset)
+	}
+	name := timestampsName(t.stores[chunk].fileId, t.stores[chunk].rootPath)
+	t.dataCond.L.Unlock()
+
+	ts, err := readTimestamp(name, i)
+	if err != nil {
+		return time.Time{}, err
+	} else if ts == 0 {
+		return time.Time{}, ErrNoTimestamp
+	}
+	return time.Unix(0, ts), nil
+}
+
+// ReaderSince returns a reader positioned at the first durable message written at or after ts
+// if inclusive is set, or strictly after it if not. Timestamps normally strictly increase, but
+// a track pieced together from elsewhere may repeat them, in which case the reader starts at
+// the first of the repeats if inclusive, and after the last of them if not. Messages without
+// timestamps count as older than any time. If no durable message qualifies, the reader starts
+// at the durable offset and waits. The reader has OnlyDurable set
+func (t *Track) ReaderSince(ts time.Time, inclusive bool) (*StorageReader, error) {
+	t.dataCond.L.Lock()
+	start, end := t.durable, t.durable
+	if len(t.stores) > 0 && t.stores[0].baseOffset < end {
+		start = t.stores[0].baseOffset
+	}
+	t.dataCond.L.Unlock()
+
+	// Binary search for the first message that's late enough
+	target := ts.UnixNano()
+	var searchErr error
+	n := sort.Search(int(end-start), func(i int) bool {
+		stamp, err := t.Timestamp(start + uint64(i))
+		if err == ErrNoTimestamp {
+			return false
+		} else if err != nil {
+			searchErr = err
+			return true
+		}
+		if inclusive {
+			return stamp.UnixNano() >= target
+		}
+		return stamp.UnixNano() > target
+	})
+	if searchErr != nil {
+		return nil, searchErr
+	}
+	r, err := t.ReaderAt(start + uint64(n))
+	if err != nil {
+		return nil, err
+	}
+	r.OnlyDurable = true
+	return r, nil
+}
+
+// Read the timestamp of the message with the given index from the named timestamps file.
+// Returns 0 if there isn't one
+func readTimestamp(name string, index uint64) (int64, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var buf [_nSize]byte
+	_, err = f.ReadAt(buf[:], int64(index*_nSize))
+	if err == io.EOF {
+		return 0, nil
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:])), err
+}
+
+// Concatenate the timestamps of the given stores into those of the store with the given id
+func mergeTimestamps(root, id string, group []*FileStorage) error {
+	var data []byte
+	found := false
+	for _, store := range group {
+		ts, err := ioutil.ReadFile(timestampsName(store.fileId, store.rootPath))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		found = found || err == nil
+		padded := make([]byte, store.Size*_nSize)
+		copy(padded, ts)
+		data = append(data, padded...)
+	}
+	if !found {
+		return nil
+	}
+	return replaceFile(timestampsName(id, root), data)
+}
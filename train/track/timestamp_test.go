@@ -0,0 +1,112 @@
+package track
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestTimestampsStrictlyIncrease(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 100
+
+	config := DefaultTrackConfig()
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	stamps := make([]time.Time, 0)
+	for i := 0; i < 1000; i++ {
+		offset, ts, err := track.WriteMessageStamped(testData)
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(uint64(i), offset, t)
+		stamps = append(stamps, ts)
+	}
+	for i := 1; i < len(stamps); i++ {
+		testutils.ExpectTrue(stamps[i].After(stamps[i-1]), fmt.Sprintf("Expected timestamp %d to be after %d", i, i-1), t)
+	}
+	for _, offset := range []uint64{0, 99, 100, 999} {
+		ts, err := track.Timestamp(offset)
+		testutils.CheckErr(err, t)
+		testutils.ExpectTrue(ts.Equal(stamps[offset]), fmt.Sprintf("Expected the timestamp of %d to be %v, got %v", offset, stamps[offset], ts), t)
+	}
+	testutils.CheckErr(track.Close(), t)
+
+	// Timestamps carry on increasing after reopening, and survive merging
+	track, err = OpenTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	_, ts, err := track.WriteMessageStamped(testData)
+	testutils.CheckErr(err, t)
+	testutils.ExpectTrue(ts.After(stamps[999]), "Expected timestamps to increase after reopening", t)
+	testutils.CheckErr(track.MergeChunks(1000), t)
+	for _, offset := range []uint64{0, 150, 999} {
+		ts, err := track.Timestamp(offset)
+		testutils.CheckErr(err, t)
+		testutils.ExpectTrue(ts.Equal(stamps[offset]), fmt.Sprintf("Expected the timestamp of %d to be %v after merging, got %v", offset, stamps[offset], ts), t)
+	}
+}
+
+func TestNoTimestamps(t *testing.T) {
+	cleanupTrack()
+	track := NewTrack("", "id")
+	defer track.Close()
+	_, _, err := track.WriteMessageStamped(testData)
+	testutils.ExpectTrue(err != nil, "Expected stamped writes to need Timestamps", t)
+	_, err = track.WriteMessageCommit(testData)
+	testutils.CheckErr(err, t)
+	_, err = track.Timestamp(0)
+	testutils.ExpectTrue(err == ErrNoTimestamp, fmt.Sprintf("Expected ErrNoTimestamp, got %v", err), t)
+	_, err = track.Timestamp(1)
+	testutils.ExpectTrue(err != nil, "Expected an unwritten offset to have no timestamp", t)
+}
+
+func TestReaderSince(t *testing.T) {
+	cleanupTrack()
+	config := DefaultTrackConfig()
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	msgs := make([][]byte, 6)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err = track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	// Repeat some timestamps, as if they weren't forced to increase
+	stamps := []int64{10, 20, 20, 20, 30, 40}
+	data := make([]byte, len(stamps)*_nSize)
+	for i, ts := range stamps {
+		binary.LittleEndian.PutUint64(data[i*_nSize:], uint64(ts))
+	}
+	testutils.CheckErr(ioutil.WriteFile(timestampsName(chunkName("id", 0), ""), data, 0666), t)
+
+	for _, c := range []struct {
+		ts        int64
+		inclusive bool
+		expected  uint64
+	}{
+		{5, true, 0}, {5, false, 0},
+		{10, true, 0}, {10, false, 1},
+		{20, true, 1}, {20, false, 4},
+		{25, true, 4}, {25, false, 4},
+		{40, true, 5}, {40, false, 6},
+		{50, true, 6},
+	} {
+		r, err := track.ReaderSince(time.Unix(0, c.ts), c.inclusive)
+		testutils.CheckErr(err, t)
+		testutils.CheckUint64(c.expected, r.Offset, t)
+		testutils.ExpectTrue(r.OnlyDurable, "Expected the reader to only read durable messages", t)
+		if c.expected < uint64(len(msgs)) {
+			msg, err := r.Next()
+			testutils.CheckErr(err, t)
+			testutils.CheckByteSlice(msgs[c.expected], msg, t)
+		}
+		r.Close()
+	}
+}
@@ -0,0 +1,75 @@
+package track
+
+// Trim deletes the sealed chunks at the start of the track which only hold messages before
+// the given offset. Chunks are only ever deleted whole, so some earlier messages may remain.
+// The last chunk is never deleted. Readers of the deleted offsets get ErrOffsetTrimmed,
+// including any which are part way through a deleted chunk
+func (t *Track) Trim(offset uint64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	_, err := t.trimChunks(func(store *FileStorage) (bool, error) {
+		return store.baseOffset+store.Capacity <= offset, nil
+	})
+	return err
+}
+
+// Delete sealed chunks from the start of the track while they're expired, and rewrite the
+// manifest to match. Returns the number of chunks deleted
+func (t *Track) trimChunks(expired func(*FileStorage) (bool, error)) (int, error) {
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+	n, keepFrom, err := t.countExpired(expired)
+	if n == 0 {
+		return 0, err
+	}
+	// Only list the chunks after them while they're deleted, so that a crash part way
+	// through leaves a track which still opens
+	err = firstErr(err, t.writeManifestOf(func(s *FileStorage) bool {
+		return s.baseOffset >= keepFrom
+	}))
+	if err != nil {
+		return 0, err
+	}
+	count, err := t.deleteChunks(n)
+	return count, firstErr(err, t.writeManifest())
+}
+
+// Close and remove the first n chunks of the track. Returns the number removed
+func (t *Track) deleteChunks(n int) (int, error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	count := 0
+	for ; count < n; count++ {
+		store := t.stores[0]
+		// Readers in this chunk have their own open file, and find out it's gone the
+		// next time they look for a message
+		err := firstErr(store.Close(), removeStorage(store.fileId, store.rootPath))
+		if err != nil {
+			return count, err
+		}
+		t.stores = t.stores[1:]
+	}
+	return count, nil
+}
+
+// Count the sealed chunks at the start of the track which are expired, and return the
+// base offset of the first chunk after them. The last chunk is never counted, even once
+// it's sealed, so the track keeps its offsets.
+// Must be called with mergeMutex held, so that they can't change before they're deleted
+func (t *Track) countExpired(expired func(*FileStorage) (bool, error)) (int, uint64, error) {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	n := 0
+	for n < len(t.stores)-1 && t.stores[n].readOnly {
+		ok, err := expired(t.stores[n])
+		if err != nil || !ok {
+			return n, t.stores[n].baseOffset, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, 0, nil
+	}
+	return n, t.stores[n].baseOffset, nil
+}
@@ -0,0 +1,143 @@
+package track
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestTrimUnderReader(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	// One reader part way through the first chunk, and one part way through a message in it
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	msg, err := r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[0], msg, t)
+	partial, err := track.ReaderAt(3)
+	testutils.CheckErr(err, t)
+	defer partial.Close()
+	partial.PartialReads = true
+	buf := make([]byte, 4)
+	_, err = partial.Read(buf)
+	testutils.CheckErr(err, t)
+
+	// Trimming only removes whole chunks
+	testutils.CheckErr(track.Trim(7), t)
+	testutils.CheckInt(2, len(track.stores), t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 0), "")), "Expected the trimmed chunk to be deleted", t)
+	testutils.CheckUint64(5, track.EarliestOffset(), t)
+
+	for _, reader := range []*StorageReader{r, partial} {
+		_, err = reader.Read(buf)
+		testutils.ExpectTrue(err == ErrOffsetTrimmed, "Expected the reader's chunk to be trimmed", t)
+		testutils.ExpectTrue(reader.currentSub == nil, "Expected the reader to close its chunk", t)
+	}
+
+	// Moving past the trimmed chunk carries on from there
+	r.Offset = track.EarliestOffset()
+	msg, err = r.Next()
+	testutils.CheckErr(err, t)
+	testutils.CheckByteSlice(msgs[5], msg, t)
+
+	// The last chunk is kept whatever the offset
+	testutils.CheckErr(track.Trim(100), t)
+	testutils.CheckInt(1, len(track.stores), t)
+	testutils.CheckUint64(10, track.EarliestOffset(), t)
+	testutils.CheckUint64(12, track.LatestOffset(), t)
+	cleanupTrack()
+}
+
+func TestTrimFailedManifest(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+
+	// The manifest can't be rewritten while something's in the way of its temporary file
+	blocker := manifestName("", "id") + ".tmp"
+	testutils.CheckErr(os.Mkdir(blocker, 0755), t)
+	defer os.Remove(blocker)
+	testutils.ExpectTrue(track.Trim(7) != nil, "Expected the trim to fail", t)
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(0, track.EarliestOffset(), t)
+	r, err := track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	for i := range msgs {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckByteSlice(msgs[i], msg, t)
+	}
+	cleanupTrack()
+}
+
+// A crash after the manifest has dropped the trimmed chunks, but before they're deleted
+func TestTrimInterrupted(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	_, err := track.WriteAllSync([][]byte{testData, testData, testData, testData, testData, testData})
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.writeManifestOf(func(s *FileStorage) bool { return s.baseOffset >= 5 }), t)
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackWithConfig("", "id", DefaultTrackConfig())
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Trim(5), t)
+	testutils.CheckUint64(5, track.EarliestOffset(), t)
+	testutils.CheckErr(track.Close(), t)
+	track, err = OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	testutils.CheckUint64(5, track.EarliestOffset(), t)
+	cleanupTrack()
+}
+
+func TestHasOffset(t *testing.T) {
+	cleanupTrack()
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+
+	track := NewTrack("", "id")
+	defer track.Close()
+	testutils.ExpectTrue(!track.HasOffset(0), "Expected nothing to be readable in an empty track", t)
+	msgs := make([][]byte, 12)
+	for i := range msgs {
+		msgs[i] = []byte(fmt.Sprintf("message %d", i))
+	}
+	_, err := track.WriteAllSync(msgs)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Trim(7), t)
+
+	for offset := uint64(0); offset < 20; offset++ {
+		expected := offset >= 5 && offset < 12
+		testutils.ExpectTrue(track.HasOffset(offset) == expected, fmt.Sprintf("Expected HasOffset(%d) to be %v", offset, expected), t)
+	}
+}
@@ -0,0 +1,124 @@
+package track
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrTruncated is returned by readers which were past the offset a track was cut back to
+// with TruncateTo, since the messages they were about to read are gone. SeekTo carries on
+var ErrTruncated = errors.New("Track was truncated to before the reader's offset")
+
+// TruncateTo drops every message from the given offset on, so that the next message written
+// gets that offset. Later chunks are deleted, and the chunk holding the offset is cut back,
+// even if it had been sealed. The writer finishes the writes queued before it first, and
+// doesn't start on later ones until it's done. Readers past the offset get ErrTruncated.
+// Offsets at or past the end of the track are left alone, and trimmed offsets give
+// ErrOffsetTrimmed
+func (t *Track) TruncateTo(offset uint64) error {
+	if t.readOnly {
+		return ErrReadOnly
+	}
+	_, err := t.commit(writeRequest{barrier: true, truncate: true, offset: offset})
+	return err
+}
+
+// Drop every message from the given offset on, for TruncateTo, and return the store to
+// write to next, which replaces active. Returns nil if it failed part way through, and the
+// track needs reloading. Must only be called by the writer
+func (t *Track) truncateTo(active *FileStorage, offset uint64) (*FileStorage, error) {
+	t.mergeMutex.Lock()
+	defer t.mergeMutex.Unlock()
+	t.dataCond.L.Lock()
+	n, i := t.locate(offset)
+	if offset >= t.latestOffset() {
+		t.dataCond.L.Unlock()
+		return active, nil
+	} else if n < 0 {
+		t.dataCond.L.Unlock()
+		return active, ErrOffsetTrimmed
+	}
+	cut := t.stores[n]
+	t.dataCond.L.Unlock()
+
+	// Drop the chunks being changed from the manifest first, so that a crash part way
+	// through leaves a track which still opens
+	err := t.writeManifestOf(func(store *FileStorage) bool {
+		return store.baseOffset < cut.baseOffset
+	})
+	if err != nil {
+		return active, err
+	}
+
+	t.readersMutex.Lock()
+	t.dataCond.L.Lock()
+	for r := range t.readers {
+		if atomic.LoadUint64(&r.Offset) >= offset {
+			r.truncated = true
+			r.cut = offset
+		}
+	}
+	t.truncations++
+	next, err := t.cutStores(n, i)
+	t.dataCond.L.Unlock()
+	t.readersMutex.Unlock()
+	t.dataCond.Broadcast()
+	if err == nil && t.keys != nil {
+		err = t.rebuildKeyIndex()
+	}
+	return next, err
+}
+
+// Delete the chunks after chunk n, and cut chunk n back to its first i messages, making it
+// the active chunk, which is returned. Returns nil if that can't be done.
+// Must be called with dataCond.L held
+func (t *Track) cutStores(n int, i uint64) (*FileStorage, error) {
+	// From the end, so the chunks left are always a whole track
+	for len(t.stores) > n+1 {
+		last := t.stores[len(t.stores)-1]
+		err := firstErr(last.Close(), removeStorage(last.fileId, last.rootPath))
+		if err != nil {
+			return nil, err
+		}
+		t.stores = t.stores[:len(t.stores)-1]
+	}
+	store := t.stores[n]
+	if store.readOnly {
+		reopened, err := openStorage(store.rootPath, store.fileId, true)
+		if err != nil {
+			return nil, err
+		}
+		reopened.baseOffset = store.baseOffset
+		store.Close()
+		t.stores[n] = reopened
+		store = reopened
+	}
+	store.checkWrites = t.config.ChecksOnWrite
+	err := store.TruncateTo(i)
+	if err == nil {
+		err = t.syncStore(store)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.setDurable(t.latestOffset())
+	return store, nil
+}
+
+// Check whether the reader was past the offset the track has been truncated to.
+// Readers at that offset carry on, from the next message written there.
+// Must be called with dataCond.L held
+func (sr *StorageReader) checkTruncated() error {
+	if !sr.truncated {
+		return nil
+	} else if sr.Offset != sr.cut || sr.partial > 0 {
+		return ErrTruncated
+	}
+	sr.truncated = false
+	if sr.currentSub != nil {
+		// It was positioned for the message which was dropped
+		sr.currentSub.Close()
+		sr.currentSub = nil
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestTrackTruncateTo(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+
+	config := indexedConfig()
+	config.Timestamps = true
+	track, err := NewTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	for i := 0; i < 10; i++ {
+		testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte(fmt.Sprintf("k%d", i%4)), []byte(fmt.Sprint(i)))), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	testutils.CheckInt(2, len(track.stores), t)
+
+	// One reader before the cut, one at it, and one past it
+	before, err := track.ReaderAt(1)
+	testutils.CheckErr(err, t)
+	defer before.Close()
+	testutils.CheckErr(before.SetReadAhead(4), t)
+	_, err = before.Next()
+	testutils.CheckErr(err, t)
+	at, err := track.ReaderAt(3)
+	testutils.CheckErr(err, t)
+	defer at.Close()
+	past, err := track.ReaderAt(7)
+	testutils.CheckErr(err, t)
+	defer past.Close()
+	_, err = past.Next()
+	testutils.CheckErr(err, t)
+
+	testutils.CheckErr(track.TruncateTo(3), t)
+	testutils.CheckUint64(3, track.LatestOffset(), t)
+	testutils.CheckUint64(3, track.DurableOffset(), t)
+	testutils.CheckInt(1, len(track.stores), t)
+	testutils.ExpectTrue(!exists(fname(chunkName("id", 1), "")), "Expected the second chunk to be deleted", t)
+	checkGet(track, "k1", "1", t)
+	checkGet(track, "k3", "", t)
+	// Truncating past the end does nothing
+	testutils.CheckErr(track.TruncateTo(10), t)
+	testutils.CheckUint64(3, track.LatestOffset(), t)
+
+	// Writes carry on from the cut, into new chunks as before
+	for i := 3; i < 8; i++ {
+		testutils.CheckErr(track.WriteKeyed(KeyedMessage([]byte("k3"), []byte(fmt.Sprintf("new %d", i)))), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	testutils.CheckUint64(8, track.LatestOffset(), t)
+	testutils.CheckInt(2, len(track.stores), t)
+	checkGet(track, "k3", "new 7", t)
+
+	_, err = past.Next()
+	testutils.ExpectTrue(err == ErrTruncated, fmt.Sprintf("Expected ErrTruncated past the cut, got %v", err), t)
+	testutils.CheckErr(past.SeekTo(4), t)
+	msg, err := past.ReadMessage()
+	testutils.CheckErr(err, t)
+	testutils.CheckString("new 4", string(msg.Value), t)
+	for _, r := range []*StorageReader{before, at} {
+		for r.Offset < 4 {
+			_, err = r.Next()
+			testutils.CheckErr(err, t)
+		}
+		msg, err = r.ReadMessage()
+		testutils.CheckErr(err, t)
+		testutils.CheckString("new 4", string(msg.Value), t)
+	}
+	_, err = track.Timestamp(7)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Close(), t)
+
+	track, err = OpenTrackWithConfig("", "id", config)
+	testutils.CheckErr(err, t)
+	defer track.Close()
+	testutils.CheckUint64(8, track.LatestOffset(), t)
+	testutils.CheckErr(track.Verify(), t)
+	checkGet(track, "k3", "new 7", t)
+	_, err = track.ReaderAt(0)
+	testutils.CheckErr(err, t)
+	testutils.CheckErr(track.Trim(5), t)
+	testutils.ExpectTrue(track.TruncateTo(2) == ErrOffsetTrimmed, "Expected truncating into trimmed chunks to fail", t)
+}
@@ -0,0 +1,52 @@
+package track
+
+import (
+	"errors"
+)
+
+// ErrTrackChanged is returned by Upgrade when the track has been written since it was opened
+var ErrTrackChanged = errors.New("Track has been written since it was opened read-only")
+
+// Upgrade makes a track opened with OpenTrackReadOnly writable, without closing and
+// reopening it. The last chunk is reopened for writing, unless it was sealed, and the
+// writer is started with the default config. Open readers carry on, and see the new
+// messages. Tracks have no lock to keep out other writers, so the caller has to make sure
+// nothing else is writing the track. Upgrade does check that nothing has been written
+// since the track was opened, and fails with ErrTrackChanged if it has
+func (t *Track) Upgrade() error {
+	t.dataCond.L.Lock()
+	defer t.dataCond.L.Unlock()
+	if !t.readOnly {
+		return errors.New("Track is already writable")
+	}
+	chunks, err := discoverChunks(t.RootPath, t.Id, t.namer())
+	if err != nil {
+		return err
+	}
+	chunks = t.pruneEmptyChunks(chunks, true)
+	n := len(t.stores)
+	if n == 0 {
+		if len(chunks) > 0 {
+			return ErrTrackChanged
+		}
+	} else if len(chunks) == 0 || chunks[len(chunks)-1] != t.chunkNumber(t.stores[n-1]) {
+		return ErrTrackChanged
+	} else if last := t.stores[n-1]; !last.sealed {
+		store, err := OpenFileStorage(last.rootPath, last.fileId)
+		if err != nil {
+			return err
+		} else if store.Size != last.Size || store.sealed {
+			store.Close()
+			return ErrTrackChanged
+		}
+		store.baseOffset = last.baseOffset
+		t.stores[n-1] = store
+		last.Close()
+	}
+	t.readOnly = false
+	t.alive = true
+	t.startWriter()
+	t.startSweeper()
+	t.startCompactor()
+	return nil
+}
@@ -0,0 +1,55 @@
+package track
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/asp2insp/go-misc/testutils"
+)
+
+func TestUpgrade(t *testing.T) {
+	defer func(size uint64) { CHUNK_SIZE = size }(CHUNK_SIZE)
+	CHUNK_SIZE = 5
+	cleanupTrack()
+
+	track := NewTrack("", "id")
+	for i := 0; i < 7; i++ {
+		track.WriteMessage([]byte(fmt.Sprint(i)))
+	}
+	testutils.CheckErr(track.Close(), t)
+
+	track, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	r, err := track.ReaderAt(6)
+	testutils.CheckErr(err, t)
+	defer r.Close()
+	testutils.ExpectTrue(track.WriteMessage(testData) == ErrReadOnly, "Expected writes to fail before upgrading", t)
+
+	testutils.CheckErr(track.Upgrade(), t)
+	testutils.ExpectTrue(track.Upgrade() != nil, "Expected a second upgrade to fail", t)
+	for i := 7; i < 12; i++ {
+		testutils.CheckErr(track.WriteMessage([]byte(fmt.Sprint(i))), t)
+	}
+	testutils.CheckErr(track.Flush(), t)
+	testutils.CheckUint64(12, track.LatestOffset(), t)
+	for i := 6; i < 12; i++ {
+		msg, err := r.Next()
+		testutils.CheckErr(err, t)
+		testutils.CheckString(fmt.Sprint(i), string(msg), t)
+	}
+	testutils.CheckErr(track.Close(), t)
+
+	track = OpenTrack("", "id")
+	testutils.CheckUint64(12, track.LatestOffset(), t)
+	testutils.CheckErr(track.Verify(), t)
+	testutils.CheckErr(track.Close(), t)
+
+	// Written by someone else since it was opened
+	readOnly, err := OpenTrackReadOnly("", "id")
+	testutils.CheckErr(err, t)
+	track = OpenTrack("", "id")
+	testutils.CheckErr(track.WriteMessage(testData), t)
+	testutils.CheckErr(track.Close(), t)
+	testutils.ExpectTrue(readOnly.Upgrade() == ErrTrackChanged, "Expected the upgrade to see the new message", t)
+	cleanupTrack()
+}